@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+)
+
+// backup writes a backup archive of a database directory that is not in use by a server
+func backup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	db_write_path := flags.String("db", "", "path to the db data")
+	out := flags.String("o", "", "path of the backup archive to write")
+	names := flags.String("name", "", "comma separated databases to back up. all databases are backed up when empty")
+	show_logs := flags.Bool("log", false, "print logs")
+	key_file := flags.String("key-file", "", "file with the db's key. defaults to ENV.TDB_KEY")
+	flags.Parse(args)
+
+	if len(*db_write_path) == 0 || len(*out) == 0 {
+		fmt.Fprintln(os.Stderr, "backup: -db and -o are required")
+		os.Exit(2)
+	}
+	if !path.IsAbs(*db_write_path) {
+		cwd, _ := os.Getwd()
+		*db_write_path = path.Join(cwd, *db_write_path)
+	}
+
+	write_settings := builder.NewWriteSettings(*db_write_path, false, 0)
+	write_settings.Cipher = mustLoadCipher("backup", *key_file, "TDB_KEY")
+	db := builder.NewTobsDB(builder.AuthSettings{}, write_settings, builder.LogOptions{Should_log: *show_logs})
+
+	var keys []string
+	if *names != "" {
+		keys = strings.Split(*names, ",")
+	}
+	db.Locker.Lock()
+	manifest, err := db.BackupToFile(*out, keys)
+	db.Locker.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup: %s\n", err)
+		os.Exit(1)
+	}
+
+	res, _ := json.MarshalIndent(manifest, "", "  ")
+	fmt.Println(string(res))
+}
+
+// restore extracts a backup archive into a new database directory
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "path of the backup archive")
+	db_write_path := flags.String("db", "", "directory to restore the db data to. it must not exist or be empty")
+	flags.Parse(args)
+
+	if len(*from) == 0 || len(*db_write_path) == 0 {
+		fmt.Fprintln(os.Stderr, "restore: -from and -db are required")
+		os.Exit(2)
+	}
+
+	manifest, err := builder.RestoreFromFile(*from, *db_write_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore: %s\n", err)
+		os.Exit(1)
+	}
+
+	res, _ := json.MarshalIndent(manifest, "", "  ")
+	fmt.Println(string(res))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/query"
+)
+
+// openDB loads the database directory for a subcommand and returns the named database
+func openDB(cmd, db_write_path, key_file, name string, show_logs bool) (*builder.TobsDB, *builder.Schema) {
+	if len(db_write_path) == 0 || len(name) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: -db and -name are required\n", cmd)
+		os.Exit(2)
+	}
+	if !path.IsAbs(db_write_path) {
+		cwd, _ := os.Getwd()
+		db_write_path = path.Join(cwd, db_write_path)
+	}
+
+	write_settings := builder.NewWriteSettings(db_write_path, false, 0)
+	write_settings.Cipher = mustLoadCipher(cmd, key_file, "TDB_KEY")
+	db := builder.NewTobsDB(builder.AuthSettings{}, write_settings, builder.LogOptions{Should_log: show_logs})
+	schema := db.Data.Get(name)
+	if schema == nil {
+		fmt.Fprintf(os.Stderr, "%s: database %s not found\n", cmd, name)
+		os.Exit(1)
+	}
+	return db, schema
+}
+
+// export writes the tables of a database to a directory, one file per table
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	db_write_path := flags.String("db", "", "path to the db data")
+	name := flags.String("name", "", "database to export")
+	out := flags.String("o", "", "directory to write the exported tables to")
+	format := flags.String("format", string(query.ExportFormatNDJSON), "format of the exported tables: ndjson or csv")
+	tables := flags.String("tables", "", "comma separated tables to export. all tables are exported when empty")
+	show_logs := flags.Bool("log", false, "print logs")
+	key_file := flags.String("key-file", "", "file with the db's key. defaults to ENV.TDB_KEY")
+	flags.Parse(args)
+
+	if len(*out) == 0 {
+		fmt.Fprintln(os.Stderr, "export: -o is required")
+		os.Exit(2)
+	}
+	_, schema := openDB("export", *db_write_path, *key_file, *name, *show_logs)
+
+	var names []string
+	if *tables != "" {
+		names = strings.Split(*tables, ",")
+	}
+	// ctrl-c stops the export between rows and reports it as an error
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	manifest, err := query.ExportSchema(ctx, schema, *out, query.ExportFormat(*format), names)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %s\n", err)
+		os.Exit(1)
+	}
+
+	res, _ := json.MarshalIndent(manifest, "", "  ")
+	fmt.Println(string(res))
+}
+
+// import_ adds the tables exported to a directory to a database.
+// it is named so because import is a keyword
+func import_(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	db_write_path := flags.String("db", "", "path to the db data")
+	name := flags.String("name", "", "database to import into")
+	from := flags.String("from", "", "directory of the exported tables")
+	show_logs := flags.Bool("log", false, "print logs")
+	key_file := flags.String("key-file", "", "file with the db's key. defaults to ENV.TDB_KEY")
+	flags.Parse(args)
+
+	if len(*from) == 0 {
+		fmt.Fprintln(os.Stderr, "import: -from is required")
+		os.Exit(2)
+	}
+	db, schema := openDB("import", *db_write_path, *key_file, *name, *show_logs)
+
+	imported, err := query.ImportSchema(schema, *from)
+	if len(imported) > 0 {
+		db.WriteToFile()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %s\n", err)
+		os.Exit(1)
+	}
+
+	res, _ := json.MarshalIndent(imported, "", "  ")
+	fmt.Println(string(res))
+}
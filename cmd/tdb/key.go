@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// loadCipher reads the base64 encoded key in key_file, or in the env variable env when key_file is empty.
+// It returns nil when neither is set, in which case files are not encrypted.
+func loadCipher(key_file, env string) (*pkg.Cipher, error) {
+	encoded := os.Getenv(env)
+	if key_file != "" {
+		data, err := os.ReadFile(key_file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := pkg.ParseKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewCipher(key)
+}
+
+// mustLoadCipher is loadCipher for commands that exit when the key cannot be loaded
+func mustLoadCipher(cmd, key_file, env string) *pkg.Cipher {
+	c, err := loadCipher(key_file, env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+		os.Exit(2)
+	}
+	return c
+}
+
+// keygen prints a new random key
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	flags.Parse(args)
+
+	key := make([]byte, pkg.KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		fmt.Fprintf(os.Stderr, "keygen: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+}
+
+// rekey re-encrypts a database directory that is not in use by a server with a new key
+func rekey(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	db_write_path := flags.String("db", "", "path to the db data")
+	key_file := flags.String("key-file", "", "file with the current key. defaults to ENV.TDB_KEY; the db is read as unencrypted when neither is set")
+	new_key_file := flags.String("new-key-file", "", "file with the new key. defaults to ENV.TDB_NEW_KEY")
+	decrypt := flags.Bool("decrypt", false, "write the db unencrypted instead of with a new key")
+	flags.Parse(args)
+
+	if len(*db_write_path) == 0 {
+		fmt.Fprintln(os.Stderr, "rekey: -db is required")
+		os.Exit(2)
+	}
+	if !path.IsAbs(*db_write_path) {
+		cwd, _ := os.Getwd()
+		*db_write_path = path.Join(cwd, *db_write_path)
+	}
+
+	from := mustLoadCipher("rekey", *key_file, "TDB_KEY")
+	var to *pkg.Cipher
+	if !*decrypt {
+		to = mustLoadCipher("rekey", *new_key_file, "TDB_NEW_KEY")
+		if to == nil {
+			fmt.Fprintln(os.Stderr, "rekey: -new-key-file, ENV.TDB_NEW_KEY or -decrypt is required")
+			os.Exit(2)
+		}
+	}
+
+	stats, err := builder.Rekey(*db_write_path, from, to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rekey: %s\n", err)
+		os.Exit(1)
+	}
+
+	out, _ := json.MarshalIndent(stats, "", "  ")
+	fmt.Println(string(out))
+}
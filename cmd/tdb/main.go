@@ -5,15 +5,43 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
 	"github.com/tobsdb/tobsdb/internal/conn"
+	"github.com/tobsdb/tobsdb/internal/paging"
 )
 
 // version gets set by goreleaser when building
 var version = "-dev"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "repair":
+			repair(os.Args[2:])
+			return
+		case "backup":
+			backup(os.Args[2:])
+			return
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "export":
+			export(os.Args[2:])
+			return
+		case "import":
+			import_(os.Args[2:])
+			return
+		case "rekey":
+			rekey(os.Args[2:])
+			return
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		}
+	}
+
 	db_write_path := flag.String("db", "", "path to load and save db data")
 	in_mem := flag.Bool("m", false, "use in-memory mode: don't persist db")
 	port := flag.Int("port", 7085, "listening port")
@@ -22,6 +50,10 @@ func main() {
 	username := flag.String("u", os.Getenv("TDB_USER"), "username")
 	password := flag.String("p", os.Getenv("TDB_PASS"), "password")
 	idle_interval := flag.Int("w", 1000, "time to wait before writing data when idle")
+	page_cache_size := flag.Int("page-cache", builder.DEFAULT_PAGE_CACHE_SIZE, "number of pages to keep in memory per schema")
+	compression := flag.String("compress", "none", "compression of pages written to disk: none or flate")
+	key_file := flag.String("key-file", "", "file with the key to encrypt db files with. defaults to ENV.TDB_KEY")
+	sweep_interval := flag.Int("sweep", int(builder.DEFAULT_SWEEP_INTERVAL/time.Millisecond), "time between deletes of expired rows in ms")
 	print_version := flag.Bool("v", false, "print version and exit")
 
 	flag.Parse()
@@ -36,10 +68,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	page_compression, err := paging.ParseCompression(*compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	write_settings := builder.NewWriteSettings(*db_write_path, *in_mem, *idle_interval)
+	write_settings.PageCacheSize = *page_cache_size
+	write_settings.Compression = page_compression
+	write_settings.SweepInterval = time.Duration(*sweep_interval) * time.Millisecond
+	write_settings.Cipher = mustLoadCipher("tdb", *key_file, "TDB_KEY")
 
-	db := builder.NewTobsDB(builder.AuthSettings{*username, *password}, write_settings,
-		builder.LogOptions{*should_log, *show_debug_logs})
+	db := builder.NewTobsDB(builder.AuthSettings{Username: *username, Password: *password}, write_settings,
+		builder.LogOptions{Should_log: *should_log, Show_debug_logs: *show_debug_logs})
 	db.WriteToFile()
 	conn.Listen(db, *port)
 }
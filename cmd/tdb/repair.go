@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+)
+
+// repair rebuilds the indexes of a database directory from its pages
+func repair(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	db_write_path := flags.String("db", "", "path to the db data")
+	name := flags.String("name", "", "only repair this database. all databases are repaired when empty")
+	show_logs := flags.Bool("log", false, "print logs")
+	key_file := flags.String("key-file", "", "file with the db's key. defaults to ENV.TDB_KEY")
+	flags.Parse(args)
+
+	if len(*db_write_path) == 0 {
+		fmt.Fprintln(os.Stderr, "repair: -db is required")
+		os.Exit(2)
+	}
+	if !path.IsAbs(*db_write_path) {
+		cwd, _ := os.Getwd()
+		*db_write_path = path.Join(cwd, *db_write_path)
+	}
+
+	write_settings := builder.NewWriteSettings(*db_write_path, false, 0)
+	write_settings.Cipher = mustLoadCipher("repair", *key_file, "TDB_KEY")
+	db := builder.NewTobsDB(builder.AuthSettings{}, write_settings, builder.LogOptions{Should_log: *show_logs})
+
+	res := map[string][]*builder.RepairStats{}
+	for _, key := range db.Data.Keys() {
+		if *name != "" && key != *name {
+			continue
+		}
+		stats, err := db.Data.Get(key).Repair()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "repair: %s: %s\n", key, err)
+			os.Exit(1)
+		}
+		res[key] = stats
+	}
+	if *name != "" && len(res) == 0 {
+		fmt.Fprintf(os.Stderr, "repair: database %s not found\n", *name)
+		os.Exit(1)
+	}
+
+	out, _ := json.MarshalIndent(res, "", "  ")
+	fmt.Println(string(out))
+}
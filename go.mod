@@ -1,6 +1,6 @@
 module github.com/tobsdb/tobsdb
 
-go 1.21.4
+go 1.23
 
 require (
 	github.com/google/uuid v1.6.0
@@ -0,0 +1,258 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const (
+	BACKUP_MANIFEST_FILE = "BACKUP_MANIFEST"
+	BACKUP_VERSION       = 1
+	// directory in the db path that the backup action writes archives to
+	BACKUP_DIR = ".backups"
+)
+
+// BackupManifest describes the contents of a backup archive
+type BackupManifest struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Databases []BackupDatabase `json:"databases"`
+}
+
+type BackupDatabase struct {
+	Name       string `json:"name"`
+	Generation uint64 `json:"generation"`
+	// paths of the database's files in the archive
+	Files []string `json:"files"`
+}
+
+var ERR_BACKUP_IN_MEM = errors.New("backups are not available in in-memory mode")
+
+func addBackupFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// backup commits the schema and adds its current files to the archive.
+// Callers must hold the schema's lock so no page is written while it is copied.
+func (s *Schema) backup(tw *tar.Writer) (*BackupDatabase, error) {
+	if err := s.writeToFile(); err != nil {
+		return nil, err
+	}
+
+	files := []string{MANIFEST_FILE, generationFile(META_FILE, s.generation)}
+	for _, t := range s.Tables.Idx {
+		files = append(files,
+			path.Join(t.Name, generationFile(INDEX_FILE, s.generation)),
+			path.Join(t.Name, generationFile(PRIMARY_INDEX_FILE, s.generation)))
+		pages, err := paging.ListPages(t.Base())
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range pages {
+			files = append(files, path.Join(t.Name, id.String()))
+		}
+	}
+
+	res := &BackupDatabase{s.Name, s.generation, []string{}}
+	base := s.Base()
+	for _, f := range files {
+		data, err := os.ReadFile(path.Join(base, f))
+		if err != nil {
+			return nil, err
+		}
+		name := path.Join(s.Name, f)
+		if err := addBackupFile(tw, name, data); err != nil {
+			return nil, err
+		}
+		res.Files = append(res.Files, name)
+	}
+	return res, nil
+}
+
+// Backup writes a gzipped tar archive of the named databases, or of every database when names is empty.
+// Each database is locked while it is written to the archive so the archive holds a consistent snapshot of it.
+//
+// Callers must hold tdb's lock.
+func (tdb *TobsDB) Backup(w io.Writer, names []string) (*BackupManifest, error) {
+	if tdb.WriteSettings.InMem {
+		return nil, ERR_BACKUP_IN_MEM
+	}
+	if len(names) == 0 {
+		names = tdb.Data.Keys()
+	}
+	for _, name := range names {
+		if !tdb.Data.Has(name) {
+			return nil, fmt.Errorf("database %s not found", name)
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := &BackupManifest{BACKUP_VERSION, time.Now(), []BackupDatabase{}}
+
+	meta, err := json.Marshal(TdbMeta{names, tdb.Users})
+	if err != nil {
+		return nil, err
+	}
+	if err := addBackupFile(tw, META_FILE, tdb.WriteSettings.Cipher.EncryptFile(meta, META_FILE)); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		s := tdb.Data.Get(name)
+		var db *BackupDatabase
+		pkg.LockWrap(s, func() { db, err = s.backup(tw) })
+		if err != nil {
+			return nil, fmt.Errorf("backup %s: %w", name, err)
+		}
+		manifest.Databases = append(manifest.Databases, *db)
+	}
+
+	// the manifest is written last so an archive cut short is detected on restore
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := addBackupFile(tw, BACKUP_MANIFEST_FILE, data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// BackupToFile writes a backup archive to name
+func (tdb *TobsDB) BackupToFile(name string, names []string) (*BackupManifest, error) {
+	if err := os.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(path.Dir(name), "."+path.Base(name)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	manifest, err := tdb.Backup(f, names)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, os.Rename(f.Name(), name)
+}
+
+// Restore extracts a backup archive into dir, which must not exist or be empty.
+// The result can be loaded as the -db directory of a server.
+func Restore(r io.Reader, dir string) (*BackupManifest, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("restore: %s is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var manifest *BackupManifest
+	extracted := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("restore: invalid path %s", header.Name)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == BACKUP_MANIFEST_FILE {
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("restore: invalid manifest: %w", err)
+			}
+			continue
+		}
+
+		location := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(location), 0o755); err != nil {
+			return nil, err
+		}
+		if err := pkg.WriteFileAtomic(location, data, 0o644); err != nil {
+			return nil, err
+		}
+		extracted[header.Name] = true
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("restore: archive has no %s, it may be incomplete", BACKUP_MANIFEST_FILE)
+	}
+	if manifest.Version > BACKUP_VERSION {
+		return nil, fmt.Errorf("restore: unsupported backup version %d", manifest.Version)
+	}
+	for _, db := range manifest.Databases {
+		for _, f := range db.Files {
+			if !extracted[f] {
+				return nil, fmt.Errorf("restore: %s is missing from the archive", f)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// RestoreFromFile extracts the backup archive at name into dir
+func RestoreFromFile(name, dir string) (*BackupManifest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Restore(f, dir)
+}
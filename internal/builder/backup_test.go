@@ -0,0 +1,91 @@
+package builder_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+func TestBackup(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	rows := s.Tables.Get("a").Rows()
+	for i := 1; i <= 3; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": string(rune('a' + i))}))
+	}
+
+	name := path.Join(t.TempDir(), "backup.tar.gz")
+	s.Tdb.Locker.Lock()
+	manifest, err := s.Tdb.BackupToFile(name, nil)
+	s.Tdb.Locker.Unlock()
+	assert.NilError(t, err)
+	assert.Equal(t, len(manifest.Databases), 1)
+	assert.Equal(t, manifest.Databases[0].Name, s.Name)
+
+	// writes after the backup are not in it
+	assert.Assert(t, rows.Insert(4, TDBTableRow{SYS_PRIMARY_KEY: 4, "b": "z"}))
+
+	dir := path.Join(t.TempDir(), "restored")
+	_, err = RestoreFromFile(name, dir)
+	assert.NilError(t, err)
+
+	tdb := NewTobsDB(AuthSettings{}, NewWriteSettings(dir, false, 0), LogOptions{})
+	restored := tdb.Data.Get(s.Name)
+	assert.Assert(t, restored != nil)
+	a := restored.Tables.Get("a")
+	assert.Equal(t, a.Rows().Len(), 3)
+	row, ok := a.Rows().Get(2)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "c")
+
+	// the target must be empty
+	_, err = RestoreFromFile(name, dir)
+	assert.ErrorContains(t, err, "is not empty")
+}
+
+func TestRestoreIncomplete(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	var buf bytes.Buffer
+	s.Tdb.Locker.Lock()
+	_, err := s.Tdb.Backup(&buf, []string{s.Name})
+	s.Tdb.Locker.Unlock()
+	assert.NilError(t, err)
+
+	// copy the archive without its manifest
+	gz, err := gzip.NewReader(&buf)
+	assert.NilError(t, err)
+	tr := tar.NewReader(gz)
+	var out bytes.Buffer
+	out_gz := gzip.NewWriter(&out)
+	tw := tar.NewWriter(out_gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		if header.Name == BACKUP_MANIFEST_FILE {
+			continue
+		}
+		assert.NilError(t, tw.WriteHeader(header))
+		_, err = io.Copy(tw, tr)
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+	assert.NilError(t, out_gz.Close())
+
+	_, err = Restore(&out, path.Join(t.TempDir(), "restored"))
+	assert.ErrorContains(t, err, BACKUP_MANIFEST_FILE)
+
+	_, err = s.Tdb.Backup(io.Discard, []string{"missing"})
+	assert.ErrorContains(t, err, "not found")
+
+	in_mem := NewTobsDB(AuthSettings{}, NewWriteSettings("", true, 0), LogOptions{})
+	_, err = in_mem.Backup(io.Discard, nil)
+	assert.Equal(t, err, ERR_BACKUP_IN_MEM)
+}
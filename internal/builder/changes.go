@@ -0,0 +1,225 @@
+package builder
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// number of recent changes a ChangeFeed keeps for subscribers that resume
+	CHANGE_FEED_SIZE = 1024
+	// number of changes a subscriber can fall behind by before it is closed
+	CHANGE_SUBSCRIPTION_BUFFER = 256
+)
+
+type ChangeOperation string
+
+const (
+	ChangeOperationCreate ChangeOperation = "create"
+	ChangeOperationUpdate ChangeOperation = "update"
+	ChangeOperationDelete ChangeOperation = "delete"
+)
+
+// Change is a row write in a schema.
+// Before is nil for created rows and After is nil for deleted rows.
+type Change struct {
+	Seq       uint64          `json:"seq"`
+	Table     string          `json:"table"`
+	Operation ChangeOperation `json:"operation"`
+	Before    TDBTableRow     `json:"before"`
+	After     TDBTableRow     `json:"after"`
+	Time      time.Time       `json:"time"`
+}
+
+// ChangeFeed numbers the committed changes of a schema and sends them to its subscribers.
+//
+// Sequence numbers restart with the server, so each feed has its own stream id
+// and subscribers can only resume on the stream they were reading.
+type ChangeFeed struct {
+	locker sync.Mutex
+
+	stream string
+	seq    uint64
+	// the last CHANGE_FEED_SIZE changes, oldest first
+	recent []Change
+
+	subscribers map[*ChangeSubscription]struct{}
+}
+
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{stream: uuid.NewString(), subscribers: map[*ChangeSubscription]struct{}{}}
+}
+
+// Stream returns the id of the feed's sequence of changes
+func (f *ChangeFeed) Stream() string { return f.stream }
+
+// Seq returns the sequence number of the last published change
+func (f *ChangeFeed) Seq() uint64 {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	return f.seq
+}
+
+// Publish numbers changes and sends them to the subscribers.
+// It never blocks: subscribers that fall too far behind are closed instead.
+func (f *ChangeFeed) Publish(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	for _, change := range changes {
+		f.seq++
+		change.Seq = f.seq
+		f.recent = append(f.recent, change)
+		for sub := range f.subscribers {
+			select {
+			case sub.c <- change:
+			default:
+				sub.overflowed = true
+				f.unsubscribe(sub)
+			}
+		}
+	}
+	if extra := len(f.recent) - CHANGE_FEED_SIZE; extra > 0 {
+		f.recent = append(f.recent[:0:0], f.recent[extra:]...)
+	}
+}
+
+type ChangeFeedError struct {
+	msg string
+}
+
+func (e *ChangeFeedError) Error() string { return e.msg }
+
+// Subscribe returns a subscription to the changes published after the change numbered after,
+// or to the changes published from now on when after is nil.
+// stream must be the feed's stream when resuming, and is ignored when empty.
+// Changes that are no longer kept can't be resumed from, and a ChangeFeedError is returned.
+func (f *ChangeFeed) Subscribe(stream string, after *uint64) (*ChangeSubscription, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	backlog, err := f.backlog(stream, after)
+	if err != nil {
+		return nil, err
+	}
+	sub := &ChangeSubscription{feed: f, after: f.seq - uint64(len(backlog)), backlog: backlog, c: make(chan Change, CHANGE_SUBSCRIPTION_BUFFER)}
+	f.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+func (f *ChangeFeed) backlog(stream string, from *uint64) ([]Change, error) {
+	if from == nil {
+		return nil, nil
+	}
+	after := *from
+	if stream != "" && stream != f.stream {
+		return nil, &ChangeFeedError{fmt.Sprintf("change stream %s is no longer available", stream)}
+	}
+	if after > f.seq {
+		return nil, &ChangeFeedError{fmt.Sprintf("change %d has not happened yet", after)}
+	}
+
+	if after == f.seq {
+		return nil, nil
+	}
+	oldest := f.seq - uint64(len(f.recent)) + 1
+	if after+1 < oldest {
+		return nil, &ChangeFeedError{fmt.Sprintf("changes after %d are no longer available", after)}
+	}
+	return append([]Change{}, f.recent[after+1-oldest:]...), nil
+}
+
+func (f *ChangeFeed) unsubscribe(sub *ChangeSubscription) {
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// ChangeSubscription receives the changes of a ChangeFeed
+type ChangeSubscription struct {
+	feed *ChangeFeed
+	// sequence number of the change before the subscription's first change
+	after   uint64
+	backlog []Change
+	c       chan Change
+
+	// set when the subscriber fell behind and was closed by the feed
+	overflowed bool
+}
+
+// Changes returns the changes the subscription resumed from, followed by new changes as they are published.
+// The sequence ends when the subscription is closed.
+func (sub *ChangeSubscription) Changes() iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		for _, change := range sub.backlog {
+			if !yield(change) {
+				return
+			}
+		}
+		for change := range sub.c {
+			if !yield(change) {
+				return
+			}
+		}
+	}
+}
+
+// After returns the sequence number of the change before the subscription's first change
+func (sub *ChangeSubscription) After() uint64 { return sub.after }
+
+// Overflowed reports whether the feed closed the subscription because it fell behind
+func (sub *ChangeSubscription) Overflowed() bool {
+	sub.feed.locker.Lock()
+	defer sub.feed.locker.Unlock()
+	return sub.overflowed
+}
+
+// Close stops the subscription. It is safe to call more than once.
+func (sub *ChangeSubscription) Close() {
+	sub.feed.locker.Lock()
+	defer sub.feed.locker.Unlock()
+	sub.feed.unsubscribe(sub)
+}
+
+// Changes returns the feed of the schema's committed changes
+func (s *Schema) Changes() *ChangeFeed {
+	if s.parent != nil {
+		return s.parent.Changes()
+	}
+	s.changes_once.Do(func() { s.changes = NewChangeFeed() })
+	return s.changes
+}
+
+// RecordChange adds a row write to the schema's changes.
+// Writes to a snapshot are published when the snapshot is applied, see ApplySnapshot.
+func (s *Schema) RecordChange(change Change) {
+	if s.parent != nil {
+		s.pending_changes = append(s.pending_changes, change)
+		return
+	}
+	s.Changes().Publish(change)
+}
+
+// RecordChange adds a write of a row of the table to its schema's changes.
+// before is nil for created rows and after is nil for deleted rows.
+func (t *Table) RecordChange(operation ChangeOperation, before, after TDBTableRow, now time.Time) {
+	if t.Schema == nil || t.HistoryOf() != nil {
+		return
+	}
+	if before != nil {
+		before = maps.Clone(before)
+	}
+	if after != nil {
+		after = maps.Clone(after)
+	}
+	t.Schema.RecordChange(Change{Table: t.Name, Operation: operation, Before: before, After: after, Time: now})
+}
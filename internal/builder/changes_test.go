@@ -0,0 +1,114 @@
+package builder_test
+
+import (
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/query"
+	"gotest.tools/assert"
+)
+
+func collect(sub *ChangeSubscription, n int) []Change {
+	changes := []Change{}
+	for change := range sub.Changes() {
+		changes = append(changes, change)
+		if len(changes) == n {
+			break
+		}
+	}
+	return changes
+}
+
+func TestChangeFeed(t *testing.T) {
+	t.Run("publish", func(t *testing.T) {
+		feed := NewChangeFeed()
+		sub, err := feed.Subscribe("", nil)
+		assert.NilError(t, err)
+		feed.Publish(Change{Table: "a"}, Change{Table: "b"})
+
+		changes := collect(sub, 2)
+		assert.Equal(t, changes[0].Seq, uint64(1))
+		assert.Equal(t, changes[1].Seq, uint64(2))
+		assert.Equal(t, changes[1].Table, "b")
+		assert.Equal(t, feed.Seq(), uint64(2))
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		feed := NewChangeFeed()
+		for range CHANGE_FEED_SIZE + 10 {
+			feed.Publish(Change{Table: "a"})
+		}
+
+		after := uint64(CHANGE_FEED_SIZE + 5)
+		sub, err := feed.Subscribe(feed.Stream(), &after)
+		assert.NilError(t, err)
+		assert.Equal(t, sub.After(), after)
+		feed.Publish(Change{Table: "a"})
+		changes := collect(sub, 6)
+		assert.Equal(t, changes[0].Seq, after+1)
+		assert.Equal(t, changes[5].Seq, after+6)
+
+		after = 5
+		_, err = feed.Subscribe(feed.Stream(), &after)
+		assert.ErrorContains(t, err, "changes after 5 are no longer available")
+		after = 10_000
+		_, err = feed.Subscribe(feed.Stream(), &after)
+		assert.ErrorContains(t, err, "has not happened yet")
+		_, err = feed.Subscribe(NewChangeFeed().Stream(), &after)
+		assert.ErrorContains(t, err, "is no longer available")
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		feed := NewChangeFeed()
+		sub, err := feed.Subscribe("", nil)
+		assert.NilError(t, err)
+		for range CHANGE_SUBSCRIPTION_BUFFER + 1 {
+			feed.Publish(Change{Table: "a"})
+		}
+
+		assert.Equal(t, len(collect(sub, -1)), CHANGE_SUBSCRIPTION_BUFFER)
+		assert.Assert(t, sub.Overflowed())
+	})
+
+	t.Run("close", func(t *testing.T) {
+		feed := NewChangeFeed()
+		sub, err := feed.Subscribe("", nil)
+		assert.NilError(t, err)
+		sub.Close()
+		sub.Close()
+		feed.Publish(Change{Table: "a"})
+		assert.Equal(t, len(collect(sub, -1)), 0)
+		assert.Assert(t, !sub.Overflowed())
+	})
+}
+
+func TestSchemaChanges(t *testing.T) {
+	s, err := NewSchemaFromString("$TABLE a {\n b Int\n}", nil, false)
+	assert.NilError(t, err)
+	sub, err := s.Changes().Subscribe("", nil)
+	assert.NilError(t, err)
+
+	snapshot := s.NewSnapshot()
+	table := snapshot.Tables.Get("a")
+	row, err := query.Create(table, query.QueryArg{"b": 1})
+	assert.NilError(t, err)
+	_, err = query.Update(table, row, query.QueryArg{"b": 2}, "")
+	assert.NilError(t, err)
+	// changes to a snapshot are published when it is applied
+	assert.Equal(t, s.Changes().Seq(), uint64(0))
+	snapshot.UpdateLastChange()
+	assert.NilError(t, s.ApplySnapshot(snapshot))
+
+	query.Delete(s.Tables.Get("a"), s.Tables.Get("a").Row(1), "")
+
+	changes := collect(sub, 3)
+	assert.Equal(t, changes[0].Operation, ChangeOperationCreate)
+	assert.Assert(t, changes[0].Before == nil)
+	assert.Equal(t, changes[0].After.Get("b"), 1)
+	assert.Equal(t, changes[1].Operation, ChangeOperationUpdate)
+	assert.Equal(t, changes[1].Before.Get("b"), 1)
+	assert.Equal(t, changes[1].After.Get("b"), 2)
+	assert.Equal(t, changes[2].Operation, ChangeOperationDelete)
+	assert.Equal(t, changes[2].Before.Get("b"), 2)
+	assert.Assert(t, changes[2].After == nil)
+}
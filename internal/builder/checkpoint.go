@@ -0,0 +1,97 @@
+package builder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const DEFAULT_WRITE_INTERVAL = time.Second
+
+// Checkpointer writes changed schemas to disk in the background.
+//
+// Every WriteInterval it compacts the tables that need it and writes each schema that changed since its last checkpoint,
+// so any number of changes in between is written once.
+type Checkpointer struct {
+	tdb      *TobsDB
+	interval time.Duration
+
+	stop_once sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewCheckpointer(tdb *TobsDB) *Checkpointer {
+	interval := tdb.WriteSettings.WriteInterval
+	if interval <= 0 {
+		interval = DEFAULT_WRITE_INTERVAL
+	}
+	return &Checkpointer{tdb: tdb, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start runs the checkpointer until Stop is called
+func (c *Checkpointer) Start() {
+	if c.tdb.WriteSettings.InMem {
+		close(c.done)
+		return
+	}
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.Checkpoint()
+			}
+		}
+	}()
+}
+
+// Stop ends the background checkpoints and writes the whole database one last time
+func (c *Checkpointer) Stop() {
+	c.stop_once.Do(func() { close(c.stop) })
+	<-c.done
+	c.tdb.WriteToFile()
+}
+
+// Checkpoint compacts and writes the schemas that changed since their last checkpoint
+func (c *Checkpointer) Checkpoint() {
+	if c.tdb.WriteSettings.InMem {
+		return
+	}
+
+	var schemas []*Schema
+	pkg.RLockWrap(c.tdb, func() {
+		for _, s := range c.tdb.Data {
+			schemas = append(schemas, s)
+		}
+	})
+
+	for _, s := range schemas {
+		pkg.LockWrap(s, func() {
+			if _, err := s.Compact(true); err != nil {
+				pkg.ErrorLog("failed to compact database", s.Name, err)
+			}
+			if !s.LastChange.After(s.last_checkpoint) {
+				return
+			}
+			pkg.DebugLog("writing database", s.Name)
+			if err := s.writeToFile(); err != nil {
+				pkg.ErrorLog("failed to write database", s.Name, err)
+			}
+		})
+	}
+}
+
+// LastCheckpoint returns when the schema was last written to disk, or the zero time if it never was
+func (s *Schema) LastCheckpoint() time.Time {
+	if s.parent != nil {
+		return s.parent.LastCheckpoint()
+	}
+	return s.last_checkpoint
+}
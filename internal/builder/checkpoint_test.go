@@ -0,0 +1,55 @@
+package builder_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/pkg"
+	"gotest.tools/assert"
+)
+
+func TestCheckpointer(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	s.Tdb.WriteSettings.WriteInterval = 10 * time.Millisecond
+	assert.Assert(t, s.Stats().LastCheckpoint == nil)
+
+	last_checkpoint := func() (last *time.Time) {
+		pkg.RLockWrap(s, func() { last = s.Stats().LastCheckpoint })
+		return
+	}
+
+	c := NewCheckpointer(s.Tdb)
+	c.Start()
+
+	pkg.LockWrap(s, func() {
+		assert.Assert(t, s.Tables.Get("a").Rows().Insert(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": "c"}))
+		s.UpdateLastChange()
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for last_checkpoint() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	first := last_checkpoint()
+	assert.Assert(t, first != nil)
+	_, err := os.Stat(path.Join(s.Base(), MANIFEST_FILE))
+	assert.NilError(t, err)
+
+	// unchanged schemas are not written again
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, *last_checkpoint(), *first)
+
+	c.Stop()
+	assert.Assert(t, s.Stats().LastCheckpoint.After(*first))
+	_, err = os.Stat(path.Join(s.Tdb.WriteSettings.WritePath, META_FILE))
+	assert.NilError(t, err)
+
+	tdb := NewTobsDB(AuthSettings{}, NewWriteSettings(s.Tdb.WriteSettings.WritePath, false, 0), LogOptions{})
+	loaded := tdb.Data.Get(s.Name)
+	assert.Assert(t, loaded != nil)
+	assert.Assert(t, loaded.Data.Get("a").Has(1))
+	assert.Assert(t, loaded.Stats().LastCheckpoint != nil)
+}
@@ -0,0 +1,203 @@
+package builder
+
+import (
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const (
+	// minimum number of dead records before a table is compacted in the background
+	COMPACT_MIN_DEAD_RECORDS = 1000
+	// fraction of dead records, out of all records, before a table is compacted in the background
+	COMPACT_DEAD_RATIO = 0.5
+)
+
+type CompactStats struct {
+	Table          string `json:"table"`
+	PagesBefore    int    `json:"pagesBefore"`
+	PagesAfter     int    `json:"pagesAfter"`
+	RecordsRemoved int    `json:"recordsRemoved"`
+	// legacy gob records rewritten in the current row format
+	RecordsUpgraded int `json:"recordsUpgraded"`
+}
+
+// DeadRecords returns the number of deleted or superseded records still stored in pages
+func (r *TDBTableRows) DeadRecords() int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return int(r.dead.Load())
+}
+
+func (r *TDBTableRows) NeedsCompaction() bool {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	dead := r.dead.Load()
+	if dead < COMPACT_MIN_DEAD_RECORDS {
+		return false
+	}
+	return float64(dead)/float64(dead+int64(len(r.PageRefs))) >= COMPACT_DEAD_RATIO
+}
+
+// pageRecord is a raw record read from a page, along with its decoded primary key
+type pageRecord struct {
+	key int
+	buf []byte
+}
+
+// liveRecords returns the records in p that are still referenced by the primary index.
+// Only the last copy of a record in a page is kept since later copies replace earlier ones.
+func (r *TDBTableRows) liveRecords(p *paging.Page) ([]pageRecord, int, error) {
+	reader := p.NewReader()
+	records := []pageRecord{}
+	idx := map[int]int{}
+	count := 0
+	for reader.ReadNext() {
+		count++
+		key, err := recordKey(reader.Buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if r.PageRefs.Get(key) != p.Id.String() {
+			continue
+		}
+		if i, ok := idx[key]; ok {
+			records[i].buf = reader.Buf
+			continue
+		}
+		idx[key] = len(records)
+		records = append(records, pageRecord{key, reader.Buf})
+	}
+	if reader.Err != nil {
+		return nil, 0, reader.Err
+	}
+	return records, count, nil
+}
+
+// Compact rewrites the table's pages without deleted or superseded records.
+//
+// Live records are copied, in order, into a new chain of pages and the primary index is pointed at them.
+// Records in the legacy gob format are rewritten in the current row format on the way.
+// The new pages and index are written before the old pages are removed,
+// so an interrupted compaction leaves the previous pages usable.
+func (t *Table) Compact() (*CompactStats, error) {
+	if t.hasCorruptPages() {
+		// rows in quarantined pages would be dropped
+		return nil, errTableCorrupt(t)
+	}
+
+	r := t.Rows()
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	pm := r.PM
+	in_mem := t.Schema.InMem()
+	stats := &CompactStats{Table: t.Name}
+
+	if err := pm.Flush(); err != nil {
+		return nil, err
+	}
+
+	old_pages := []uuid.UUID{}
+	live := []pageRecord{}
+	total := 0
+	for id := uuid.MustParse(pm.first_page); id != uuid.Nil; {
+		p, err := pm.Page(id)
+		if err != nil {
+			return nil, err
+		}
+		records, count, err := r.liveRecords(p)
+		if err != nil {
+			return nil, err
+		}
+		old_pages = append(old_pages, id)
+		live = append(live, records...)
+		total += count
+		id = p.Next
+	}
+
+	pages := []*paging.Page{paging.NewPage(uuid.Nil, uuid.Nil)}
+	refs := TDBTablePageRefs{}
+	for _, rec := range live {
+		if IsLegacyRecord(rec.buf) {
+			key, row, err := t.DecodeRecord(rec.buf)
+			if err != nil {
+				return nil, err
+			}
+			if rec.buf, err = t.EncodeRecord(key, row); err != nil {
+				return nil, err
+			}
+			stats.RecordsUpgraded++
+		}
+		p := pages[len(pages)-1]
+		err := p.Push(rec.buf, in_mem)
+		if err == paging.ERR_PAGE_OVERFLOW {
+			next := paging.NewPage(p.Id, uuid.Nil)
+			p.SetNext(next.Id)
+			pages = append(pages, next)
+			err = next.Push(rec.buf, in_mem)
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs.Set(rec.key, pages[len(pages)-1].Id.String())
+	}
+
+	if !in_mem {
+		for _, p := range pages {
+			if err := t.writePage(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r.PageRefs = refs
+	r.keys = sortedKeys(refs)
+	pm.reset(pages)
+	m, err := pm.ParsePage()
+	if err != nil {
+		return nil, err
+	}
+	r.Map = m
+	r.DeletedPageRefs = TDBTablePageRefs{}
+	r.dead.Store(0)
+
+	if !in_mem {
+		// the old pages are kept until the new chain is committed
+		if err := t.WriteToFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !in_mem {
+		for _, id := range old_pages {
+			if err := paging.RemovePage(t.Base(), id, t.Schema.cipher()); err != nil {
+				pkg.ErrorLog("failed to remove compacted page", id, err)
+			}
+		}
+	}
+
+	stats.PagesBefore = len(old_pages)
+	stats.PagesAfter = len(pages)
+	stats.RecordsRemoved = total - len(live)
+	return stats, nil
+}
+
+// Compact compacts every table in the schema.
+// When only_needed is set, tables without enough dead records are skipped.
+func (s *Schema) Compact(only_needed bool) ([]*CompactStats, error) {
+	res := []*CompactStats{}
+	for _, name := range s.Tables.Sorted {
+		t := s.Tables.Get(name)
+		if only_needed && (!t.Rows().NeedsCompaction() || t.hasCorruptPages()) {
+			continue
+		}
+		stats, err := t.Compact()
+		if err != nil {
+			return res, err
+		}
+		pkg.DebugLog("compacted table", s.Name, t.Name, stats.RecordsRemoved, "records removed")
+		res = append(res, stats)
+	}
+	return res, nil
+}
@@ -0,0 +1,105 @@
+package builder_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+func newTestDiskSchema(t *testing.T, schema_data string) *Schema {
+	tdb := NewTobsDB(AuthSettings{}, NewWriteSettings(t.TempDir(), false, 0), LogOptions{})
+	s, err := NewSchemaFromString(schema_data, nil, false)
+	assert.NilError(t, err)
+	s.Name = "test"
+	s.Tdb = tdb
+	tdb.Data.Set(s.Name, s)
+	return s
+}
+
+func countPageFiles(t *testing.T, table *Table) int {
+	entries, err := os.ReadDir(table.Base())
+	assert.NilError(t, err)
+	count := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".tdb") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCompact(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 10_000)
+	for i := 1; i <= 300; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	for i := 1; i <= 300; i++ {
+		assert.Assert(t, rows.Replace(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value + "y"}))
+	}
+	for i := 1; i <= 100; i++ {
+		assert.Assert(t, rows.Delete(i))
+	}
+	assert.Equal(t, rows.DeadRecords(), 500)
+	assert.NilError(t, table.WriteToFile())
+	pages_before := countPageFiles(t, table)
+
+	stats, err := table.Compact()
+	assert.NilError(t, err)
+	assert.Equal(t, stats.RecordsRemoved, 500)
+	assert.Equal(t, stats.PagesBefore, pages_before)
+	assert.Assert(t, stats.PagesAfter < stats.PagesBefore)
+	assert.Equal(t, countPageFiles(t, table), stats.PagesAfter)
+	assert.Equal(t, rows.DeadRecords(), 0)
+
+	assert.Equal(t, rows.Len(), 200)
+	for i := 1; i <= 300; i++ {
+		row, ok := rows.Get(i)
+		if i <= 100 {
+			assert.Assert(t, !ok)
+			continue
+		}
+		assert.Assert(t, ok)
+		assert.Equal(t, row.Get("b"), value+"y")
+	}
+
+	count := 0
+	for _, err := range rows.Scan(context.Background()) {
+		assert.NilError(t, err)
+		count++
+	}
+	assert.Equal(t, count, 200)
+
+	// new rows go after the compacted rows
+	assert.Assert(t, rows.Insert(301, TDBTableRow{SYS_PRIMARY_KEY: 301, "b": "z"}))
+	row, ok := rows.Get(301)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "z")
+}
+
+func TestCompactInMem(t *testing.T) {
+	r := newTestTDBTableRows(t, 10)
+	for i := 0; i < 10; i++ {
+		r.Replace(i, TDBTableRow{SYS_PRIMARY_KEY: i, "v": 1})
+	}
+	r.Delete(0)
+	s, err := NewSchemaFromString("$TABLE a {\n b Int\n}", TDBData{"a": r}, false)
+	assert.NilError(t, err)
+
+	stats, err := s.Compact(false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].RecordsRemoved, 12)
+	for i := 1; i < 10; i++ {
+		row, ok := r.Get(i)
+		assert.Assert(t, ok)
+		assert.DeepEqual(t, row, TDBTableRow{SYS_PRIMARY_KEY: i, "v": 1})
+	}
+}
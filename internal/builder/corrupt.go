@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// CorruptPage is a page that failed verification and was quarantined
+type CorruptPage struct {
+	Table  string    `json:"table"`
+	Page   string    `json:"page"`
+	Reason string    `json:"reason"`
+	File   string    `json:"file"`
+	Time   time.Time `json:"time"`
+	// set once the table has been rebuilt without the page
+	Repaired bool `json:"repaired"`
+	// the pages before and after the page in the table's chain, so it can be stepped over.
+	// They are found the first time the page is stepped over.
+	Prev string `json:"prev,omitempty"`
+	Next string `json:"next,omitempty"`
+}
+
+// quarantinePage moves the pages named by a corruption error out of the table's page chain
+// and records them on the schema.
+// Rows stored in a quarantined page are unavailable until the table is repaired.
+func (t *Table) quarantinePage(id uuid.UUID, err error) {
+	var corrupt *paging.CorruptPageError
+	if !errors.As(err, &corrupt) {
+		return
+	}
+
+	ids := []uuid.UUID{id}
+	if corrupt.Id != id {
+		// a corrupt overflow page makes the page that points to it unreadable too
+		ids = append(ids, corrupt.Id)
+	}
+	for _, id := range ids {
+		file, q_err := paging.QuarantinePage(t.Base(), id)
+		if q_err != nil {
+			pkg.ErrorLog("failed to quarantine page", t.Name, id, q_err)
+		}
+		pkg.ErrorLog("quarantined corrupt page", t.Schema.Name, t.Name, id, corrupt.Reason)
+		t.Schema.reportCorruptPage(CorruptPage{Table: t.Name, Page: id.String(), Reason: corrupt.Reason, File: file, Time: time.Now()})
+	}
+}
+
+func (s *Schema) reportCorruptPage(p CorruptPage) {
+	if s.parent != nil {
+		s.parent.reportCorruptPage(p)
+		return
+	}
+	s.corrupt_locker.Lock()
+	defer s.corrupt_locker.Unlock()
+	s.corrupt_pages = append(s.corrupt_pages, p)
+}
+
+// CorruptPages returns the pages quarantined since the schema was loaded
+func (s *Schema) CorruptPages() []CorruptPage {
+	if s.parent != nil {
+		return s.parent.CorruptPages()
+	}
+	s.corrupt_locker.Lock()
+	defer s.corrupt_locker.Unlock()
+	return append([]CorruptPage{}, s.corrupt_pages...)
+}
+
+// stepOverCorruptPage returns the page after a quarantined page of the table, which prev points to,
+// so the rest of the chain can still be read. ok is false when the page was not quarantined.
+func (t *Table) stepOverCorruptPage(id, prev uuid.UUID) (next uuid.UUID, ok bool, err error) {
+	var found *CorruptPage
+	for _, p := range t.Schema.CorruptPages() {
+		if p.Table == t.Name && p.Page == id.String() && !p.Repaired {
+			found = &p
+			break
+		}
+	}
+	if found == nil {
+		return uuid.Nil, false, nil
+	}
+	if found.Next != "" {
+		return uuid.MustParse(found.Next), true, nil
+	}
+
+	next, err = t.Rows().PM.pageAfter(id)
+	if err != nil {
+		return uuid.Nil, true, err
+	}
+	t.Schema.setCorruptPageLinks(t.Name, id.String(), prev.String(), next.String())
+	return next, true, nil
+}
+
+func (s *Schema) setCorruptPageLinks(table, page, prev, next string) {
+	if s.parent != nil {
+		s.parent.setCorruptPageLinks(table, page, prev, next)
+		return
+	}
+	s.corrupt_locker.Lock()
+	defer s.corrupt_locker.Unlock()
+	for i := range s.corrupt_pages {
+		if s.corrupt_pages[i].Table == table && s.corrupt_pages[i].Page == page {
+			s.corrupt_pages[i].Prev, s.corrupt_pages[i].Next = prev, next
+		}
+	}
+}
+
+func (t *Table) hasCorruptPages() bool {
+	for _, p := range t.Schema.CorruptPages() {
+		if p.Table == t.Name && !p.Repaired {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) markRepaired(table string) {
+	if s.parent != nil {
+		s.parent.markRepaired(table)
+		return
+	}
+	s.corrupt_locker.Lock()
+	defer s.corrupt_locker.Unlock()
+	for i := range s.corrupt_pages {
+		if s.corrupt_pages[i].Table == table {
+			s.corrupt_pages[i].Repaired = true
+		}
+	}
+}
+
+// SchemaStats is the schema as reported by the databaseStats action, along with its storage health
+type SchemaStats struct {
+	*Schema
+	CorruptPages []CorruptPage `json:"corruptPages"`
+	// nil when the schema has not been written to disk yet
+	LastCheckpoint *time.Time `json:"lastCheckpoint"`
+	// nil in in-memory mode
+	Compression *CompressionStats `json:"compression"`
+}
+
+// CompressionStats compares the size of the schema's pages on disk to their uncompressed size
+type CompressionStats struct {
+	// compression new pages are written with
+	Compression paging.Compression `json:"compression"`
+	RawBytes    int64              `json:"rawBytes"`
+	StoredBytes int64              `json:"storedBytes"`
+	// RawBytes / StoredBytes
+	Ratio float64 `json:"ratio"`
+}
+
+func (s *Schema) Stats() SchemaStats {
+	stats := SchemaStats{Schema: s, CorruptPages: s.CorruptPages()}
+	if last := s.LastCheckpoint(); !last.IsZero() {
+		stats.LastCheckpoint = &last
+	}
+	if !s.InMem() {
+		stats.Compression = s.compressionStats()
+	}
+	return stats
+}
+
+// compressionStats sums the sizes of the page files on disk.
+// Pages that have not been written yet are not counted.
+func (s *Schema) compressionStats() *CompressionStats {
+	stats := &CompressionStats{Compression: s.Tdb.WriteSettings.Compression, Ratio: 1}
+	for _, t := range s.Tables.Idx {
+		pages, err := paging.ListPages(t.Base())
+		if err != nil {
+			continue
+		}
+		for _, id := range pages {
+			size, err := paging.StatPage(t.Base(), id)
+			if err != nil {
+				continue
+			}
+			stats.RawBytes += size.Raw
+			stats.StoredBytes += size.Stored
+		}
+	}
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+	}
+	return stats
+}
+
+var ERR_TABLE_CORRUPT = errors.New("table has corrupt pages")
+
+func errTableCorrupt(t *Table) error {
+	return fmt.Errorf("%w: %s", ERR_TABLE_CORRUPT, t.Name)
+}
@@ -0,0 +1,123 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+)
+
+// row field that holds when a row of a table with a ttl prop expires
+const SYS_EXPIRES_AT = "__tdb_expires_at__"
+
+// table rules:
+// - expiresAt prop must name a Date field of the table
+// - can't have both ttl and expiresAt props
+func CheckTableRules(t *Table) error {
+	if t.Properties.Has(props.TablePropTTL) && t.Properties.Has(props.TablePropExpiresAt) {
+		return fmt.Errorf("table(%s) cannot have both ttl and expiresAt props", t.Name)
+	}
+
+	if name, ok := t.Properties.Get(props.TablePropExpiresAt).(string); ok {
+		field := t.Fields.Get(name)
+		if field == nil {
+			return fmt.Errorf("expiresAt(%s) is not a valid prop; %s is not a field of table %s", name, name, t.Name)
+		}
+		if field.BuiltinType != types.FieldTypeDate {
+			return fmt.Errorf("expiresAt(%s) is not a valid prop; field %s must be type Date", name, name)
+		}
+	}
+
+	return nil
+}
+
+// TTL returns how long rows of the table live after they are created, or 0 when the table has no ttl prop
+func (t *Table) TTL() time.Duration {
+	v, ok := t.Properties.Get(props.TablePropTTL).(string)
+	if !ok {
+		return 0
+	}
+	ttl, _ := time.ParseDuration(v)
+	return ttl
+}
+
+// Expires reports whether rows of the table can expire
+func (t *Table) Expires() bool {
+	return t.Properties.Has(props.TablePropTTL) || t.Properties.Has(props.TablePropExpiresAt)
+}
+
+// SetExpiry stamps a new row of a table with a ttl prop with the time it expires
+func (t *Table) SetExpiry(row TDBTableRow, now time.Time) {
+	if ttl := t.TTL(); ttl > 0 {
+		row.Set(SYS_EXPIRES_AT, now.Add(ttl))
+	}
+}
+
+// ExpiresAt returns when the row expires; ok is false when it never does
+func (t *Table) ExpiresAt(row TDBTableRow) (at time.Time, ok bool) {
+	name := SYS_EXPIRES_AT
+	if field, has := t.Properties.Get(props.TablePropExpiresAt).(string); has {
+		name = field
+	} else if !t.Properties.Has(props.TablePropTTL) {
+		return time.Time{}, false
+	}
+	at, ok = row.Get(name).(time.Time)
+	return at, ok
+}
+
+// IsExpired reports whether the row expired at or before now
+func (t *Table) IsExpired(row TDBTableRow, now time.Time) bool {
+	at, ok := t.ExpiresAt(row)
+	return ok && !at.After(now)
+}
+
+// SweepExpired deletes the rows of the table that expired at or before now,
+// along with the unique index entries that point to them.
+// Tables that keep history get a delete entry for each row, valid until the row expired.
+// on_expired, if set, runs for each row once it is deleted.
+// Rows that were already soft deleted are removed like a purge, with no history entry, change or on_expired.
+// Callers must hold the schema's lock.
+func (t *Table) SweepExpired(ctx context.Context, now time.Time, on_expired func(t *Table, row TDBTableRow)) (int, error) {
+	if !t.Expires() {
+		return 0, nil
+	}
+
+	rows := t.Rows()
+	expired := []TDBTableRow{}
+	for row, err := range rows.Scan(ctx) {
+		if err != nil {
+			return 0, err
+		}
+		if t.IsExpired(row, now) {
+			expired = append(expired, row)
+		}
+	}
+
+	for i, row := range expired {
+		id := GetPrimaryKey(row)
+		// soft deleted rows already went through their delete, so they are purged
+		if IsDeleted(row) {
+			rows.Delete(id)
+			continue
+		}
+		at, _ := t.ExpiresAt(row)
+		if err := t.AppendHistory(row, HistoryOperationDelete, "", at); err != nil {
+			return i, err
+		}
+		for _, index := range t.Indexes {
+			if !row.Has(index) || t.Fields.Get(index).IndexLevel() < IndexLevelUnique {
+				continue
+			}
+			// a new row may already use the value again
+			t.IndexMap(index).DeleteRow(row.Get(index), id)
+		}
+		rows.Delete(id)
+		t.RecordChange(ChangeOperationDelete, row, nil, now)
+		if on_expired != nil {
+			on_expired(t, row)
+		}
+	}
+	return len(expired), nil
+}
@@ -2,6 +2,7 @@ package builder
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -116,30 +117,61 @@ func (field *Field) IsLess(a, b any) bool {
 		return false
 	}
 
+	return field.CompareOrder(a, b) < 0
+}
+
+// CompareOrder returns -1, 0 or 1 depending on whether a is ordered before, with or after b.
+// Both values must be non-nil and of the field's type.
+//
+// Bools are ordered false before true.
+// Vectors are ordered element by element, with a shorter vector ordered before any longer vector it prefixes.
+func (field *Field) CompareOrder(a, b any) int {
 	switch field.BuiltinType {
 	case types.FieldTypeInt:
-		a, b := a.(int), b.(int)
-		return a < b
+		return cmp.Compare(a.(int), b.(int))
 	case types.FieldTypeFloat:
-		a, b := a.(float64), b.(float64)
-		return a < b
+		return cmp.Compare(a.(float64), b.(float64))
 	case types.FieldTypeString:
-		a, b := a.(string), b.(string)
-		return a < b
+		return cmp.Compare(a.(string), b.(string))
 	case types.FieldTypeBool:
 		a, b := a.(bool), b.(bool)
-		return !a || b
+		if a == b {
+			return 0
+		} else if b {
+			return -1
+		}
+		return 1
 	case types.FieldTypeBytes:
-		return bytes.Compare(a.([]byte), b.([]byte)) < 0
-	// Can't order by vector fields
+		return bytes.Compare(a.([]byte), b.([]byte))
 	case types.FieldTypeVector:
-		return false
+		return field.compareVectorOrder(a.([]any), b.([]any))
 	case types.FieldTypeDate:
-		a, b := a.(time.Time), b.(time.Time)
-		return a.Before(b)
+		return a.(time.Time).Compare(b.(time.Time))
+	}
+
+	return 0
+}
+
+func (field *Field) compareVectorOrder(a, b []any) int {
+	v_type, v_level := parser.ParseVectorProp(field.Properties.Get(props.FieldPropVector).(string))
+
+	v_field := Field{Name: field.Name, BuiltinType: v_type, Table: field.Table}
+	if v_level > 1 {
+		v_field.BuiltinType = types.FieldTypeVector
+		v_field.Properties = pkg.Map[props.FieldProp, any]{
+			props.FieldPropVector: fmt.Sprintf("%s,%d", v_type, v_level-1),
+		}
 	}
 
-	return false
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if (&v_field).IsLess(a[i], b[i]) {
+			return -1
+		}
+		if (&v_field).IsLess(b[i], a[i]) {
+			return 1
+		}
+	}
+	return cmp.Compare(len(a), len(b))
 }
 
 func (field *Field) Compare(value any, input any) bool {
@@ -147,3 +147,31 @@ func TestFieldValidateType(t *testing.T) {
 		assert.Assert(t, ok)
 	})
 }
+
+func TestCompareOrder(t *testing.T) {
+	t.Run("bool", func(t *testing.T) {
+		f := Field{Name: "a", BuiltinType: types.FieldTypeBool}
+		assert.Equal(t, f.CompareOrder(false, true), -1)
+		assert.Equal(t, f.CompareOrder(true, false), 1)
+		assert.Equal(t, f.CompareOrder(true, true), 0)
+		assert.Assert(t, !f.IsLess(true, true))
+	})
+
+	t.Run("vector", func(t *testing.T) {
+		f := Field{
+			Name:        "a",
+			BuiltinType: types.FieldTypeVector,
+			Properties:  map[props.FieldProp]any{props.FieldPropVector: "Int,2"},
+		}
+		assert.Equal(t, f.CompareOrder([]any{[]any{1, 2}}, []any{[]any{1, 3}}), -1)
+		assert.Equal(t, f.CompareOrder([]any{[]any{1}}, []any{[]any{1}, []any{0}}), -1)
+		assert.Equal(t, f.CompareOrder([]any{[]any{2}}, []any{[]any{1, 9}}), 1)
+		assert.Equal(t, f.CompareOrder([]any{[]any{2}}, []any{[]any{2}}), 0)
+	})
+
+	t.Run("date", func(t *testing.T) {
+		f := Field{Name: "a", BuiltinType: types.FieldTypeDate}
+		now := time.Now()
+		assert.Equal(t, f.CompareOrder(now, now.Add(time.Second)), -1)
+	})
+}
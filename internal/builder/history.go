@@ -0,0 +1,143 @@
+package builder
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const (
+	// row field that holds when the row's current version was written, in tables with the history prop
+	SYS_VALID_FROM = "__tdb_valid_from__"
+
+	// name of a table's history table is the table's name followed by this suffix
+	HISTORY_TABLE_SUFFIX = "__history"
+
+	// fields of history tables besides the fields of their table
+	HISTORY_FIELD_ROW_ID    = "__tdb_row_id__"
+	HISTORY_FIELD_VALID_TO  = "__tdb_valid_to__"
+	HISTORY_FIELD_ACTOR     = "__tdb_actor__"
+	HISTORY_FIELD_OPERATION = "__tdb_operation__"
+)
+
+type HistoryOperation string
+
+const (
+	HistoryOperationUpdate HistoryOperation = "update"
+	HistoryOperationDelete HistoryOperation = "delete"
+)
+
+// KeepsHistory reports whether the table copies the previous version of a row to its history table on every write
+func (t *Table) KeepsHistory() bool {
+	history, ok := t.Properties.Get(props.TablePropHistory).(bool)
+	return ok && history
+}
+
+// History returns the table's history table, or nil when it does not keep history
+func (t *Table) History() *Table {
+	if !t.KeepsHistory() {
+		return nil
+	}
+	return t.Schema.Tables.Get(t.Name + HISTORY_TABLE_SUFFIX)
+}
+
+// HistoryOf returns the table that t keeps the history of, or nil when t is not a history table
+func (t *Table) HistoryOf() *Table {
+	name, ok := strings.CutSuffix(t.Name, HISTORY_TABLE_SUFFIX)
+	if !ok || t.Schema == nil {
+		return nil
+	}
+	if source := t.Schema.Tables.Get(name); source != nil && source.KeepsHistory() {
+		return source
+	}
+	return nil
+}
+
+// NewHistoryTable returns the history table of t.
+// It has an optional copy of every field of t, without keys, unique values, relations or defaults,
+// since it holds many versions of the same row.
+func NewHistoryTable(t *Table) *Table {
+	history := &Table{
+		Name:      t.Name + HISTORY_TABLE_SUFFIX,
+		Fields:    pkg.NewInsertSortMap[string, *Field](),
+		Indexes:   []string{},
+		IdTracker: atomic.Int64{},
+		Schema:    t.Schema,
+	}
+	add := func(name string, field_type types.FieldType, field_props pkg.Map[props.FieldProp, any]) {
+		history.Fields.Push(name, &Field{Name: name, BuiltinType: field_type, Properties: field_props, Table: history})
+	}
+
+	for _, f := range t.Fields.Idx {
+		field_props := pkg.Map[props.FieldProp, any]{props.FieldPropOptional: true}
+		if f.Properties.Has(props.FieldPropVector) {
+			field_props.Set(props.FieldPropVector, f.Properties.Get(props.FieldPropVector))
+		}
+		add(f.Name, f.BuiltinType, field_props)
+	}
+	add(HISTORY_FIELD_ROW_ID, types.FieldTypeInt, pkg.Map[props.FieldProp, any]{})
+	add(SYS_VALID_FROM, types.FieldTypeDate, pkg.Map[props.FieldProp, any]{props.FieldPropOptional: true})
+	add(HISTORY_FIELD_VALID_TO, types.FieldTypeDate, pkg.Map[props.FieldProp, any]{})
+	add(HISTORY_FIELD_ACTOR, types.FieldTypeString, pkg.Map[props.FieldProp, any]{props.FieldPropOptional: true})
+	add(HISTORY_FIELD_OPERATION, types.FieldTypeString, pkg.Map[props.FieldProp, any]{})
+	return history
+}
+
+// SetValidFrom stamps a row of a table that keeps history with the time its current version was written
+func (t *Table) SetValidFrom(row TDBTableRow, now time.Time) {
+	if t.KeepsHistory() {
+		row.Set(SYS_VALID_FROM, now)
+	}
+}
+
+// AppendHistory adds the version of row that stopped being current at now to the table's history table.
+// actor is the id of the user that made the change, if any.
+func (t *Table) AppendHistory(row TDBTableRow, operation HistoryOperation, actor string, now time.Time) error {
+	history := t.History()
+	if history == nil {
+		return nil
+	}
+
+	entry := maps.Clone(row)
+	entry.Set(HISTORY_FIELD_ROW_ID, GetPrimaryKey(row))
+	entry.Set(HISTORY_FIELD_VALID_TO, now)
+	entry.Set(HISTORY_FIELD_OPERATION, string(operation))
+	if actor != "" {
+		entry.Set(HISTORY_FIELD_ACTOR, actor)
+	}
+	key := history.CreateId()
+	SetPrimaryKey(entry, key)
+	if !history.Rows().Insert(key, entry) {
+		return fmt.Errorf("failed to add row %d of table %s to its history", GetPrimaryKey(row), t.Name)
+	}
+	return nil
+}
+
+// ValidAt reports whether the current version of a row of a table that keeps history was written at or before at.
+// Rows written before the table kept history are valid at any time.
+func ValidAt(row TDBTableRow, at time.Time) bool {
+	from, ok := row.Get(SYS_VALID_FROM).(time.Time)
+	return !ok || !from.After(at)
+}
+
+// HistoryVersionAt returns the row version held by an entry of a history table if it was current at at.
+// The version has the row's own id, and none of the fields history tables add.
+func HistoryVersionAt(entry TDBTableRow, at time.Time) (TDBTableRow, bool) {
+	to, ok := entry.Get(HISTORY_FIELD_VALID_TO).(time.Time)
+	if !ok || !to.After(at) || !ValidAt(entry, at) {
+		return nil, false
+	}
+
+	version := maps.Clone(entry)
+	SetPrimaryKey(version, pkg.NumToInt(entry.Get(HISTORY_FIELD_ROW_ID)))
+	for _, name := range []string{HISTORY_FIELD_ROW_ID, HISTORY_FIELD_VALID_TO, HISTORY_FIELD_ACTOR, HISTORY_FIELD_OPERATION} {
+		version.Delete(name)
+	}
+	return version, true
+}
@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"fmt"
+
+	"github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+)
+
+// ValidateSchemaHooks checks the props that declare hooks on writes.
+//
+// copy rules:
+// - copy(field) must name another field of the table
+// - copy(relation_field.field) must name a non-vector relation field of the table and a field of the related table
+// - the copied field must have the same type, and can't be a copy itself
+// - fields with the copy prop can't be keys, unique or relations
+//
+// counter rules:
+// - counter(field) must be on a non-vector relation field
+// - it must name an Int field of the related table that is not a key or unique
+func ValidateSchemaHooks(schema *Schema) error {
+	for _, table := range schema.Tables.Idx {
+		for _, field := range table.Fields.Idx {
+			if err := checkCopyProp(schema, table, field); err != nil {
+				return err
+			}
+			if err := checkCounterProp(schema, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkCopyProp(schema *Schema, table *Table, field *Field) error {
+	value, ok := field.Properties.Get(props.FieldPropCopy).(string)
+	if !ok {
+		return nil
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("field(%s.%s copy(%s)) is not valid; %s", table.Name, field.Name, value, reason)
+	}
+
+	if field.IndexLevel() > IndexLevelNone || field.Properties.Has(props.FieldPropRelation) {
+		return invalid("copies can't be keys, unique or relations")
+	}
+
+	rel_field_name, source_name := parser.ParseCopyProp(value)
+	source_table := table
+	if rel_field_name != "" {
+		rel_field := table.Fields.Get(rel_field_name)
+		if rel_field == nil || !rel_field.Properties.Has(props.FieldPropRelation) {
+			return invalid(fmt.Sprintf("%s is not a relation field of table %s", rel_field_name, table.Name))
+		}
+		if rel_field.BuiltinType == types.FieldTypeVector {
+			return invalid(fmt.Sprintf("%s is a vector relation", rel_field_name))
+		}
+		rel_table_name, _ := parser.ParseRelationProp(rel_field.Properties.Get(props.FieldPropRelation).(string))
+		source_table = schema.Tables.Get(rel_table_name)
+	}
+
+	source := source_table.Fields.Get(source_name)
+	if source == nil {
+		return invalid(fmt.Sprintf("%s is not a field of table %s", source_name, source_table.Name))
+	}
+	if source == field {
+		return invalid("field can't copy itself")
+	}
+	if source.Properties.Has(props.FieldPropCopy) {
+		return invalid(fmt.Sprintf("%s is a copy", source_name))
+	}
+	if source.BuiltinType != field.BuiltinType ||
+		source.Properties.Get(props.FieldPropVector) != field.Properties.Get(props.FieldPropVector) {
+		return invalid("field types must match")
+	}
+	return nil
+}
+
+func checkCounterProp(schema *Schema, field *Field) error {
+	value, ok := field.Properties.Get(props.FieldPropCounter).(string)
+	if !ok {
+		return nil
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("field(%s.%s counter(%s)) is not valid; %s", field.Table.Name, field.Name, value, reason)
+	}
+
+	if !field.Properties.Has(props.FieldPropRelation) || field.BuiltinType == types.FieldTypeVector {
+		return invalid("counters must be on non-vector relation fields")
+	}
+
+	rel_table_name, _ := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+	counter := schema.Tables.Get(rel_table_name).Fields.Get(value)
+	if counter == nil {
+		return invalid(fmt.Sprintf("%s is not a field of table %s", value, rel_table_name))
+	}
+	if counter.BuiltinType != types.FieldTypeInt || counter.IndexLevel() > IndexLevelNone {
+		return invalid(fmt.Sprintf("field %s must be type Int, and can't be a key or unique", value))
+	}
+	return nil
+}
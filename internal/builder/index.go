@@ -1,36 +1,49 @@
 package builder
 
 import (
+	"context"
 	"fmt"
+	"iter"
+	"slices"
+	"sort"
 	"sync"
 
 	"github.com/tobsdb/tobsdb/pkg"
 )
 
+// number of keys read at a time when seeking an index
+const SEEK_BATCH_SIZE = 256
+
 type (
 	TDBTableIndexMap struct {
 		locker sync.RWMutex
 		Map    map[string]int
+
+		// the index's values in field order, built by a seek and dropped by the next write to the index
+		sorted []indexEntry
+		// number of writes to the index, so a seek doesn't keep values sorted before a write
+		writes uint64
 	}
 	// index field name -> index value -> row id
 	TDBTableIndexes = pkg.Map[string, *TDBTableIndexMap]
 )
 
-func formatIndexValue(v any) string {
+// FormatIndexValue formats a value as a key of a unique index, so values that are the same key conflict
+func FormatIndexValue(v any) string {
 	return fmt.Sprintf("%v", v)
 }
 
 func (m *TDBTableIndexMap) Has(key any) bool {
 	m.locker.RLock()
 	defer m.locker.RUnlock()
-	_, ok := m.Map[formatIndexValue(key)]
+	_, ok := m.Map[FormatIndexValue(key)]
 	return ok
 }
 
 func (m *TDBTableIndexMap) Get(key any) int {
 	m.locker.RLock()
 	defer m.locker.RUnlock()
-	val, ok := m.Map[formatIndexValue(key)]
+	val, ok := m.Map[FormatIndexValue(key)]
 	if !ok {
 		return 0
 	}
@@ -40,11 +53,128 @@ func (m *TDBTableIndexMap) Get(key any) int {
 func (m *TDBTableIndexMap) Set(key any, value int) {
 	m.locker.Lock()
 	defer m.locker.Unlock()
-	m.Map[formatIndexValue(key)] = value
+	m.Map[FormatIndexValue(key)] = value
+	m.dropSorted()
 }
 
 func (m *TDBTableIndexMap) Delete(key any) {
 	m.locker.Lock()
 	defer m.locker.Unlock()
-	delete(m.Map, formatIndexValue(key))
+	delete(m.Map, FormatIndexValue(key))
+	m.dropSorted()
+}
+
+// Ids returns the sorted row ids in the index
+func (m *TDBTableIndexMap) Ids() []int {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	ids := make([]int, 0, len(m.Map))
+	for _, id := range m.Map {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// DeleteRow deletes key from the index if it still points to the row with the given id
+func (m *TDBTableIndexMap) DeleteRow(key any, id int) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	k := FormatIndexValue(key)
+	if v, ok := m.Map[k]; ok && v == id {
+		delete(m.Map, k)
+		m.dropSorted()
+	}
+}
+
+type indexEntry struct {
+	value any
+	id    int
+}
+
+// searchSorted returns the position of the first sorted value that is not before key
+func searchSorted(sorted []indexEntry, compare func(a, b any) int, key any) int {
+	return sort.Search(len(sorted), func(i int) bool { return compare(sorted[i].value, key) >= 0 })
+}
+
+// dropSorted drops the index's sorted values, so the next seek sorts them again.
+// Callers must hold the index's lock.
+func (m *TDBTableIndexMap) dropSorted() {
+	m.sorted = nil
+	m.writes++
+}
+
+// sort returns the index's values in field order.
+// When a write dropped them since the last seek, they are sorted again from the rows of the table it indexes,
+// without locking the index while the table is read.
+func (m *TDBTableIndexMap) sort(ctx context.Context, t *Table, field *Field) ([]indexEntry, error) {
+	m.locker.RLock()
+	sorted, writes := m.sorted, m.writes
+	m.locker.RUnlock()
+	if sorted != nil {
+		return sorted, nil
+	}
+
+	sorted = []indexEntry{}
+	for row, err := range t.Rows().Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if value := row.Get(field.Name); value != nil {
+			sorted = append(sorted, indexEntry{value, GetPrimaryKey(row)})
+		}
+	}
+	slices.SortFunc(sorted, func(a, b indexEntry) int { return field.CompareOrder(a.value, b.value) })
+
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	// soft deleted rows, and rows whose value is indexed to another row, aren't in the index
+	sorted = slices.DeleteFunc(sorted, func(entry indexEntry) bool {
+		id, ok := m.Map[FormatIndexValue(entry.value)]
+		return !ok || id != entry.id
+	})
+	if m.writes == writes {
+		m.sorted = sorted
+	}
+	return sorted, nil
+}
+
+// IndexSeek returns an iterator over the ids of the rows whose value of the unique field sorts after value,
+// in the field's order, or before it in reverse order when reverse is set.
+// Rows where the field is null are not in the index.
+//
+// The first seek after the index is written to reads the table's rows to sort its values,
+// later seeks don't read the table. The seek reads the values as they were when it started.
+func (t *Table) IndexSeek(ctx context.Context, index string, value any, reverse bool) iter.Seq2[int, error] {
+	return func(yield func(int, error) bool) {
+		field := t.Fields.Get(index)
+		m := t.IndexMap(index)
+		if field == nil || m == nil {
+			yield(0, fmt.Errorf("%s is not a unique field of table %s", index, t.Name))
+			return
+		}
+		sorted, err := m.sort(ctx, t, field)
+		if err != nil {
+			yield(0, err)
+			return
+		}
+
+		i := searchSorted(sorted, field.CompareOrder, value)
+		if reverse {
+			for i--; i >= 0; i-- {
+				if !yield(sorted[i].id, nil) {
+					return
+				}
+			}
+			return
+		}
+		if i < len(sorted) && field.CompareOrder(sorted[i].value, value) == 0 {
+			i++
+		}
+		for ; i < len(sorted); i++ {
+			if !yield(sorted[i].id, nil) {
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const (
+	MANIFEST_FILE = "MANIFEST"
+	META_FILE     = "meta.tdb"
+)
+
+// Manifest records which generation of a schema's meta and index files is current.
+//
+// Every write of a schema creates a new generation of these files next to the previous one,
+// then atomically replaces the manifest to point at it.
+// A crash before the manifest is replaced leaves the previous generation in place, so a reload always reads a consistent set.
+type Manifest struct {
+	Generation uint64 `json:"generation"`
+}
+
+// generationFile returns the name of a file for generation gen.
+// Generation 0 is the layout used before the manifest was introduced.
+func generationFile(name string, gen uint64) string {
+	if gen == 0 {
+		return name
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), gen, ext)
+}
+
+// readManifest reads the schema manifest in base.
+// A schema written before the manifest was introduced has none and is read as generation 0.
+func readManifest(base string) (*Manifest, error) {
+	data, err := os.ReadFile(path.Join(base, MANIFEST_FILE))
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// writeToFile flushes the schema's pages and commits a new generation of its meta and index files.
+// Callers must hold the schema's lock.
+func (s *Schema) writeToFile() error {
+	meta_data, err := s.MetaData()
+	if err != nil {
+		return err
+	}
+
+	base := s.Base()
+	if _, err := os.Stat(base); os.IsNotExist(err) {
+		os.Mkdir(base, 0o755)
+	}
+
+	// pages are written first so the committed indexes never point to missing records
+	for _, t := range s.Tables.Idx {
+		if err := t.Rows().PM.Flush(); err != nil {
+			return err
+		}
+	}
+
+	gen := s.generation + 1
+	meta_data = s.cipher().EncryptFile(meta_data, path.Join(s.Name, generationFile(META_FILE, gen)))
+	if err := pkg.WriteFileAtomic(path.Join(base, generationFile(META_FILE, gen)), meta_data, 0o644); err != nil {
+		return err
+	}
+	for _, t := range s.Tables.Idx {
+		if err := t.writeIndexes(gen); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.Marshal(Manifest{gen})
+	if err != nil {
+		return err
+	}
+	if err := pkg.WriteFileAtomic(path.Join(base, MANIFEST_FILE), manifest, 0o644); err != nil {
+		return err
+	}
+
+	prev := s.generation
+	s.generation = gen
+	s.last_checkpoint = time.Now()
+	s.removeGeneration(prev)
+	return nil
+}
+
+// removeGeneration deletes the meta and index files of a generation that is no longer current
+func (s *Schema) removeGeneration(gen uint64) {
+	base := s.Base()
+	files := []string{path.Join(base, generationFile(META_FILE, gen))}
+	for _, t := range s.Tables.Idx {
+		files = append(files,
+			path.Join(base, t.Name, generationFile(INDEX_FILE, gen)),
+			path.Join(base, t.Name, generationFile(PRIMARY_INDEX_FILE, gen)))
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			pkg.ErrorLog("failed to remove old schema file", f, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package builder_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+func TestSchemaManifest(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	assert.Assert(t, table.Rows().Insert(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": "c"}))
+	assert.NilError(t, s.WriteToFile())
+	assert.NilError(t, s.WriteToFile())
+
+	write_path := s.Tdb.WriteSettings.WritePath
+	base := s.Base()
+	manifest, err := os.ReadFile(path.Join(base, MANIFEST_FILE))
+	assert.NilError(t, err)
+	assert.Equal(t, string(manifest), `{"generation":2}`)
+
+	// the previous generation is removed once the new one is committed
+	_, err = os.Stat(path.Join(base, "meta.1.tdb"))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(base, "a", "primary_index.1.tdb"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// files of a generation that was never committed are ignored
+	assert.NilError(t, os.WriteFile(path.Join(base, "meta.3.tdb"), []byte("{"), 0o644))
+	assert.NilError(t, os.WriteFile(path.Join(base, "a", "primary_index.3.tdb"), []byte{}, 0o644))
+
+	loaded, err := NewSchemaFromPath(write_path, s.Name, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, loaded.Tables.Has("a"))
+	assert.Assert(t, loaded.Data.Get("a").PageRefs.Has(1))
+}
+
+func TestSchemaManifestLegacy(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	assert.Assert(t, table.Rows().Insert(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": "c"}))
+	assert.NilError(t, s.WriteToFile())
+
+	// rewrite the files in the layout used before the manifest
+	base := s.Base()
+	assert.NilError(t, os.Rename(path.Join(base, "meta.1.tdb"), path.Join(base, META_FILE)))
+	assert.NilError(t, os.Rename(path.Join(base, "a", "index.1.tdb"), path.Join(base, "a", INDEX_FILE)))
+	assert.NilError(t, os.Rename(path.Join(base, "a", "primary_index.1.tdb"), path.Join(base, "a", PRIMARY_INDEX_FILE)))
+	assert.NilError(t, os.Remove(path.Join(base, MANIFEST_FILE)))
+
+	loaded, err := NewSchemaFromPath(s.Tdb.WriteSettings.WritePath, s.Name, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, loaded.Data.Get("a").PageRefs.Has(1))
+
+	loaded.Tdb = s.Tdb
+	assert.NilError(t, loaded.WriteToFile())
+	_, err = os.Stat(path.Join(base, META_FILE))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(base, "a", PRIMARY_INDEX_FILE))
+	assert.Assert(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(base, "meta.1.tdb"))
+	assert.NilError(t, err)
+}
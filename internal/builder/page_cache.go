@@ -0,0 +1,170 @@
+package builder
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	sorted "github.com/tobshub/go-sortedmap"
+)
+
+const DEFAULT_PAGE_CACHE_SIZE = 16
+
+type pageCacheKey struct {
+	t  *Table
+	id uuid.UUID
+}
+
+type pageCacheEntry struct {
+	key  pageCacheKey
+	page *paging.Page
+	rows *sorted.SortedMap[int, TDBTableRow]
+}
+
+// PageCache is a bounded pool of parsed pages shared by the tables of a schema.
+// When it is full, the least recently used page is evicted, and written to disk first if it is dirty.
+//
+// A table's last page, which new rows are written to, is held by its PagingManager instead.
+type PageCache struct {
+	locker  sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[pageCacheKey]*list.Element
+
+	hits   int
+	misses int
+}
+
+func NewPageCache(size int) *PageCache {
+	if size < 1 {
+		size = 1
+	}
+	return &PageCache{size: size, lru: list.New(), entries: map[pageCacheKey]*list.Element{}}
+}
+
+func (c *PageCache) Len() int {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the number of cache hits and misses
+func (c *PageCache) Stats() (hits, misses int) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.hits, c.misses
+}
+
+// Get returns the cached page with id, loading and parsing it from disk when it is not resident.
+func (c *PageCache) Get(t *Table, id uuid.UUID) (*pageCacheEntry, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	key := pageCacheKey{t, id}
+	if el, ok := c.entries[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(el)
+		return el.Value.(*pageCacheEntry), nil
+	}
+
+	c.misses++
+	p, err := paging.LoadPageUUID(t.Base(), id, t.Schema.cipher())
+	if err != nil {
+		t.quarantinePage(id, err)
+		return nil, err
+	}
+	entry, err := c.push(t, p)
+	if err != nil {
+		t.quarantinePage(id, err)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Put adds a page that is already in memory, such as a table's previous last page.
+// The page may be dirty; it is written to disk when evicted or flushed.
+func (c *PageCache) Put(t *Table, p *paging.Page) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if el, ok := c.entries[pageCacheKey{t, p.Id}]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, pageCacheKey{t, p.Id})
+	}
+	_, err := c.push(t, p)
+	return err
+}
+
+func (c *PageCache) push(t *Table, p *paging.Page) (*pageCacheEntry, error) {
+	rows, err := parsePage(t, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for c.lru.Len() >= c.size {
+		if err := c.evict(); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &pageCacheEntry{pageCacheKey{t, p.Id}, p, rows}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	return entry, nil
+}
+
+func (c *PageCache) evict() error {
+	el := c.lru.Back()
+	entry := el.Value.(*pageCacheEntry)
+	if err := entry.key.t.writePage(entry.page); err != nil {
+		return err
+	}
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	return nil
+}
+
+// Flush writes the table's dirty pages to disk. The pages stay in the cache.
+func (c *PageCache) Flush(t *Table) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*pageCacheEntry)
+		if entry.key.t != t {
+			continue
+		}
+		if err := t.writePage(entry.page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageAfter returns the id of the cached page of the table whose previous page is id
+func (c *PageCache) pageAfter(t *Table, id uuid.UUID) (uuid.UUID, bool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	for key, el := range c.entries {
+		if key.t == t && el.Value.(*pageCacheEntry).page.Prev == id {
+			return key.id, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// Remove drops the table's pages from the cache without writing them.
+func (c *PageCache) Remove(t *Table) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*pageCacheEntry)
+		if entry.key.t == t {
+			c.lru.Remove(el)
+			delete(c.entries, entry.key)
+		}
+		el = next
+	}
+}
@@ -0,0 +1,197 @@
+package builder_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/query"
+	"gotest.tools/assert"
+)
+
+func TestPageCache(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	s.Tdb.WriteSettings.PageCacheSize = 1
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 50_000)
+	for i := 1; i <= 200; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+
+	cache := s.PageCache()
+	assert.Assert(t, cache.Len() <= 1)
+	// full pages that were evicted have already been written
+	assert.Assert(t, countPageFiles(t, table) > 2)
+
+	t.Run("get", func(t *testing.T) {
+		for i := 1; i <= 200; i++ {
+			row, ok := rows.Get(i)
+			assert.Assert(t, ok)
+			assert.Equal(t, GetPrimaryKey(row), i)
+		}
+		assert.Assert(t, cache.Len() <= 1)
+
+		hits, misses := cache.Stats()
+		assert.Assert(t, hits > 0)
+		assert.Assert(t, misses > 0)
+	})
+
+	t.Run("records", func(t *testing.T) {
+		count := 0
+		for row, err := range rows.Scan(context.Background()) {
+			assert.NilError(t, err)
+			count++
+			assert.Equal(t, GetPrimaryKey(row), count)
+		}
+		assert.Equal(t, count, 200)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		assert.Assert(t, rows.Replace(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": "y"}))
+		row, ok := rows.Get(1)
+		assert.Assert(t, ok)
+		assert.Equal(t, row.Get("b"), "y")
+	})
+}
+
+func TestLargeRow(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 300_000)
+	assert.Assert(t, rows.Insert(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": value}))
+	assert.Assert(t, rows.Insert(2, TDBTableRow{SYS_PRIMARY_KEY: 2, "b": "y"}))
+	assert.NilError(t, table.WriteToFile())
+
+	row, ok := rows.Get(1)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), value)
+	row, ok = rows.Get(2)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "y")
+}
+
+func TestCorruptPage(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	s.Tdb.WriteSettings.PageCacheSize = 1
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 50_000)
+	for i := 1; i <= 200; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	assert.NilError(t, table.WriteToFile())
+	// drop the cached pages so the next read comes from disk
+	s.PageCache().Remove(table)
+
+	page_id := rows.PageRefs.Get(1)
+	location := path.Join(table.Base(), page_id)
+	data, err := os.ReadFile(location)
+	assert.NilError(t, err)
+	data[len(data)-1] ^= 1
+	assert.NilError(t, os.WriteFile(location, data, 0o644))
+
+	_, ok := rows.Get(1)
+	assert.Assert(t, !ok)
+
+	corrupt := s.Stats().CorruptPages
+	assert.Equal(t, len(corrupt), 1)
+	assert.Equal(t, corrupt[0].Table, "a")
+	assert.Equal(t, corrupt[0].Page, page_id)
+	assert.Equal(t, corrupt[0].File, location+".corrupt")
+	_, err = os.Stat(location + ".corrupt")
+	assert.NilError(t, err)
+
+	// rows in other pages are still readable
+	_, ok = rows.Get(200)
+	assert.Assert(t, ok)
+
+	// scans step over the quarantined page to the pages after it
+	lost := 0
+	for _, page := range rows.PageRefs {
+		if page == page_id {
+			lost++
+		}
+	}
+	for range 2 {
+		count := 0
+		for row, err := range rows.Scan(context.Background()) {
+			assert.NilError(t, err)
+			assert.Assert(t, rows.PageRefs.Get(GetPrimaryKey(row)) != page_id)
+			count++
+		}
+		assert.Equal(t, count, 200-lost)
+	}
+	corrupt = s.Stats().CorruptPages
+	assert.Equal(t, corrupt[0].Prev, uuid.Nil.String())
+	assert.Equal(t, corrupt[0].Next, rows.PageRefs.Get(lost+1))
+
+	_, err = table.Compact()
+	assert.Assert(t, errors.Is(err, ERR_TABLE_CORRUPT))
+}
+
+func TestCreateManyWriteError(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n n Int default(autoincrement)\n b String\n}")
+	s.Tdb.WriteSettings.PageCacheSize = 1
+	table := s.Tables.Get("a")
+	_, err := query.Create(table, query.QueryArg{"b": "a"})
+	assert.NilError(t, err)
+
+	// pages evicted from the cache can't be written while the table's directory is a file
+	base := table.Base()
+	assert.NilError(t, os.RemoveAll(base))
+	assert.NilError(t, os.WriteFile(base, nil, 0o644))
+	data := []query.QueryArg{}
+	for range 100 {
+		data = append(data, query.QueryArg{"b": strings.Repeat("x", 50_000)})
+	}
+	_, _, err = query.CreateMany(table, data, false)
+	assert.Assert(t, err != nil)
+
+	assert.Equal(t, table.Rows().Len(), 1)
+	assert.Equal(t, table.IdTracker.Load(), int64(1))
+	assert.Equal(t, table.Fields.Get("n").IncrementTracker.Load(), int64(1))
+
+	assert.NilError(t, os.Remove(base))
+	assert.NilError(t, table.WriteToFile())
+	stats, err := table.Rebuild()
+	assert.NilError(t, err)
+	// the rows written before the error were tombstoned
+	assert.Equal(t, stats.Rows, 1)
+
+	row, err := query.Create(table, query.QueryArg{"b": "b"})
+	assert.NilError(t, err)
+	assert.Equal(t, row.Get("n"), 2)
+}
+
+func TestImportWriteError(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n n Int default(autoincrement)\n b String\n}")
+	s.Tdb.WriteSettings.PageCacheSize = 1
+	table := s.Tables.Get("a")
+	_, err := query.Create(table, query.QueryArg{"b": "a"})
+	assert.NilError(t, err)
+
+	base := table.Base()
+	assert.NilError(t, os.RemoveAll(base))
+	assert.NilError(t, os.WriteFile(base, nil, 0o644))
+	data := []query.QueryArg{}
+	for i := range 100 {
+		data = append(data, query.QueryArg{"n": i + 10, "b": strings.Repeat("x", 50_000)})
+	}
+	_, err = query.Import(table, data, &query.TableCounters{Id: 500, Fields: map[string]int64{"n": 500}})
+	assert.Assert(t, err != nil)
+
+	// the counters from the failed import aren't kept
+	assert.Equal(t, table.Rows().Len(), 1)
+	assert.Equal(t, table.IdTracker.Load(), int64(1))
+	assert.Equal(t, table.Fields.Get("n").IncrementTracker.Load(), int64(1))
+}
@@ -0,0 +1,67 @@
+package builder_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+func TestPageChainRestart(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}\n$TABLE empty {\n b String\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 50_000)
+	for i := 1; i <= 200; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	assert.Assert(t, rows.Delete(1))
+	chain := rows.Chain()
+	assert.Equal(t, chain.DeadRecords, 2)
+	assert.Assert(t, chain.PageCount > 1)
+	assert.Equal(t, len(chain.FreeSpace), chain.PageCount)
+	s.Tdb.WriteToFile()
+
+	restart := func() (*TobsDB, *TDBTableRows) {
+		tdb := NewTobsDB(AuthSettings{}, NewWriteSettings(s.Tdb.WriteSettings.WritePath, false, 0), LogOptions{})
+		loaded := tdb.Data.Get(s.Name)
+		assert.Assert(t, loaded != nil)
+		assert.Equal(t, loaded.Data.Get("empty").Len(), 0)
+		return tdb, loaded.Data.Get("a")
+	}
+
+	tdb, loaded := restart()
+	assert.DeepEqual(t, loaded.Chain(), chain)
+	// dead records written before the restart are still counted for compaction
+	assert.Equal(t, loaded.DeadRecords(), 2)
+	count := 0
+	for row, err := range loaded.Scan(context.Background()) {
+		assert.NilError(t, err)
+		count++
+		assert.Equal(t, GetPrimaryKey(row), count+1)
+		assert.Equal(t, row.Get("b"), value)
+	}
+	assert.Equal(t, count, 199)
+	_, ok := loaded.Get(1)
+	assert.Assert(t, !ok)
+
+	// new rows are appended to the existing chain
+	assert.Assert(t, loaded.Insert(201, TDBTableRow{SYS_PRIMARY_KEY: 201, "b": "y"}))
+	assert.Equal(t, loaded.PM.Chain().FirstPage, chain.FirstPage)
+	tdb.WriteToFile()
+
+	_, loaded = restart()
+	assert.Equal(t, loaded.Len(), 200)
+	row, ok := loaded.Get(201)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "y")
+	count = 0
+	for _, err := range loaded.Scan(context.Background()) {
+		assert.NilError(t, err)
+		count++
+	}
+	assert.Equal(t, count, 200)
+}
@@ -1,8 +1,12 @@
 package builder
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/tobsdb/tobsdb/internal/paging"
@@ -10,110 +14,320 @@ import (
 	sorted "github.com/tobshub/go-sortedmap"
 )
 
+// PagingManager reads and writes a table's chain of pages.
+//
+// New records are always pushed to the last page in the chain, which the manager keeps loaded.
+// Every other page is read through the schema's PageCache.
 type PagingManager struct {
-	t *Table
+	locker sync.Mutex
+	t      *Table
 
+	// the last page in the chain
 	p *paging.Page
+	// parsed rows of p; nil when p has changed since it was last parsed
+	p_rows *sorted.SortedMap[int, TDBTableRow]
 
-	has_parsed       bool
-	first_page       string
-	last_loaded_page string
+	first_page string
+	// number of pages in the chain
+	count int
+	// page id -> bytes left in the page, for pages before p
+	free map[string]int
+	// number of times the chain was replaced by compaction or repair, so scans notice their pages are gone
+	resets atomic.Uint64
+}
+
+// PageChain describes a table's chain of pages.
+// It is saved with the table in meta.tdb so the chain can be reopened on startup.
+type PageChain struct {
+	FirstPage string
+	LastPage  string
+	PageCount int
+	// page id -> bytes left in the page
+	FreeSpace map[string]int
+	// number of records in the pages that were deleted or replaced by a newer copy,
+	// so background compaction still sees them after a restart
+	DeadRecords int
 }
 
 func NewPagingManager(t *Table) *PagingManager {
-	pm := &PagingManager{t: t}
+	pm := &PagingManager{t: t, count: 1, free: map[string]int{}}
 	if t.first_page_id == "" {
 		pm.p = paging.NewPage(uuid.Nil, uuid.Nil)
 		t.first_page_id = pm.p.Id.String()
 	} else {
-		p := paging.NewPageWithId(uuid.MustParse(t.first_page_id), uuid.Nil, uuid.Nil)
-		pm.p = p
+		pm.p = paging.NewPageWithId(uuid.MustParse(t.first_page_id), uuid.Nil, uuid.Nil)
 	}
-	pm.last_loaded_page = t.first_page_id
 	pm.first_page = t.first_page_id
 	return pm
 }
 
-// TODO(tobshub):
-// instead of returning a new map each time, could simply insert into existing map.
-// this would allow keeping previous values
-// & reduce the number of times a page has to be parsed.
-// it would also enable manually evicting stale records in the map
-func (pm *PagingManager) ParsePage() (*sorted.SortedMap[int, TDBTableRow], error) {
-	r := pm.p.NewReader()
+// Chain returns the current shape of the page chain
+func (pm *PagingManager) Chain() PageChain {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+	free := make(map[string]int, len(pm.free)+1)
+	for id, n := range pm.free {
+		free[id] = n
+	}
+	free[pm.p.Id.String()] = paging.MAX_PAGE_SIZE - pm.p.Size()
+	return PageChain{FirstPage: pm.first_page, LastPage: pm.p.Id.String(), PageCount: pm.count, FreeSpace: free}
+}
+
+// open reopens a chain saved on disk, loading its last page.
+// Pages appended after the chain was saved are followed to find the current last page.
+func (pm *PagingManager) open(chain PageChain) error {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	base := pm.t.Base()
+	for _, id := range []string{chain.FirstPage, chain.LastPage} {
+		_, err := os.Stat(path.Join(base, id))
+		if os.IsNotExist(err) && chain.PageCount <= 1 {
+			// the table's only page was still empty so it was never written
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("page chain: %w", err)
+		}
+	}
+
+	free := map[string]int{}
+	for id, n := range chain.FreeSpace {
+		free[id] = n
+	}
+	count := chain.PageCount
+	p, err := paging.LoadPage(base, chain.LastPage, pm.t.Schema.cipher())
+	if errors.Is(err, paging.ERR_PAGE_NOT_FOUND) && chain.PageCount <= 1 {
+		p, err = paging.NewPageWithId(uuid.MustParse(chain.LastPage), uuid.Nil, uuid.Nil), nil
+	}
+	if err != nil {
+		return err
+	}
+	for p.Next != uuid.Nil {
+		free[p.Id.String()] = paging.MAX_PAGE_SIZE - p.Size()
+		p, err = paging.LoadPageUUID(base, p.Next, pm.t.Schema.cipher())
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	delete(free, p.Id.String())
+
+	pm.p = p
+	pm.p_rows = nil
+	pm.first_page = chain.FirstPage
+	pm.t.first_page_id = chain.FirstPage
+	pm.count = count
+	pm.free = free
+	return nil
+}
+
+// reset points the manager at a new chain of pages, such as after compaction or repair
+func (pm *PagingManager) reset(pages []*paging.Page) {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	last := pages[len(pages)-1]
+	pm.free = map[string]int{}
+	for _, p := range pages[:len(pages)-1] {
+		pm.free[p.Id.String()] = paging.MAX_PAGE_SIZE - p.Size()
+	}
+	if !pm.t.Schema.InMem() {
+		pm.cache().Remove(pm.t)
+	}
+	pm.p = last
+	pm.p_rows = nil
+	pm.first_page = pages[0].Id.String()
+	pm.t.first_page_id = pm.first_page
+	pm.count = len(pages)
+	pm.resets.Add(1)
+}
+
+func parsePage(t *Table, p *paging.Page) (*sorted.SortedMap[int, TDBTableRow], error) {
+	r := p.NewReader()
 
 	m := sorted.New[int, TDBTableRow](0, tdbTableRowsComparisonFunc)
-	d := make([]any, 2)
 	for r.ReadNext() {
-		err := gob.NewDecoder(bytes.NewReader(r.Buf)).Decode(&d)
+		key, value, err := t.DecodeRecord(r.Buf)
 		if err != nil {
 			return nil, err
 		}
-		key := d[0].(int)
-		value := d[1].(TDBTableRow)
 
 		if !m.Insert(key, value) {
 			m.Replace(key, value)
 		}
 	}
-	pm.has_parsed = true
+	if r.Err != nil {
+		return nil, r.Err
+	}
 	return m, nil
 }
 
-func (pm *PagingManager) LoadPage(id string) error {
-	if pm.last_loaded_page == id {
-		return nil
-	}
+// ParsePage returns the parsed rows of the last page
+func (pm *PagingManager) ParsePage() (*sorted.SortedMap[int, TDBTableRow], error) {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+	return pm.parseLastPage()
+}
 
-	err := pm.p.WriteToFile(pm.t.Base(), pm.t.Schema.InMem())
+func (pm *PagingManager) parseLastPage() (*sorted.SortedMap[int, TDBTableRow], error) {
+	if pm.p_rows != nil {
+		return pm.p_rows, nil
+	}
+	m, err := parsePage(pm.t, pm.p)
 	if err != nil {
-		pkg.ErrorLog("failed to write page", err)
+		return nil, err
+	}
+	pm.p_rows = m
+	return m, nil
+}
+
+func (pm *PagingManager) cache() *PageCache { return pm.t.Schema.PageCache() }
+
+// PageRows returns the parsed rows of the page with id and the id of the page after it.
+func (pm *PagingManager) PageRows(id uuid.UUID) (*sorted.SortedMap[int, TDBTableRow], uuid.UUID, error) {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	if id == pm.p.Id {
+		m, err := pm.parseLastPage()
+		return m, pm.p.Next, err
 	}
 
-	p, err := paging.LoadPage(pm.t.Base(), id)
+	if pm.t.Schema.InMem() {
+		return nil, uuid.Nil, fmt.Errorf("page %s not found", id)
+	}
+
+	entry, err := pm.cache().Get(pm.t, id)
 	if err != nil {
-		return err
+		return nil, uuid.Nil, err
 	}
-	pm.last_loaded_page = id
-	pm.has_parsed = false
-	pm.p = p
-	return nil
+	return entry.rows, entry.page.Next, nil
 }
 
-func (pm *PagingManager) LoadNextPage() error {
-	if pm.p.Next == uuid.Nil {
-		pm.p.Next = uuid.New()
+// Page returns the page with id
+func (pm *PagingManager) Page(id uuid.UUID) (*paging.Page, error) {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	if id == pm.p.Id {
+		return pm.p, nil
 	}
-	curr_page_id := pm.p.Id
-	err := pm.LoadPage(pm.p.Next.String())
+	entry, err := pm.cache().Get(pm.t, id)
 	if err != nil {
+		return nil, err
+	}
+	return entry.page, nil
+}
+
+// pageAfter returns the id of the page after the page with id, which may be missing or corrupt
+func (pm *PagingManager) pageAfter(id uuid.UUID) (uuid.UUID, error) {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+	if pm.p.Prev == id {
+		return pm.p.Id, nil
+	}
+	if next, ok := pm.cache().pageAfter(pm.t, id); ok {
+		return next, nil
+	}
+	return paging.PageAfter(pm.t.Base(), id)
+}
+
+// LastPageId returns the id of the page new records are written to
+func (pm *PagingManager) LastPageId() string {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+	return pm.p.Id.String()
+}
+
+// appendPage starts a new last page and hands the previous one to the page cache
+func (pm *PagingManager) appendPage() error {
+	prev := pm.p
+	next := paging.NewPage(prev.Id, uuid.Nil)
+	prev.SetNext(next.Id)
+	if err := pm.cache().Put(pm.t, prev); err != nil {
 		return err
 	}
-	pm.p.Prev = curr_page_id
+	pm.free[prev.Id.String()] = paging.MAX_PAGE_SIZE - prev.Size()
+	pm.p = next
+	pm.p_rows = nil
+	pm.count++
 	return nil
 }
 
-func (pm *PagingManager) Insert(key int, value TDBTableRow) error {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode([]any{key, value}); err != nil {
+// Flush writes the table's dirty pages to disk
+func (pm *PagingManager) Flush() error {
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	if err := pm.cache().Flush(pm.t); err != nil {
 		return err
 	}
+	return pm.t.writePage(pm.p)
+}
+
+// writePage writes a page of the table to disk, compressed and encrypted as set in the server's write settings
+func (t *Table) writePage(p *paging.Page) error {
+	if t.Schema.InMem() {
+		return nil
+	}
+	p.SetCompression(t.Schema.Tdb.WriteSettings.Compression)
+	p.SetCipher(t.Schema.cipher())
+	return p.WriteToFile(t.Base(), false)
+}
 
-	d := buf.Bytes()
+func (pm *PagingManager) Insert(key int, value TDBTableRow) error {
+	d, err := pm.t.EncodeRecord(key, value)
+	if err != nil {
+		return err
+	}
 	return pm.InsertBytes(d)
 }
 
+// InsertMany encodes every row up front and pushes the records into pages in order.
+// It returns the id of the page each row was written to.
+//
+// When a record can't be pushed, the records pushed before it are followed by tombstones,
+// so the rows don't come back when the table's indexes are rebuilt from its pages,
+// and the pages of the rows that were pushed are returned with the error.
+func (pm *PagingManager) InsertMany(rows []TDBTableRow) ([]string, error) {
+	records := make([][]byte, len(rows))
+	for i, row := range rows {
+		d, err := pm.t.EncodeRecord(GetPrimaryKey(row), row)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = d
+	}
+
+	page_ids := make([]string, 0, len(rows))
+	for i, d := range records {
+		if err := pm.InsertBytes(d); err != nil {
+			for _, row := range rows[:i] {
+				if err := pm.Insert(GetPrimaryKey(row), TDBTableRow{}); err != nil {
+					pkg.ErrorLog("failed to tombstone row", GetPrimaryKey(row), err)
+				}
+			}
+			return page_ids, err
+		}
+		page_ids = append(page_ids, pm.LastPageId())
+	}
+	return page_ids, nil
+}
+
 func (pm *PagingManager) InsertBytes(d []byte) error {
-	pm.has_parsed = false
+	pm.locker.Lock()
+	defer pm.locker.Unlock()
+
+	pm.p_rows = nil
 	err := pm.p.Push(d, pm.t.Schema.InMem())
 	if err == nil || err != paging.ERR_PAGE_OVERFLOW {
 		return err
 	}
 
-	// on ERR_PAGE_OVERFLOW attempt to insert in next page
-	err = pm.LoadNextPage()
-	if err != nil {
+	// on ERR_PAGE_OVERFLOW insert in a new page
+	if err := pm.appendPage(); err != nil {
 		return err
 	}
-	return pm.InsertBytes(d)
+	return pm.p.Push(d, pm.t.Schema.InMem())
 }
@@ -1,9 +1,11 @@
 package builder_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/paging"
 	"gotest.tools/assert"
 )
 
@@ -24,3 +26,25 @@ func TestPagingManager(t *testing.T) {
 	assert.DeepEqual(t, m.Idx[1], builder.TDBTableRow{"a": 1, "b": 2})
 	assert.DeepEqual(t, m.Idx[2], builder.TDBTableRow{"c": 3, "d": 4})
 }
+
+func TestPageCompressionStats(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	s.Tdb.WriteSettings.Compression = paging.CompressionFlate
+	rows := s.Tables.Get("a").Rows()
+	value := strings.Repeat("text ", 1000)
+	for i := 1; i <= 100; i++ {
+		assert.Assert(t, rows.Insert(i, builder.TDBTableRow{builder.SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	s.Tdb.WriteToFile()
+
+	stats := s.Stats().Compression
+	assert.Equal(t, stats.Compression, paging.CompressionFlate)
+	assert.Assert(t, stats.StoredBytes > 0)
+	assert.Assert(t, stats.Ratio > 10, stats.Ratio)
+
+	tdb := builder.NewTobsDB(builder.AuthSettings{}, builder.NewWriteSettings(s.Tdb.WriteSettings.WritePath, false, 0), builder.LogOptions{})
+	loaded := tdb.Data.Get(s.Name).Data.Get("a")
+	row, ok := loaded.Get(100)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), value)
+}
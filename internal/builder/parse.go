@@ -40,8 +40,19 @@ func ParseSchema(schema_data string) (*Schema, error) {
 			current_table.Name = data.Name
 			current_table.Fields = pkg.NewInsertSortMap[string, *Field]()
 			current_table.Indexes = []string{}
+			current_table.Properties = data.TableProperties
 		case parser.ParserStateTableEnd:
+			if err := CheckTableRules(current_table); err != nil {
+				return nil, ParseLineError(line_idx, err.Error())
+			}
 			schema.Tables.Push(current_table.Name, current_table)
+			if current_table.KeepsHistory() {
+				history := NewHistoryTable(current_table)
+				if schema.Tables.Has(history.Name) {
+					return nil, ParseLineError(line_idx, fmt.Sprintf("Duplicate table %s", history.Name))
+				}
+				schema.Tables.Push(history.Name, history)
+			}
 			current_table = &Table{IdTracker: atomic.Int64{}, Schema: &schema}
 		case parser.ParserStateNewField:
 			if current_table.Fields.Has(data.Name) {
@@ -77,6 +88,10 @@ func ParseSchema(schema_data string) (*Schema, error) {
 		return nil, err
 	}
 
+	if err := ValidateSchemaHooks(&schema); err != nil {
+		return nil, err
+	}
+
 	return &schema, nil
 }
 
@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+type RekeyStats struct {
+	// meta and index files
+	Files int `json:"files"`
+	Pages int `json:"pages"`
+	// files that were already encrypted with the new key
+	Skipped int `json:"skipped"`
+}
+
+// rekeyFile rewrites a meta or index file encrypted with from so it is encrypted with to.
+// rel is the file's path relative to the db directory.
+func rekeyFile(name, rel string, from, to *pkg.Cipher) (bool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	plain, err := from.DecryptFile(data, rel)
+	if err != nil {
+		if _, new_err := to.DecryptFile(data, rel); new_err == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	return true, pkg.WriteFileAtomic(name, to.EncryptFile(plain, rel), info.Mode().Perm())
+}
+
+// Rekey re-encrypts every page, index and meta file of the db in dir from one cipher to another.
+// Either cipher may be nil to encrypt an unencrypted db or decrypt an encrypted one.
+// The db must not be in use.
+//
+// Each file is replaced atomically and files already encrypted with to are skipped,
+// so an interrupted rekey can be run again with the same keys.
+// Backups and quarantined pages are left as they are.
+func Rekey(dir string, from, to *pkg.Cipher) (*RekeyStats, error) {
+	stats := &RekeyStats{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == BACKUP_DIR {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasSuffix(d.Name(), ".tdb") {
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			rekeyed, err := rekeyFile(name, filepath.ToSlash(rel), from, to)
+			if err != nil {
+				return err
+			}
+			if rekeyed {
+				stats.Files++
+			} else {
+				stats.Skipped++
+			}
+			return nil
+		}
+
+		id, parse_err := uuid.Parse(d.Name())
+		if parse_err != nil {
+			return nil
+		}
+		rekeyed, err := paging.RekeyPage(filepath.Dir(name), id, from, to)
+		if err != nil {
+			return err
+		}
+		if rekeyed {
+			stats.Pages++
+		} else {
+			stats.Skipped++
+		}
+		return nil
+	})
+	return stats, err
+}
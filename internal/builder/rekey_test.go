@@ -0,0 +1,107 @@
+package builder_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/pkg"
+	"gotest.tools/assert"
+)
+
+func newTestKey(t *testing.T) *pkg.Cipher {
+	key := make([]byte, pkg.KEY_SIZE)
+	_, err := rand.Read(key)
+	assert.NilError(t, err)
+	c, err := pkg.NewCipher(key)
+	assert.NilError(t, err)
+	return c
+}
+
+func loadEncrypted(t *testing.T, dir string, c *pkg.Cipher) *Schema {
+	settings := NewWriteSettings(dir, false, 0)
+	settings.Cipher = c
+	tdb := NewTobsDB(AuthSettings{}, settings, LogOptions{})
+	s := tdb.Data.Get("test")
+	assert.Assert(t, s != nil)
+	return s
+}
+
+func TestEncryptedSchema(t *testing.T) {
+	key := newTestKey(t)
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}\n$TABLE c {\n d String\n}")
+	s.Tdb.WriteSettings.Cipher = key
+	rows := s.Tables.Get("a").Rows()
+	for i := 1; i <= 10; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": "secret value"}))
+	}
+	s.Tdb.WriteToFile()
+
+	dir := s.Tdb.WriteSettings.WritePath
+	meta, err := os.ReadFile(path.Join(dir, META_FILE))
+	assert.NilError(t, err)
+	assert.Assert(t, pkg.IsEncryptedFile(meta))
+
+	_, err = NewSchemaFromPath(dir, s.Name, nil)
+	assert.Assert(t, errors.Is(err, pkg.ERR_ENCRYPTED), err)
+
+	row, ok := loadEncrypted(t, dir, key).Tables.Get("a").Rows().Get(10)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "secret value")
+
+	// index files are bound to their table, so one can't be swapped for another's
+	a, c := s.Tables.Get("a").Base(), s.Tables.Get("c").Base()
+	indexes, err := filepath.Glob(path.Join(a, "index.*.tdb"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(indexes), 1)
+	data, err := os.ReadFile(indexes[0])
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(path.Join(c, path.Base(indexes[0])), data, 0o644))
+	_, err = BuildTableIndexesFromPath(s.Base(), "c", 1, key)
+	assert.Assert(t, errors.Is(err, pkg.ERR_DECRYPT), err)
+}
+
+func TestRekey(t *testing.T) {
+	from, to := newTestKey(t), newTestKey(t)
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	rows := s.Tables.Get("a").Rows()
+	for i := 1; i <= 10; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": "value"}))
+	}
+	s.Tdb.WriteToFile()
+	dir := s.Tdb.WriteSettings.WritePath
+
+	// encrypt a plaintext db
+	stats, err := Rekey(dir, nil, from)
+	assert.NilError(t, err)
+	assert.Assert(t, stats.Files > 0)
+	assert.Assert(t, stats.Pages > 0)
+	assert.Equal(t, stats.Skipped, 0)
+	assert.Equal(t, loadEncrypted(t, dir, from).Tables.Get("a").Rows().Len(), 10)
+
+	stats, err = Rekey(dir, from, to)
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Skipped, 0)
+	_, err = NewSchemaFromPath(dir, s.Name, from)
+	assert.Assert(t, errors.Is(err, pkg.ERR_DECRYPT), err)
+	assert.Equal(t, loadEncrypted(t, dir, to).Tables.Get("a").Rows().Len(), 10)
+
+	// running it again skips files already encrypted with the new key
+	again, err := Rekey(dir, from, to)
+	assert.NilError(t, err)
+	assert.Equal(t, again.Files+again.Pages, 0)
+	assert.Equal(t, again.Skipped, stats.Files+stats.Pages)
+
+	// a wrong key is not mistaken for an already rekeyed file
+	_, err = Rekey(dir, newTestKey(t), from)
+	assert.Assert(t, errors.Is(err, pkg.ERR_DECRYPT), err)
+
+	stats, err = Rekey(dir, to, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Skipped, 0)
+	assert.Equal(t, loadEncrypted(t, dir, nil).Tables.Get("a").Rows().Len(), 10)
+}
@@ -0,0 +1,318 @@
+package builder
+
+import (
+	"os"
+	"path"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// DuplicateValue is a value of a unique field shared by more than one row.
+// The index keeps the row with the lowest id.
+type DuplicateValue struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+	Rows  []int  `json:"rows"`
+}
+
+type RepairStats struct {
+	Table       string `json:"table"`
+	Pages       int    `json:"pages"`
+	Rows        int    `json:"rows"`
+	DeadRecords int    `json:"deadRecords"`
+	// pages missing from the chain, such as quarantined pages, whose rows were lost
+	LostPages  []string         `json:"lostPages"`
+	Duplicates []DuplicateValue `json:"duplicates"`
+}
+
+// chainHead finds the first page of the table's page chain on disk.
+// It is the page with no previous page, preferring the known first page,
+// or the first page after a missing one when the head itself was lost.
+// When a crash left more than one chain, such as during compaction, the most recently written one is used.
+func (t *Table) chainHead(pages map[uuid.UUID]*paging.Page) uuid.UUID {
+	if t.first_page_id != "" {
+		if p, ok := pages[uuid.MustParse(t.first_page_id)]; ok && p.Prev == uuid.Nil {
+			return p.Id
+		}
+	}
+
+	newest := func(is_head func(p *paging.Page) bool) uuid.UUID {
+		head := uuid.Nil
+		var head_time int64
+		for id, p := range pages {
+			if !is_head(p) {
+				continue
+			}
+			info, err := os.Stat(path.Join(t.Base(), id.String()))
+			if err != nil {
+				continue
+			}
+			if head == uuid.Nil || info.ModTime().UnixNano() > head_time {
+				head, head_time = id, info.ModTime().UnixNano()
+			}
+		}
+		return head
+	}
+
+	head := newest(func(p *paging.Page) bool { return p.Prev == uuid.Nil })
+	if head != uuid.Nil {
+		return head
+	}
+	return newest(func(p *paging.Page) bool {
+		_, ok := pages[p.Prev]
+		return !ok
+	})
+}
+
+// loadChain reads the table's page chain from disk in order.
+// Pages missing from the chain are skipped by following the page that links back to them,
+// and the pages around the gap are relinked.
+func (t *Table) loadChain(stats *RepairStats) ([]*paging.Page, error) {
+	ids, err := paging.ListPages(t.Base())
+	if err != nil {
+		return nil, err
+	}
+
+	pages := map[uuid.UUID]*paging.Page{}
+	// previous page id -> page, to step over missing pages
+	after := map[uuid.UUID]*paging.Page{}
+	for _, id := range ids {
+		p, err := paging.LoadPageUUID(t.Base(), id, t.Schema.cipher())
+		if err != nil {
+			// reported as lost when the chain is walked
+			t.quarantinePage(id, err)
+			continue
+		}
+		if p.IsOverflow() {
+			continue
+		}
+		pages[id] = p
+		after[p.Prev] = p
+	}
+
+	chain := []*paging.Page{}
+	head := t.chainHead(pages)
+	if head == uuid.Nil {
+		return chain, nil
+	}
+	if p := pages[head]; p.Prev != uuid.Nil {
+		stats.LostPages = append(stats.LostPages, p.Prev.String())
+		p.SetPrev(uuid.Nil)
+	}
+	visited := map[uuid.UUID]bool{}
+	for p := pages[head]; p != nil && !visited[p.Id]; {
+		visited[p.Id] = true
+		chain = append(chain, p)
+		if p.Next == uuid.Nil {
+			break
+		}
+
+		next, ok := pages[p.Next]
+		if !ok {
+			stats.LostPages = append(stats.LostPages, p.Next.String())
+			next = after[p.Next]
+			if next == nil {
+				p.SetNext(uuid.Nil)
+				break
+			}
+			p.SetNext(next.Id)
+			next.SetPrev(p.Id)
+		}
+		p = next
+	}
+	return chain, nil
+}
+
+// Rebuild recovers the table's primary index and unique indexes from its pages,
+// instead of trusting the index files.
+//
+// The latest copy of each row in the page chain wins and deleted rows are dropped.
+// Rows that share a value of a unique field are reported as duplicates.
+// The rebuilt indexes are only in memory until the schema is written.
+func (t *Table) Rebuild() (*RepairStats, error) {
+	r := t.Rows()
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	pm := r.PM
+	stats := &RepairStats{Table: t.Name, LostPages: []string{}, Duplicates: []DuplicateValue{}}
+
+	var chain []*paging.Page
+	if t.Schema.InMem() {
+		chain = []*paging.Page{pm.p}
+	} else {
+		if err := pm.Flush(); err != nil {
+			return nil, err
+		}
+		var err error
+		chain, err = t.loadChain(stats)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) == 0 {
+			chain = []*paging.Page{pm.p}
+		}
+	}
+
+	refs := TDBTablePageRefs{}
+	rows := map[int]TDBTableRow{}
+	records := 0
+	max_key := 0
+	for _, p := range chain {
+		reader := p.NewReader()
+		for reader.ReadNext() {
+			key, row, err := t.DecodeRecord(reader.Buf)
+			if err != nil {
+				return nil, err
+			}
+			records++
+			max_key = max(max_key, key)
+			if IsTombstone(row) {
+				delete(rows, key)
+				refs.Delete(key)
+				continue
+			}
+			rows[key] = row
+			refs.Set(key, p.Id.String())
+		}
+		if reader.Err != nil {
+			return nil, reader.Err
+		}
+	}
+
+	keys := make([]int, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	indexes := TDBTableIndexes{}
+	for _, name := range t.Indexes {
+		field := t.Fields.Get(name)
+		if field == nil || field.IndexLevel() != IndexLevelUnique {
+			continue
+		}
+		index := &TDBTableIndexMap{Map: map[string]int{}}
+		duplicates := map[string]*DuplicateValue{}
+		dup_order := []string{}
+		for _, key := range keys {
+			// soft deleted rows keep their values out of the unique indexes
+			if IsDeleted(rows[key]) {
+				continue
+			}
+			value := rows[key].Get(name)
+			if value == nil {
+				continue
+			}
+			if !index.Has(value) {
+				index.Set(value, key)
+				continue
+			}
+			formatted := FormatIndexValue(value)
+			if _, ok := duplicates[formatted]; !ok {
+				duplicates[formatted] = &DuplicateValue{name, formatted, []int{index.Get(value)}}
+				dup_order = append(dup_order, formatted)
+			}
+			duplicates[formatted].Rows = append(duplicates[formatted].Rows, key)
+		}
+		for _, v := range dup_order {
+			stats.Duplicates = append(stats.Duplicates, *duplicates[v])
+		}
+		indexes.Set(name, index)
+	}
+
+	if !t.Schema.InMem() {
+		for _, p := range chain[:len(chain)-1] {
+			if err := t.writePage(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pm.reset(chain)
+
+	m, err := pm.ParsePage()
+	if err != nil {
+		return nil, err
+	}
+	r.Map = m
+	r.PageRefs = refs
+	r.keys = sortedKeys(refs)
+	r.Indexes = indexes
+	r.DeletedPageRefs = TDBTablePageRefs{}
+	r.dead.Store(int64(records - len(rows)))
+	if int64(max_key) > t.IdTracker.Load() {
+		t.IdTracker.Store(int64(max_key))
+	}
+
+	t.Schema.markRepaired(t.Name)
+	for _, dup := range stats.Duplicates {
+		pkg.WarnLog("duplicate unique value", t.Name, dup.Field, dup.Value, dup.Rows)
+	}
+
+	stats.Pages = len(chain)
+	stats.Rows = len(rows)
+	stats.DeadRecords = int(r.dead.Load())
+	return stats, nil
+}
+
+// Repair rebuilds the indexes of every table from their pages and commits them.
+func (s *Schema) Repair() ([]*RepairStats, error) {
+	res := []*RepairStats{}
+	for _, name := range s.Tables.Sorted {
+		stats, err := s.Tables.Get(name).Rebuild()
+		if err != nil {
+			return res, err
+		}
+		res = append(res, stats)
+	}
+	if s.InMem() {
+		return res, nil
+	}
+	return res, s.writeToFile()
+}
+
+// openPages reopens each table's page chain from the chain saved in meta.tdb.
+// Tables whose chain is missing or cannot be opened are rebuilt from their pages.
+func (s *Schema) openPages() {
+	for _, t := range s.Tables.Idx {
+		chain := t.page_chain
+		t.page_chain = nil
+		if t.needs_repair {
+			continue
+		}
+		if chain == nil {
+			// saved before the page chain was persisted
+			pages, err := paging.ListPages(t.Base())
+			t.needs_repair = err == nil && len(pages) > 0
+			continue
+		}
+		if err := t.Rows().open(*chain); err != nil {
+			pkg.ErrorLog("failed to open page chain, it will be rebuilt from pages", s.Name, t.Name, err)
+			t.needs_repair = true
+		}
+	}
+}
+
+// repairPending rebuilds the tables whose index files failed to load
+func (s *Schema) repairPending() error {
+	repaired := false
+	for _, t := range s.Tables.Idx {
+		if !t.needs_repair {
+			continue
+		}
+		stats, err := t.Rebuild()
+		if err != nil {
+			return err
+		}
+		t.needs_repair = false
+		repaired = true
+		pkg.WarnLog("rebuilt indexes from pages", s.Name, t.Name, stats.Rows, "rows")
+	}
+	if !repaired {
+		return nil
+	}
+	return s.writeToFile()
+}
@@ -0,0 +1,139 @@
+package builder_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+func TestRebuild(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String unique(true)\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	for i := 1; i <= 3; i++ {
+		row := TDBTableRow{SYS_PRIMARY_KEY: i, "b": string(rune('a' + i))}
+		assert.Assert(t, rows.Insert(i, row))
+	}
+	assert.Assert(t, rows.Replace(2, TDBTableRow{SYS_PRIMARY_KEY: 2, "b": "z"}))
+	assert.Assert(t, rows.Delete(3))
+	assert.NilError(t, table.WriteToFile())
+
+	// stale indexes
+	rows.PageRefs = TDBTablePageRefs{}
+	rows.Indexes = TDBTableIndexes{}
+	table.IdTracker.Store(0)
+
+	stats, err := table.Rebuild()
+	assert.NilError(t, err)
+	assert.Equal(t, stats.Rows, 2)
+	assert.Equal(t, stats.DeadRecords, 3)
+	assert.Equal(t, len(stats.Duplicates), 0)
+
+	assert.Equal(t, rows.Len(), 2)
+	row, ok := rows.Get(2)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "z")
+	_, ok = rows.Get(3)
+	assert.Assert(t, !ok)
+
+	assert.Assert(t, table.IndexMap("b").Has("z"))
+	assert.Assert(t, !table.IndexMap("b").Has("c"))
+	assert.Assert(t, !table.IndexMap("b").Has("d"))
+	assert.Equal(t, table.IdTracker.Load(), int64(3))
+}
+
+func TestRebuildDuplicates(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String unique(true)\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+	for i := 1; i <= 3; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": "same"}))
+	}
+
+	stats, err := table.Rebuild()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stats.Duplicates, []DuplicateValue{{Field: "b", Value: "same", Rows: []int{1, 2, 3}}})
+	assert.Equal(t, table.IndexMap("b").Get("same"), 1)
+}
+
+func TestRebuildSoftDeleted(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a softDelete(true) {\n b String unique(true)\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+	deleted_at := time.Now()
+	assert.Assert(t, rows.Insert(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "b": "same", SYS_DELETED_AT: deleted_at}))
+	assert.Assert(t, rows.Insert(2, TDBTableRow{SYS_PRIMARY_KEY: 2, "b": "same", SYS_DELETED_AT: deleted_at}))
+	assert.Assert(t, rows.Insert(3, TDBTableRow{SYS_PRIMARY_KEY: 3, "b": "same"}))
+	assert.Assert(t, rows.Insert(4, TDBTableRow{SYS_PRIMARY_KEY: 4, "b": "other", SYS_DELETED_AT: deleted_at}))
+
+	for range 2 {
+		stats, err := table.Rebuild()
+		assert.NilError(t, err)
+		assert.Equal(t, stats.Rows, 4)
+		assert.Equal(t, len(stats.Duplicates), 0)
+		assert.Equal(t, table.IndexMap("b").Get("same"), 3)
+		assert.Assert(t, !table.IndexMap("b").Has("other"))
+	}
+}
+
+func TestRebuildLostPage(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	s.Tdb.WriteSettings.PageCacheSize = 1
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+
+	value := strings.Repeat("x", 50_000)
+	for i := 1; i <= 200; i++ {
+		assert.Assert(t, rows.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	assert.NilError(t, table.WriteToFile())
+
+	lost := rows.PageRefs.Get(100)
+	lost_rows := 0
+	for _, page := range rows.PageRefs {
+		if page == lost {
+			lost_rows++
+		}
+	}
+	assert.NilError(t, os.Remove(path.Join(table.Base(), lost)))
+
+	stats, err := table.Rebuild()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, stats.LostPages, []string{lost})
+	assert.Equal(t, stats.Rows, 200-lost_rows)
+
+	count := 0
+	for _, err := range rows.Scan(context.Background()) {
+		assert.NilError(t, err)
+		count++
+	}
+	assert.Equal(t, count, 200-lost_rows)
+	_, ok := rows.Get(200)
+	assert.Assert(t, ok)
+}
+
+func TestRebuildOnLoad(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	for i := 1; i <= 3; i++ {
+		assert.Assert(t, table.Rows().Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": "c"}))
+	}
+	s.Tdb.WriteToFile()
+	assert.NilError(t, os.Remove(path.Join(table.Base(), "primary_index.1.tdb")))
+
+	tdb := NewTobsDB(AuthSettings{}, NewWriteSettings(s.Tdb.WriteSettings.WritePath, false, 0), LogOptions{})
+	loaded := tdb.Data.Get(s.Name)
+	assert.Assert(t, loaded != nil)
+	rows := loaded.Data.Get("a")
+	assert.Equal(t, rows.Len(), 3)
+	row, ok := rows.Get(2)
+	assert.Assert(t, ok)
+	assert.Equal(t, row.Get("b"), "c")
+}
@@ -0,0 +1,464 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+)
+
+// Records in table pages are encoded with a schema-aware binary format:
+//
+//	marker  byte     ROW_CODEC_MARKER
+//	version byte     ROW_CODEC_VERSION
+//	flags   byte     ROW_FLAG_*
+//	key     varint
+//	fields  uvarint  number of fields in the null bitmap
+//	bitmap  (fields+7)/8 bytes; bit i is set when the field with id i holds a value
+//	values           one for each set bit, in field id order, encoded by the field's type
+//	extra   uvarint  number of values not stored by field id, each a name followed by a tagged value
+//
+// A field's id is its position in the table's declaration.
+// Ints and Floats are 8 bytes, Bools 1 byte, and Strings, Bytes, Dates and Vectors are prefixed with their length as a uvarint.
+// A value that does not match its field's type, or a key that is not a field, is stored as an extra value.
+// Tombstones hold only the header and key.
+//
+// Records written before this format are gob encoded [key, row] pairs.
+// A gob stream starts with a uvarint whose first byte is below 0x80 or at least 0xf8, so it never starts with the marker.
+const (
+	ROW_CODEC_MARKER  byte = 0xa5
+	ROW_CODEC_VERSION byte = 1
+)
+
+const (
+	ROW_FLAG_TOMBSTONE byte = 1 << iota
+	// the row's SYS_PRIMARY_KEY is the record key and is not stored again
+	ROW_FLAG_ID
+)
+
+const (
+	tagNil byte = iota
+	tagInt
+	tagFloat
+	tagString
+	tagBool
+	tagDate
+	tagBytes
+	tagVector
+	tagRow
+)
+
+var ERR_INVALID_ROW_RECORD = errors.New("invalid row record")
+
+// valueType is the type a field's values are encoded with
+type valueType struct {
+	kind types.FieldType
+	// type of a vector's elements
+	elem *valueType
+}
+
+func fieldValueType(field *Field) *valueType {
+	vt := &valueType{kind: field.BuiltinType}
+	if field.BuiltinType != types.FieldTypeVector {
+		return vt
+	}
+	v_type, v_level := parser.ParseVectorProp(field.Properties.Get(props.FieldPropVector).(string))
+	elem := &valueType{kind: v_type}
+	for i := 1; i < v_level; i++ {
+		elem = &valueType{kind: types.FieldTypeVector, elem: elem}
+	}
+	vt.elem = elem
+	return vt
+}
+
+// rowCodec holds a table's field ids and types
+type rowCodec struct {
+	names []string
+	types []*valueType
+	ids   map[string]int
+}
+
+func (t *Table) rowCodec() *rowCodec {
+	t.codec_once.Do(func() {
+		c := &rowCodec{ids: map[string]int{}}
+		if t.Fields == nil {
+			// without fields every value is stored as an extra value
+			t.codec = c
+			return
+		}
+		for i, name := range t.Fields.Sorted {
+			c.names = append(c.names, name)
+			c.types = append(c.types, fieldValueType(t.Fields.Get(name)))
+			c.ids[name] = i
+		}
+		t.codec = c
+	})
+	return t.codec
+}
+
+// IsLegacyRecord reports whether a page record was written in the gob format used before the row codec
+func IsLegacyRecord(buf []byte) bool {
+	return len(buf) == 0 || buf[0] != ROW_CODEC_MARKER
+}
+
+// EncodeRecord encodes a row as a page record
+func (t *Table) EncodeRecord(key int, row TDBTableRow) ([]byte, error) {
+	buf := []byte{ROW_CODEC_MARKER, ROW_CODEC_VERSION, 0}
+	if IsTombstone(row) {
+		buf[2] = ROW_FLAG_TOMBSTONE
+		return binary.AppendVarint(buf, int64(key)), nil
+	}
+	if id, ok := row.Get(SYS_PRIMARY_KEY).(int); ok && id == key {
+		buf[2] = ROW_FLAG_ID
+	}
+	buf = binary.AppendVarint(buf, int64(key))
+
+	c := t.rowCodec()
+	buf = binary.AppendUvarint(buf, uint64(len(c.names)))
+	bitmap := len(buf)
+	buf = append(buf, make([]byte, (len(c.names)+7)/8)...)
+
+	extra := []string{}
+	for i, name := range c.names {
+		v, ok := row[name]
+		if !ok || v == nil {
+			continue
+		}
+		var typed bool
+		if buf, typed = appendTypedValue(buf, c.types[i], v); typed {
+			buf[bitmap+i/8] |= 1 << (i % 8)
+		} else {
+			extra = append(extra, name)
+		}
+	}
+	for name := range row {
+		if _, ok := c.ids[name]; ok {
+			continue
+		}
+		if name == SYS_PRIMARY_KEY && buf[2]&ROW_FLAG_ID != 0 {
+			continue
+		}
+		extra = append(extra, name)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(extra)))
+	for _, name := range extra {
+		buf = appendString(buf, name)
+		var err error
+		if buf, err = appendTaggedValue(buf, row[name]); err != nil {
+			return nil, fmt.Errorf("encode %s: %w", name, err)
+		}
+	}
+	return buf, nil
+}
+
+// DecodeRecord decodes a page record written by EncodeRecord or in the legacy gob format
+func (t *Table) DecodeRecord(buf []byte) (int, TDBTableRow, error) {
+	if IsLegacyRecord(buf) {
+		return decodeLegacyRecord(buf)
+	}
+
+	r := &recordReader{buf: buf}
+	flags, key := r.header()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if flags&ROW_FLAG_TOMBSTONE != 0 {
+		return key, TDBTableRow{}, nil
+	}
+
+	c := t.rowCodec()
+	row := TDBTableRow{}
+	if flags&ROW_FLAG_ID != 0 {
+		row[SYS_PRIMARY_KEY] = key
+	}
+
+	n := r.uvarint()
+	if n > uint64(len(c.names)) {
+		return 0, nil, ERR_INVALID_ROW_RECORD
+	}
+	bitmap := r.next(int(n+7) / 8)
+	for i := 0; i < int(n) && r.err == nil; i++ {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			row[c.names[i]] = r.typedValue(c.types[i])
+		}
+	}
+
+	extra := r.length()
+	for i := 0; i < extra && r.err == nil; i++ {
+		name := r.string()
+		row[name] = r.taggedValue()
+	}
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	return key, row, nil
+}
+
+// recordKey returns the key of a page record without decoding its row
+func recordKey(buf []byte) (int, error) {
+	if IsLegacyRecord(buf) {
+		key, _, err := decodeLegacyRecord(buf)
+		return key, err
+	}
+	r := &recordReader{buf: buf}
+	_, key := r.header()
+	return key, r.err
+}
+
+func decodeLegacyRecord(buf []byte) (int, TDBTableRow, error) {
+	d := make([]any, 2)
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&d); err != nil {
+		return 0, nil, err
+	}
+	return d[0].(int), d[1].(TDBTableRow), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendTypedValue appends v encoded as vt.
+// It returns buf unchanged and false when v is not a value of vt.
+func appendTypedValue(buf []byte, vt *valueType, v any) ([]byte, bool) {
+	switch vt.kind {
+	case types.FieldTypeInt:
+		if v, ok := v.(int); ok {
+			return binary.LittleEndian.AppendUint64(buf, uint64(v)), true
+		}
+	case types.FieldTypeFloat:
+		if v, ok := v.(float64); ok {
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v)), true
+		}
+	case types.FieldTypeString:
+		if v, ok := v.(string); ok {
+			return appendString(buf, v), true
+		}
+	case types.FieldTypeBytes:
+		if v, ok := v.([]byte); ok {
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			return append(buf, v...), true
+		}
+	case types.FieldTypeBool:
+		if v, ok := v.(bool); ok {
+			if v {
+				return append(buf, 1), true
+			}
+			return append(buf, 0), true
+		}
+	case types.FieldTypeDate:
+		if v, ok := v.(time.Time); ok {
+			data, err := v.MarshalBinary()
+			if err != nil {
+				return buf, false
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(data)))
+			return append(buf, data...), true
+		}
+	case types.FieldTypeVector:
+		v, ok := v.([]any)
+		if !ok {
+			return buf, false
+		}
+		start := len(buf)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		for _, e := range v {
+			if buf, ok = appendTypedValue(buf, vt.elem, e); !ok {
+				return buf[:start], false
+			}
+		}
+		return buf, true
+	}
+	return buf, false
+}
+
+func appendTaggedValue(buf []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case int:
+		return binary.LittleEndian.AppendUint64(append(buf, tagInt), uint64(v)), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(buf, tagFloat), math.Float64bits(v)), nil
+	case string:
+		return appendString(append(buf, tagString), v), nil
+	case bool:
+		buf, _ = appendTypedValue(append(buf, tagBool), &valueType{kind: types.FieldTypeBool}, v)
+		return buf, nil
+	case time.Time:
+		buf, ok := appendTypedValue(append(buf, tagDate), &valueType{kind: types.FieldTypeDate}, v)
+		if !ok {
+			return nil, fmt.Errorf("unsupported date %s", v)
+		}
+		return buf, nil
+	case []byte:
+		buf = binary.AppendUvarint(append(buf, tagBytes), uint64(len(v)))
+		return append(buf, v...), nil
+	case []any:
+		buf = binary.AppendUvarint(append(buf, tagVector), uint64(len(v)))
+		var err error
+		for _, e := range v {
+			if buf, err = appendTaggedValue(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case TDBTableRow:
+		buf = binary.AppendUvarint(append(buf, tagRow), uint64(len(v)))
+		var err error
+		for name, e := range v {
+			buf = appendString(buf, name)
+			if buf, err = appendTaggedValue(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// recordReader reads the parts of a record.
+// After the first read past the end of the record every read returns a zero value and err is set.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) fail() {
+	if r.err == nil {
+		r.err = ERR_INVALID_ROW_RECORD
+	}
+	r.buf = nil
+}
+
+func (r *recordReader) next(n int) []byte {
+	if n < 0 || n > len(r.buf) {
+		r.fail()
+		return make([]byte, max(n, 0))
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *recordReader) byte() byte { return r.next(1)[0] }
+
+func (r *recordReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// length reads the length of a string or the number of values in a vector or list.
+// Every value takes at least a byte so neither can be larger than what is left of the record.
+func (r *recordReader) length() int {
+	v := r.uvarint()
+	if v > uint64(len(r.buf)) {
+		r.fail()
+		return 0
+	}
+	return int(v)
+}
+
+func (r *recordReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) fixed64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+func (r *recordReader) string() string { return string(r.next(r.length())) }
+
+func (r *recordReader) header() (byte, int) {
+	if r.byte() != ROW_CODEC_MARKER {
+		r.fail()
+	}
+	if version := r.byte(); r.err == nil && version != ROW_CODEC_VERSION {
+		r.err = fmt.Errorf("unsupported row record version %d", version)
+	}
+	flags := r.byte()
+	return flags, int(r.varint())
+}
+
+func (r *recordReader) typedValue(vt *valueType) any {
+	switch vt.kind {
+	case types.FieldTypeInt:
+		return int(r.fixed64())
+	case types.FieldTypeFloat:
+		return math.Float64frombits(r.fixed64())
+	case types.FieldTypeString:
+		return r.string()
+	case types.FieldTypeBytes:
+		return bytes.Clone(r.next(r.length()))
+	case types.FieldTypeBool:
+		return r.byte() != 0
+	case types.FieldTypeDate:
+		var v time.Time
+		if err := v.UnmarshalBinary(r.next(r.length())); err != nil {
+			r.fail()
+		}
+		return v
+	case types.FieldTypeVector:
+		n := r.length()
+		v := make([]any, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			v = append(v, r.typedValue(vt.elem))
+		}
+		return v
+	}
+	r.fail()
+	return nil
+}
+
+func (r *recordReader) taggedValue() any {
+	switch tag := r.byte(); tag {
+	case tagNil:
+		return nil
+	case tagInt:
+		return r.typedValue(&valueType{kind: types.FieldTypeInt})
+	case tagFloat:
+		return r.typedValue(&valueType{kind: types.FieldTypeFloat})
+	case tagString:
+		return r.string()
+	case tagBool:
+		return r.byte() != 0
+	case tagDate:
+		return r.typedValue(&valueType{kind: types.FieldTypeDate})
+	case tagBytes:
+		return r.typedValue(&valueType{kind: types.FieldTypeBytes})
+	case tagVector:
+		n := r.length()
+		v := make([]any, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			v = append(v, r.taggedValue())
+		}
+		return v
+	case tagRow:
+		n := r.length()
+		v := make(TDBTableRow, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			name := r.string()
+			v[name] = r.taggedValue()
+		}
+		return v
+	}
+	r.fail()
+	return nil
+}
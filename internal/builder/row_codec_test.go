@@ -0,0 +1,202 @@
+package builder_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"gotest.tools/assert"
+)
+
+const codecTestSchema = `$TABLE a {
+	i Int optional(true)
+	f Float optional(true)
+	s String optional(true)
+	d Date optional(true)
+	b Bool optional(true)
+	raw Bytes optional(true)
+	v Vector vector(Int) optional(true)
+	vv Vector vector(String,2) optional(true)
+}`
+
+func newCodecTestTable(t testing.TB) *Table {
+	s, err := NewSchemaFromString(codecTestSchema, nil, false)
+	assert.NilError(t, err)
+	return s.Tables.Get("a")
+}
+
+func encodeLegacyRecord(t testing.TB, key int, row TDBTableRow) []byte {
+	var buf bytes.Buffer
+	assert.NilError(t, gob.NewEncoder(&buf).Encode([]any{key, row}))
+	return buf.Bytes()
+}
+
+func TestRowCodec(t *testing.T) {
+	table := newCodecTestTable(t)
+	date := time.Date(2024, 3, 1, 12, 30, 0, 5, time.FixedZone("", 3600))
+
+	rows := map[string]TDBTableRow{
+		"all types": {
+			SYS_PRIMARY_KEY: 7,
+			"i":             -42,
+			"f":             3.5,
+			"s":             "text",
+			"d":             date,
+			"b":             true,
+			"raw":           []byte{0, 1, 2},
+			"v":             []any{1, 2, 3},
+			"vv":            []any{[]any{"a"}, []any{}},
+		},
+		"empty values": {SYS_PRIMARY_KEY: 7, "s": "", "v": []any{}, "b": false},
+		"only id":      {SYS_PRIMARY_KEY: 7},
+		"extra values": {
+			SYS_PRIMARY_KEY: 7,
+			"i":             "not an int",
+			"v":             []any{1, "two"},
+			"other":         []any{1, 2.5, nil, TDBTableRow{"x": true}},
+		},
+		"other id": {SYS_PRIMARY_KEY: 8, "i": 1},
+	}
+	for name, row := range rows {
+		t.Run(name, func(t *testing.T) {
+			buf, err := table.EncodeRecord(7, row)
+			assert.NilError(t, err)
+			assert.Assert(t, !IsLegacyRecord(buf))
+
+			key, decoded, err := table.DecodeRecord(buf)
+			assert.NilError(t, err)
+			assert.Equal(t, key, 7)
+			assert.DeepEqual(t, decoded, row)
+		})
+	}
+
+	t.Run("nil values are dropped", func(t *testing.T) {
+		buf, err := table.EncodeRecord(1, TDBTableRow{SYS_PRIMARY_KEY: 1, "s": nil})
+		assert.NilError(t, err)
+		_, decoded, err := table.DecodeRecord(buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, decoded, TDBTableRow{SYS_PRIMARY_KEY: 1})
+	})
+
+	t.Run("tombstone", func(t *testing.T) {
+		buf, err := table.EncodeRecord(3, TDBTableRow{})
+		assert.NilError(t, err)
+		key, decoded, err := table.DecodeRecord(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, key, 3)
+		assert.Assert(t, IsTombstone(decoded))
+	})
+
+	t.Run("legacy records", func(t *testing.T) {
+		row := TDBTableRow{SYS_PRIMARY_KEY: 2, "s": "text", "v": []any{1}}
+		buf := encodeLegacyRecord(t, 2, row)
+		assert.Assert(t, IsLegacyRecord(buf))
+		key, decoded, err := table.DecodeRecord(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, key, 2)
+		assert.DeepEqual(t, decoded, row)
+	})
+
+	t.Run("invalid records", func(t *testing.T) {
+		buf, err := table.EncodeRecord(7, rows["all types"])
+		assert.NilError(t, err)
+		for i := 1; i < len(buf); i++ {
+			_, _, err := table.DecodeRecord(buf[:i])
+			assert.Assert(t, err != nil, i)
+		}
+
+		future := bytes.Clone(buf)
+		future[1] = ROW_CODEC_VERSION + 1
+		_, _, err = table.DecodeRecord(future)
+		assert.ErrorContains(t, err, "unsupported row record version")
+	})
+}
+
+func TestCompactUpgradesLegacyRecords(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	rows := table.Rows()
+	for i := 1; i <= 10; i++ {
+		row := TDBTableRow{SYS_PRIMARY_KEY: i, "b": fmt.Sprint(i)}
+		assert.NilError(t, rows.PM.InsertBytes(encodeLegacyRecord(t, i, row)))
+		rows.PageRefs.Set(i, rows.PM.LastPageId())
+	}
+	assert.Assert(t, rows.Insert(11, TDBTableRow{SYS_PRIMARY_KEY: 11, "b": "11"}))
+
+	stats, err := table.Compact()
+	assert.NilError(t, err)
+	assert.Equal(t, stats.RecordsUpgraded, 10)
+
+	p, err := rows.PM.Page(uuid.MustParse(rows.PM.LastPageId()))
+	assert.NilError(t, err)
+	reader := p.NewReader()
+	for reader.ReadNext() {
+		assert.Assert(t, !IsLegacyRecord(reader.Buf))
+	}
+	for i := 1; i <= 11; i++ {
+		row, ok := rows.Get(i)
+		assert.Assert(t, ok)
+		assert.Equal(t, row.Get("b"), fmt.Sprint(i))
+	}
+}
+
+func benchmarkRow(i int) TDBTableRow {
+	return TDBTableRow{
+		SYS_PRIMARY_KEY: i,
+		"i":             i * 1000,
+		"f":             float64(i) / 3,
+		"s":             fmt.Sprintf("row number %d", i),
+		"d":             time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		"b":             i%2 == 0,
+		"v":             []any{i, i + 1, i + 2},
+	}
+}
+
+func BenchmarkRowEncode(b *testing.B) {
+	table := newCodecTestTable(b)
+	b.Run("codec", func(b *testing.B) {
+		size := 0
+		for i := 0; i < b.N; i++ {
+			buf, err := table.EncodeRecord(i, benchmarkRow(i))
+			if err != nil {
+				b.Fatal(err)
+			}
+			size += len(buf)
+		}
+		b.ReportMetric(float64(size)/float64(b.N), "bytes/record")
+	})
+	b.Run("gob", func(b *testing.B) {
+		size := 0
+		for i := 0; i < b.N; i++ {
+			size += len(encodeLegacyRecord(b, i, benchmarkRow(i)))
+		}
+		b.ReportMetric(float64(size)/float64(b.N), "bytes/record")
+	})
+}
+
+func BenchmarkRowDecode(b *testing.B) {
+	table := newCodecTestTable(b)
+	b.Run("codec", func(b *testing.B) {
+		buf, err := table.EncodeRecord(1, benchmarkRow(1))
+		assert.NilError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := table.DecodeRecord(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gob", func(b *testing.B) {
+		buf := encodeLegacyRecord(b, 1, benchmarkRow(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := table.DecodeRecord(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
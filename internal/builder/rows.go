@@ -1,7 +1,14 @@
 package builder
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/tobsdb/tobsdb/pkg"
@@ -19,6 +26,18 @@ func SetPrimaryKey(r TDBTableRow, key int) {
 	r.Set(SYS_PRIMARY_KEY, key)
 }
 
+// GetVersion returns the row's version. Rows written before row versions were added are version 1.
+func GetVersion(r TDBTableRow) int {
+	if !r.Has(SYS_VERSION) {
+		return 1
+	}
+	return pkg.NumToInt(r.Get(SYS_VERSION))
+}
+
+func SetVersion(r TDBTableRow, version int) {
+	r.Set(SYS_VERSION, version)
+}
+
 type TDBTablePageRefs = pkg.Map[int, string]
 
 // Maps row id to its saved data
@@ -31,6 +50,12 @@ type TDBTableRows struct {
 	// primary key -> page id
 	PageRefs        TDBTablePageRefs
 	DeletedPageRefs TDBTablePageRefs
+
+	// number of records in pages that were deleted or replaced by a newer copy.
+	// It is saved with the page chain, which is read while the table is locked for compaction.
+	dead atomic.Int64
+	// the primary keys of PageRefs in ascending order, for seeking without sorting the index
+	keys []int
 }
 
 func tdbTableRowsComparisonFunc(a, b TDBTableRow) bool {
@@ -43,7 +68,56 @@ func NewTDBTableRows(t *Table, indexes TDBTableIndexes, primary_indexes TDBTable
 	if err != nil {
 		pkg.FatalLog("failed to parse first page.", err)
 	}
-	return &TDBTableRows{sync.RWMutex{}, pm, m, indexes, primary_indexes, TDBTablePageRefs{}}
+	return &TDBTableRows{PM: pm, Map: m, Indexes: indexes, PageRefs: primary_indexes, DeletedPageRefs: TDBTablePageRefs{}, keys: sortedKeys(primary_indexes)}
+}
+
+func sortedKeys(refs TDBTablePageRefs) []int {
+	keys := refs.Keys()
+	slices.Sort(keys)
+	return keys
+}
+
+// setRef points key to the page it was written to, keeping the sorted keys in step
+func (r *TDBTableRows) setRef(key int, page_id string) {
+	if !r.PageRefs.Has(key) {
+		// keys are mostly created in ascending order
+		if n := len(r.keys); n == 0 || r.keys[n-1] < key {
+			r.keys = append(r.keys, key)
+		} else if i, found := slices.BinarySearch(r.keys, key); !found {
+			r.keys = slices.Insert(r.keys, i, key)
+		}
+	}
+	r.PageRefs.Set(key, page_id)
+}
+
+func (r *TDBTableRows) deleteRef(key int) {
+	if i, found := slices.BinarySearch(r.keys, key); found {
+		r.keys = slices.Delete(r.keys, i, i+1)
+	}
+	r.PageRefs.Delete(key)
+}
+
+// open reopens the table's page chain saved on disk
+func (r *TDBTableRows) open(chain PageChain) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if err := r.PM.open(chain); err != nil {
+		return err
+	}
+	m, err := r.PM.ParsePage()
+	if err != nil {
+		return err
+	}
+	r.Map = m
+	r.dead.Store(int64(chain.DeadRecords))
+	return nil
+}
+
+// Chain returns the current shape of the table's page chain, with its number of dead records
+func (r *TDBTableRows) Chain() PageChain {
+	chain := r.PM.Chain()
+	chain.DeadRecords = int(r.dead.Load())
+	return chain
 }
 
 func (r *TDBTableRows) GetLocker() *sync.RWMutex { return &r.locker }
@@ -57,19 +131,13 @@ func (r *TDBTableRows) Get(id int) (TDBTableRow, bool) {
 	}
 
 	page_id := r.PageRefs.Get(id)
-	err := r.PM.LoadPage(page_id)
+	m, _, err := r.PM.PageRows(uuid.MustParse(page_id))
 	if err != nil {
-		pkg.FatalLog("failed to load page.", err)
-	}
-
-	if !r.PM.has_parsed {
-		r.Map, err = r.PM.ParsePage()
-		if err != nil {
-			pkg.FatalLog("failed to parse page.", err)
-		}
+		pkg.ErrorLog("failed to load page.", err)
+		return nil, false
 	}
 
-	return r.Map.Get(id)
+	return m.Get(id)
 }
 
 func (r *TDBTableRows) Insert(key int, value TDBTableRow) bool {
@@ -82,10 +150,33 @@ func (r *TDBTableRows) Insert(key int, value TDBTableRow) bool {
 		pkg.ErrorLog(err)
 		return false
 	}
-	r.PageRefs.Set(key, r.PM.p.Id.String())
+	r.setRef(key, r.PM.LastPageId())
 	return true
 }
 
+// InsertMany writes rows in a single batch.
+// Either every row is added to the table or, on error, none of them are.
+func (r *TDBTableRows) InsertMany(rows []TDBTableRow) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	for _, row := range rows {
+		if r.PageRefs.Has(GetPrimaryKey(row)) {
+			return fmt.Errorf("row %d already exists", GetPrimaryKey(row))
+		}
+	}
+
+	page_ids, err := r.PM.InsertMany(rows)
+	if err != nil {
+		// the rows written before the error and their tombstones
+		r.dead.Add(int64(2 * len(page_ids)))
+		return err
+	}
+	for i, row := range rows {
+		r.setRef(GetPrimaryKey(row), page_ids[i])
+	}
+	return nil
+}
+
 func (r *TDBTableRows) Replace(key int, value TDBTableRow) bool {
 	r.locker.Lock()
 	defer r.locker.Unlock()
@@ -94,7 +185,10 @@ func (r *TDBTableRows) Replace(key int, value TDBTableRow) bool {
 		pkg.ErrorLog(err)
 		return false
 	}
-	r.PageRefs.Set(key, r.PM.p.Id.String())
+	if r.PageRefs.Has(key) {
+		r.dead.Add(1)
+	}
+	r.setRef(key, r.PM.LastPageId())
 	return true
 }
 
@@ -105,8 +199,15 @@ func (r *TDBTableRows) Delete(key int) bool {
 	if ref == "" {
 		return false
 	}
-	r.PageRefs.Delete(key)
+	// the tombstone keeps the row deleted when the indexes are rebuilt from pages
+	if err := r.PM.Insert(key, TDBTableRow{}); err != nil {
+		pkg.ErrorLog(err)
+		return false
+	}
+	r.deleteRef(key)
 	r.DeletedPageRefs.Set(key, ref)
+	// the deleted row and its tombstone
+	r.dead.Add(2)
 	return true
 }
 
@@ -122,52 +223,122 @@ func (r *TDBTableRows) Len() int {
 	return len(r.PageRefs)
 }
 
-func (r *TDBTableRows) CheckDeleted(row TDBTableRow) bool {
-	return r.DeletedPageRefs.Has(GetPrimaryKey(row))
-}
-
-func (r *TDBTableRows) Records() <-chan sorted.Record[int, TDBTableRow] {
-	rchan := make(chan sorted.Record[int, TDBTableRow], 1)
-	go func() {
-		err := r.PM.LoadPage(r.PM.first_page)
-		if err != nil {
-			pkg.ErrorLog(err)
-			return
-		}
+// KeysAfter returns an iterator over the primary keys greater than key, in ascending order.
+// It seeks the sorted primary index, so it doesn't read pages or sort keys,
+// and reads the keys in batches so the table isn't locked while the loop runs.
+func (r *TDBTableRows) KeysAfter(key int) iter.Seq[int] {
+	return func(yield func(int) bool) {
 		for {
-			if !r.PM.has_parsed {
-				r.Map, err = r.PM.ParsePage()
-				if err != nil {
-					pkg.ErrorLog(err)
-					return
-				}
+			r.locker.RLock()
+			i, found := slices.BinarySearch(r.keys, key)
+			if found {
+				i++
 			}
+			batch := slices.Clone(r.keys[i:min(i+SEEK_BATCH_SIZE, len(r.keys))])
+			r.locker.RUnlock()
 
-			icc, err := r.Map.IterCh()
-			if err != nil {
-				close(rchan)
+			if len(batch) == 0 {
 				return
 			}
-			for rec := range icc.Records() {
-				if !r.CheckDeleted(rec.Val) {
-					rchan <- rec
+			for _, k := range batch {
+				if !yield(k) {
+					return
 				}
 			}
+			key = batch[len(batch)-1]
+		}
+	}
+}
+
+// IsTombstone reports whether a record read from a page marks its row as deleted
+func IsTombstone(row TDBTableRow) bool { return len(row) == 0 }
+
+func (r *TDBTableRows) CheckDeleted(row TDBTableRow) bool {
+	return r.DeletedPageRefs.Has(GetPrimaryKey(row))
+}
+
+// ERR_SCAN_COMPACTED is returned by a scan whose table was compacted or repaired before it finished
+var ERR_SCAN_COMPACTED = errors.New("table was compacted during the scan")
+
+// Scan returns an iterator over the table's rows in page order.
+//
+// The rows are read from a snapshot of the primary index taken when the loop starts,
+// so rows written during the loop are not seen and rows changed during the loop are seen once.
+// Rows in the last page, which is written to in place, may be seen with their changes or not at all.
+// The table is only locked while each page is read, so the loop body may use the table,
+// but compacting or repairing it ends the iteration with ERR_SCAN_COMPACTED.
+//
+// Quarantined pages are stepped over. Any other page that fails to load, or ctx being done,
+// ends the iteration with the error.
+func (r *TDBTableRows) Scan(ctx context.Context) iter.Seq2[TDBTableRow, error] {
+	return func(yield func(TDBTableRow, error) bool) {
+		r.locker.RLock()
+		refs := maps.Clone(r.PageRefs)
+		first, last := uuid.MustParse(r.PM.first_page), uuid.MustParse(r.PM.LastPageId())
+		resets := r.PM.resets.Load()
+		r.locker.RUnlock()
 
-			if r.PM.p.Next == uuid.Nil {
-				close(rchan)
+		done := ctx.Done()
+		prev := uuid.Nil
+		for id := first; id != uuid.Nil; {
+			rows, next, err := r.scanPage(id, prev, refs, resets)
+			if err != nil {
+				yield(nil, err)
 				return
 			}
 
-			err = r.PM.LoadPage(r.PM.p.Next.String())
-			if err != nil {
-				pkg.ErrorLog(err)
-				close(rchan)
+			for _, row := range rows {
+				select {
+				case <-done:
+					yield(nil, ctx.Err())
+					return
+				default:
+				}
+
+				if !yield(row, nil) {
+					return
+				}
+			}
+			// pages after the last one were added during the loop and only hold rows it doesn't see
+			if id == last {
 				return
 			}
+			prev, id = id, next
 		}
-	}()
-	return rchan
+	}
+}
+
+// scanPage returns the rows of page id that refs point to, along with the id of the next page.
+// A quarantined page has no rows.
+func (r *TDBTableRows) scanPage(id, prev uuid.UUID, refs TDBTablePageRefs, resets uint64) ([]TDBTableRow, uuid.UUID, error) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	if r.PM.resets.Load() != resets {
+		return nil, uuid.Nil, ERR_SCAN_COMPACTED
+	}
+
+	m, next, err := r.PM.PageRows(id)
+	if err != nil {
+		// rows in a quarantined page are unavailable until the table is repaired,
+		// but the pages after it can still be read
+		next, ok, skip_err := r.PM.t.stepOverCorruptPage(id, prev)
+		if !ok || skip_err != nil {
+			return nil, uuid.Nil, errors.Join(err, skip_err)
+		}
+		return nil, next, nil
+	}
+
+	page_id := id.String()
+	rows := []TDBTableRow{}
+	for _, key := range m.Keys() {
+		rec, _ := m.Get(key)
+		// skip copies of rows that were replaced in a later page, and rows deleted since the snapshot
+		if refs.Get(key) != page_id || IsTombstone(rec) {
+			continue
+		}
+		rows = append(rows, rec)
+	}
+	return rows, next, nil
 }
 
 // TODO(Tobani): explore if paging manager needs to be updated in any way
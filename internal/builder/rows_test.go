@@ -1,8 +1,10 @@
 package builder_test
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 
@@ -85,13 +87,113 @@ func TestTDBTableRows(t *testing.T) {
 	})
 }
 
-func TestTDBTableRowsRecords(t *testing.T) {
+func TestTDBTableRowsKeysAfter(t *testing.T) {
+	r := NewTDBTableRows(&Table{Schema: &Schema{}}, TDBTableIndexes{}, TDBTablePageRefs{})
+	for _, i := range []int{5, 1, 9, 3, 7} {
+		assert.Assert(t, r.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i}))
+	}
+	assert.Assert(t, r.Delete(7))
+
+	keys := []int{}
+	for key := range r.KeysAfter(3) {
+		keys = append(keys, key)
+	}
+	assert.DeepEqual(t, keys, []int{5, 9})
+
+	big := newTestTDBTableRows(t, SEEK_BATCH_SIZE*2)
+	count := 0
+	for key := range big.KeysAfter(-1) {
+		if count == SEEK_BATCH_SIZE*2 {
+			assert.Equal(t, key, SEEK_BATCH_SIZE*3)
+		} else {
+			assert.Equal(t, key, count)
+		}
+		count++
+		// the table is not locked between batches, so keys written during the loop are seen
+		if count == SEEK_BATCH_SIZE {
+			assert.Assert(t, big.Insert(SEEK_BATCH_SIZE*3, TDBTableRow{SYS_PRIMARY_KEY: SEEK_BATCH_SIZE * 3}))
+		}
+	}
+	assert.Equal(t, count, SEEK_BATCH_SIZE*2+1)
+}
+
+func TestTDBTableRowsScan(t *testing.T) {
 	r := newTestTDBTableRows(t, 500)
-	ch := r.Records()
 	i := 0
-	for rec := range ch {
-		assert.DeepEqual(t, rec.Val, TDBTableRow{SYS_PRIMARY_KEY: i})
+	for row, err := range r.Scan(context.Background()) {
+		assert.NilError(t, err)
+		assert.DeepEqual(t, row, TDBTableRow{SYS_PRIMARY_KEY: i})
 		i++
 	}
 	assert.Equal(t, i, 500)
+
+	t.Run("stops early", func(t *testing.T) {
+		for range r.Scan(context.Background()) {
+			break
+		}
+		// the table is not left locked
+		assert.Assert(t, r.Insert(500, TDBTableRow{SYS_PRIMARY_KEY: 500}))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		count := 0
+		var scan_err error
+		for _, err := range r.Scan(ctx) {
+			if err != nil {
+				scan_err = err
+				break
+			}
+			count++
+			if count == 10 {
+				cancel()
+			}
+		}
+		assert.Equal(t, count, 10)
+		assert.Equal(t, scan_err, context.Canceled)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		count := 0
+		for row := range r.Scan(context.Background()) {
+			// the loop body can write to the table
+			if count == 0 {
+				assert.Assert(t, r.Insert(501, TDBTableRow{SYS_PRIMARY_KEY: 501}))
+			}
+			key := GetPrimaryKey(row)
+			assert.Assert(t, r.Replace(key, TDBTableRow{SYS_PRIMARY_KEY: key, "seen": true}))
+			count++
+		}
+		// rows written during the scan are not seen, and replaced rows are seen once
+		assert.Equal(t, count, 501)
+		assert.Assert(t, r.Has(501))
+	})
+}
+
+func TestTDBTableRowsScanCompacted(t *testing.T) {
+	s := newTestDiskSchema(t, "$TABLE a {\n b String\n}")
+	table := s.Tables.Get("a")
+	r := table.Rows()
+	// rows spread over several pages
+	value := strings.Repeat("x", 50_000)
+	for i := 1; i <= 100; i++ {
+		assert.Assert(t, r.Insert(i, TDBTableRow{SYS_PRIMARY_KEY: i, "b": value}))
+	}
+	assert.Assert(t, r.PM.Chain().PageCount > 1)
+
+	count := 0
+	var scan_err error
+	for _, err := range r.Scan(context.Background()) {
+		if err != nil {
+			scan_err = err
+			break
+		}
+		if count == 0 {
+			_, err := table.Compact()
+			assert.NilError(t, err)
+		}
+		count++
+	}
+	assert.Equal(t, scan_err, ERR_SCAN_COMPACTED)
 }
@@ -69,13 +69,28 @@ type Schema struct {
 
 	locker sync.RWMutex
 
-	WriteTicker *time.Ticker `json:"-"`
-	LastChange  time.Time    `json:"-"`
+	LastChange time.Time `json:"-"`
+	// when the schema was last written to disk; see Checkpointer
+	last_checkpoint time.Time
 
 	users []SchemaAccess
 
 	Tdb *TobsDB `json:"-"`
 
+	page_cache      *PageCache
+	page_cache_once sync.Once
+
+	// generation of the files last committed to disk; see Manifest
+	generation uint64
+
+	corrupt_locker sync.Mutex
+	corrupt_pages  []CorruptPage
+
+	changes      *ChangeFeed
+	changes_once sync.Once
+	// changes written to a snapshot that are published when it is applied
+	pending_changes []Change
+
 	parent *Schema
 }
 
@@ -104,6 +119,8 @@ func (s *Schema) ApplySnapshot(snapshot *Schema) error {
         TDBDataApplySnapshot(s.Data, snapshot.Data)
         s.LastChange = snapshot.LastChange
     }
+    s.Changes().Publish(snapshot.pending_changes...)
+    snapshot.pending_changes = nil
     return nil
 }
 
@@ -133,6 +150,30 @@ func (s *Schema) InMem() bool {
 	return s.Tdb.WriteSettings.InMem
 }
 
+// cipher returns the cipher the schema's files are encrypted with, or nil when they are not encrypted
+func (s *Schema) cipher() *pkg.Cipher {
+	if s.Tdb == nil {
+		return nil
+	}
+	return s.Tdb.WriteSettings.Cipher
+}
+
+// PageCache returns the page cache shared by the schema's tables.
+// Snapshots share the cache of the schema they were taken from.
+func (s *Schema) PageCache() *PageCache {
+	if s.parent != nil {
+		return s.parent.PageCache()
+	}
+	s.page_cache_once.Do(func() {
+		size := DEFAULT_PAGE_CACHE_SIZE
+		if s.Tdb != nil && s.Tdb.WriteSettings.PageCacheSize > 0 {
+			size = s.Tdb.WriteSettings.PageCacheSize
+		}
+		s.page_cache = NewPageCache(size)
+	})
+	return s.page_cache
+}
+
 func (s *Schema) AddUser(u *auth.TdbUser, r auth.TdbUserRole) error {
 	if slices.ContainsFunc(s.users, userAccess(u)) {
 		return fmt.Errorf("User %s already has access", u.Id)
@@ -176,6 +217,9 @@ func (s *Schema) UpdateLastChange() { s.LastChange = time.Now() }
 
 const SYS_PRIMARY_KEY = "__tdb_id__"
 
+// row field that counts the writes to a row, starting at 1 when it is created
+const SYS_VERSION = "__tdb_version__"
+
 func NewSchemaFromString(input string, data TDBData, build_only bool) (*Schema, error) {
 	if len(input) == 0 {
 		return nil, fmt.Errorf("No schema provided")
@@ -319,29 +363,7 @@ func (s *Schema) MetaData() ([]byte, error) { return json.Marshal(s) }
 func (s *Schema) WriteToFile() error {
 	s.locker.Lock()
 	defer s.locker.Unlock()
-
-	meta_data, err := s.MetaData()
-	if err != nil {
-		return err
-	}
-
-	base := s.Base()
-	if _, err := os.Stat(base); os.IsNotExist(err) {
-		os.Mkdir(base, 0o755)
-	}
-
-	if err := os.WriteFile(path.Join(base, "meta.tdb"), meta_data, 0o644); err != nil {
-		return err
-	}
-
-	for _, t := range s.Tables.Idx {
-		err := t.WriteToFile()
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return s.writeToFile()
 }
 
 func (s *Schema) Base() string {
@@ -356,12 +378,22 @@ func (s *Schema) Base() string {
 	return base
 }
 
-func NewSchemaFromPath(base, name string) (*Schema, error) {
+func NewSchemaFromPath(base, name string, c *pkg.Cipher) (*Schema, error) {
 	base = path.Join(base, name)
-	meta_data, err := os.ReadFile(path.Join(base, "meta.tdb"))
+	manifest, err := readManifest(base)
+	if err != nil {
+		return nil, err
+	}
+	meta_name := path.Join(name, generationFile(META_FILE, manifest.Generation))
+	meta_file := path.Join(base, generationFile(META_FILE, manifest.Generation))
+	meta_data, err := os.ReadFile(meta_file)
 	if err != nil {
 		return nil, err
 	}
+	meta_data, err = c.DecryptFile(meta_data, meta_name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", meta_file, err)
+	}
 
 	var s Schema
 	err = json.Unmarshal(meta_data, &s)
@@ -375,12 +407,18 @@ func NewSchemaFromPath(base, name string) (*Schema, error) {
 		for _, f := range t.Fields.Idx {
 			f.Table = t
 		}
-		indexes, err := BuildTableIndexesFromPath(base, t.Name)
+		indexes, err := BuildTableIndexesFromPath(base, t.Name, manifest.Generation, c)
 		if err != nil {
-			return nil, err
+			pkg.ErrorLog("failed to load indexes, they will be rebuilt from pages", name, t.Name, err)
+			indexes = &TdbIndexesBuilder{TDBTableIndexes{}, TDBTablePageRefs{}}
+			t.needs_repair = true
 		}
 		rows := NewTDBTableRows(t, indexes.Indexes, indexes.PrimaryIndexes)
 		s.Data.Set(t.Name, rows)
 	}
+	s.generation = manifest.Generation
+	if info, err := os.Stat(meta_file); err == nil {
+		s.last_checkpoint = info.ModTime()
+	}
 	return &s, nil
 }
@@ -4,9 +4,11 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/auth"
 	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/props"
 	"github.com/tobsdb/tobsdb/internal/query"
 	"gotest.tools/assert"
 )
@@ -201,6 +203,128 @@ $TABLE b {
 
 		assert.ErrorContains(t, err, "field types must match")
 	})
+
+	t.Run("table props", func(t *testing.T) {
+		s, err := ParseSchema(`
+$TABLE a ttl(1h30m) {
+    a Int
+}
+
+$TABLE b expiresAt(until) {
+    until Date optional(true)
+}
+        `)
+		assert.NilError(t, err)
+		assert.Equal(t, s.Tables.Get("a").TTL(), 90*time.Minute)
+		assert.Assert(t, s.Tables.Get("b").Expires())
+		assert.Equal(t, s.Tables.Get("b").TTL(), time.Duration(0))
+	})
+
+	t.Run("expiresAt unknown field", func(t *testing.T) {
+		_, err := ParseSchema(`
+$TABLE a expiresAt(until) {
+    a Int
+}
+        `)
+
+		assert.ErrorContains(t, err, "until is not a field of table a")
+	})
+
+	t.Run("expiresAt non date field", func(t *testing.T) {
+		_, err := ParseSchema(`
+$TABLE a expiresAt(until) {
+    until Int
+}
+        `)
+
+		assert.ErrorContains(t, err, "field until must be type Date")
+	})
+
+	t.Run("ttl and expiresAt", func(t *testing.T) {
+		_, err := ParseSchema(`
+$TABLE a ttl(1h) expiresAt(until) {
+    until Date
+}
+        `)
+
+		assert.ErrorContains(t, err, "cannot have both ttl and expiresAt props")
+	})
+
+	t.Run("history", func(t *testing.T) {
+		s, err := ParseSchema(`
+$TABLE a history(true) {
+    a Int unique(true)
+    b Vector vector(String)
+}
+        `)
+		assert.NilError(t, err)
+		table := s.Tables.Get("a")
+		history := table.History()
+		assert.Equal(t, history.Name, "a__history")
+		assert.Equal(t, history.HistoryOf(), table)
+		assert.Assert(t, table.HistoryOf() == nil)
+		assert.Equal(t, len(history.Indexes), 0)
+		assert.Equal(t, history.Fields.Get("b").Properties.Get(props.FieldPropVector), "String")
+		for _, name := range []string{"a", "b", SYS_VALID_FROM, HISTORY_FIELD_ACTOR} {
+			assert.Assert(t, history.Fields.Get(name).Properties.Get(props.FieldPropOptional).(bool))
+		}
+	})
+
+	t.Run("history table name taken", func(t *testing.T) {
+		_, err := ParseSchema(`
+$TABLE a__history {
+    a Int
+}
+
+$TABLE a history(true) {
+    a Int
+}
+        `)
+
+		assert.ErrorContains(t, err, "Duplicate table a__history")
+	})
+
+	t.Run("copy and counter", func(t *testing.T) {
+		_, err := ParseSchema(`
+$TABLE a {
+    id Int key(primary)
+    name String
+    count Int
+}
+
+$TABLE b {
+    title String
+    slug String copy(title)
+    a Int relation(a.id) counter(count)
+    a_name String optional(true) copy(a.name)
+}
+        `)
+		assert.NilError(t, err)
+	})
+
+	t.Run("invalid copy", func(t *testing.T) {
+		for schema, msg := range map[string]string{
+			"$TABLE a {\n b String\n c String copy(d)\n}":                    "d is not a field of table a",
+			"$TABLE a {\n b Int\n c String copy(b)\n}":                       "field types must match",
+			"$TABLE a {\n b String\n c String copy(b) unique(true)\n}":       "copies can't be keys, unique or relations",
+			"$TABLE a {\n b String\n c String copy(b)\n d String copy(c)\n}": "c is a copy",
+			"$TABLE a {\n b String\n c String copy(b.c)\n}":                  "b is not a relation field of table a",
+		} {
+			_, err := ParseSchema(schema)
+			assert.ErrorContains(t, err, msg)
+		}
+	})
+
+	t.Run("invalid counter", func(t *testing.T) {
+		for schema, msg := range map[string]string{
+			"$TABLE a {\n b Int counter(b)\n}":                                                   "counters must be on non-vector relation fields",
+			"$TABLE a {\n id Int\n n String\n}\n$TABLE b {\n a Int relation(a.id) counter(n)\n}": "field n must be type Int",
+			"$TABLE a {\n id Int\n}\n$TABLE b {\n a Int relation(a.id) counter(n)\n}":            "n is not a field of table a",
+		} {
+			_, err := ParseSchema(schema)
+			assert.ErrorContains(t, err, msg)
+		}
+	})
 }
 
 func TestSchemaJSON(t *testing.T) {
@@ -220,6 +344,14 @@ $TABLE a {
 
 	new_table := new_s.Tables.Get("a")
 	assert.Assert(t, new_table != nil)
+
+	s, err = NewSchemaFromString("$TABLE a ttl(1h) {\n b String\n}", nil, false)
+	assert.NilError(t, err)
+	data, err = s.MetaData()
+	assert.NilError(t, err)
+	new_s = Schema{}
+	assert.NilError(t, json.Unmarshal(data, &new_s))
+	assert.Equal(t, new_s.Tables.Get("a").TTL(), time.Hour)
 }
 
 func TestTableIndexesToBytes(t *testing.T) {
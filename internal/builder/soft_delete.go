@@ -0,0 +1,22 @@
+package builder
+
+import (
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/props"
+)
+
+// row field that holds when a row of a table with the softDelete prop was deleted
+const SYS_DELETED_AT = "__tdb_deleted_at__"
+
+// SoftDeletes reports whether deletes in the table only mark rows as deleted, so they can be restored
+func (t *Table) SoftDeletes() bool {
+	soft_delete, ok := t.Properties.Get(props.TablePropSoftDelete).(bool)
+	return ok && soft_delete
+}
+
+// IsDeleted reports whether the row was soft deleted
+func IsDeleted(row TDBTableRow) bool {
+	_, ok := row.Get(SYS_DELETED_AT).(time.Time)
+	return ok
+}
@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+const DEFAULT_SWEEP_INTERVAL = time.Minute
+
+// Sweeper deletes expired rows in the background.
+//
+// Expired rows are hidden from queries as soon as they expire, so the sweeper only reclaims their space.
+// Unlike the Checkpointer it also runs in in-memory mode.
+type Sweeper struct {
+	tdb      *TobsDB
+	interval time.Duration
+	// OnExpired runs for each expired row after it is deleted, while the schema's lock is held.
+	// The server sets it to run the table's afterDelete hooks, which builder can't reach.
+	OnExpired func(t *Table, row TDBTableRow)
+
+	stop_once sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewSweeper(tdb *TobsDB) *Sweeper {
+	interval := tdb.WriteSettings.SweepInterval
+	if interval <= 0 {
+		interval = DEFAULT_SWEEP_INTERVAL
+	}
+	return &Sweeper{tdb: tdb, interval: interval, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start runs the sweeper until Stop is called
+func (s *Sweeper) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.Sweep(time.Now())
+			}
+		}
+	}()
+}
+
+// Stop ends the background sweeps
+func (s *Sweeper) Stop() {
+	s.stop_once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// Sweep deletes the rows that expired at or before now from every schema and returns how many were deleted
+func (s *Sweeper) Sweep(now time.Time) int {
+	var schemas []*Schema
+	pkg.RLockWrap(s.tdb, func() {
+		for _, schema := range s.tdb.Data {
+			schemas = append(schemas, schema)
+		}
+	})
+
+	total := 0
+	for _, schema := range schemas {
+		pkg.LockWrap(schema, func() {
+			swept := 0
+			for _, t := range schema.Tables.Idx {
+				n, err := t.SweepExpired(context.Background(), now, s.OnExpired)
+				if err != nil {
+					pkg.ErrorLog("failed to sweep expired rows", schema.Name, t.Name, err)
+				}
+				swept += n
+			}
+			if swept > 0 {
+				pkg.DebugLog("swept expired rows", schema.Name, swept)
+				schema.UpdateLastChange()
+			}
+			total += swept
+		})
+	}
+	return total
+}
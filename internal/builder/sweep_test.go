@@ -0,0 +1,125 @@
+package builder_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/query"
+	"github.com/tobsdb/tobsdb/pkg"
+	"gotest.tools/assert"
+)
+
+const sweepTestSchema = `
+$TABLE a ttl(1h) {
+    b String unique(true)
+}
+
+$TABLE c expiresAt(until) {
+    until Date optional(true)
+}
+`
+
+func TestSweeper(t *testing.T) {
+	t.Run("ttl", func(t *testing.T) {
+		s := newTestDiskSchema(t, sweepTestSchema)
+		table := s.Tables.Get("a")
+		for _, b := range []string{"x", "y"} {
+			_, err := query.Create(table, query.QueryArg{"b": b})
+			assert.NilError(t, err)
+		}
+
+		sweeper := NewSweeper(s.Tdb)
+		assert.Equal(t, sweeper.Sweep(time.Now()), 0)
+		assert.Equal(t, table.Rows().Len(), 2)
+
+		assert.Equal(t, sweeper.Sweep(time.Now().Add(2*time.Hour)), 2)
+		assert.Equal(t, table.Rows().Len(), 0)
+		assert.Assert(t, !table.IndexMap("b").Has("x"))
+		assert.Assert(t, !table.IndexMap("b").Has("y"))
+	})
+
+	t.Run("reused unique value", func(t *testing.T) {
+		s := newTestDiskSchema(t, sweepTestSchema)
+		table := s.Tables.Get("a")
+		old, err := query.Create(table, query.QueryArg{"b": "x"})
+		assert.NilError(t, err)
+		old.Set(SYS_EXPIRES_AT, time.Now().Add(-time.Minute))
+		table.Rows().Replace(GetPrimaryKey(old), old)
+
+		row, err := query.Create(table, query.QueryArg{"b": "x"})
+		assert.NilError(t, err)
+
+		assert.Equal(t, NewSweeper(s.Tdb).Sweep(time.Now()), 1)
+		assert.Assert(t, !table.Rows().Has(GetPrimaryKey(old)))
+		assert.Equal(t, table.IndexMap("b").Get("x"), GetPrimaryKey(row))
+	})
+
+	t.Run("expiresAt", func(t *testing.T) {
+		s := newTestDiskSchema(t, sweepTestSchema)
+		table := s.Tables.Get("c")
+		for _, until := range []any{time.Now().Add(-time.Minute), nil, time.Now().Add(time.Hour)} {
+			_, err := query.Create(table, query.QueryArg{"until": until})
+			assert.NilError(t, err)
+		}
+
+		assert.Equal(t, NewSweeper(s.Tdb).Sweep(time.Now()), 1)
+		assert.Equal(t, table.Rows().Len(), 2)
+	})
+
+	t.Run("history", func(t *testing.T) {
+		s := newTestDiskSchema(t, "$TABLE h ttl(1h) history(true) {\n b String\n}")
+		table := s.Tables.Get("h")
+		row, err := query.Create(table, query.QueryArg{"b": "x"})
+		assert.NilError(t, err)
+		expires_at := row.Get(SYS_EXPIRES_AT).(time.Time)
+
+		assert.Equal(t, NewSweeper(s.Tdb).Sweep(time.Now().Add(2*time.Hour)), 1)
+		history := table.History().Rows()
+		assert.Equal(t, history.Len(), 1)
+		entry, _ := history.Get(1)
+		assert.Equal(t, entry.Get(HISTORY_FIELD_OPERATION), string(HistoryOperationDelete))
+		assert.Equal(t, entry.Get(HISTORY_FIELD_ROW_ID), GetPrimaryKey(row))
+		// the row stopped being current when it expired, not when it was swept
+		assert.Assert(t, entry.Get(HISTORY_FIELD_VALID_TO).(time.Time).Equal(expires_at))
+	})
+
+	t.Run("soft deleted", func(t *testing.T) {
+		s := newTestDiskSchema(t, "$TABLE h ttl(1h) history(true) softDelete(true) {\n b String\n}")
+		table := s.Tables.Get("h")
+		row, err := query.Create(table, query.QueryArg{"b": "x"})
+		assert.NilError(t, err)
+		_, err = query.Delete(table, row, "")
+		assert.NilError(t, err)
+		history := table.History().Rows().Len()
+		seq := s.Changes().Seq()
+
+		assert.Equal(t, NewSweeper(s.Tdb).Sweep(time.Now().Add(2*time.Hour)), 1)
+		assert.Equal(t, table.Rows().Len(), 0)
+		// the soft delete already recorded the row's delete
+		assert.Equal(t, table.History().Rows().Len(), history)
+		assert.Equal(t, s.Changes().Seq(), seq)
+	})
+
+	t.Run("background", func(t *testing.T) {
+		s := newTestDiskSchema(t, sweepTestSchema)
+		s.Tdb.WriteSettings.SweepInterval = 10 * time.Millisecond
+		table := s.Tables.Get("c")
+		_, err := query.Create(table, query.QueryArg{"until": time.Now().Add(20 * time.Millisecond)})
+		assert.NilError(t, err)
+
+		sweeper := NewSweeper(s.Tdb)
+		sweeper.Start()
+		defer sweeper.Stop()
+
+		size := func() (n int) {
+			pkg.RLockWrap(s, func() { n = table.Rows().Len() })
+			return
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for size() > 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(t, size(), 0)
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"maps"
 	"os"
 	"path"
+	"sync"
 	"sync/atomic"
 
+	"github.com/tobsdb/tobsdb/internal/props"
 	"github.com/tobsdb/tobsdb/pkg"
 )
 
@@ -15,12 +18,21 @@ type Table struct {
 	Name    string
 	Fields  *pkg.InsertSortMap[string, *Field]
 	Indexes []string
+	// props declared after the table name, e.g. ttl(24h)
+	Properties pkg.Map[props.TableProp, any] `json:",omitempty"`
 
 	IdTracker atomic.Int64 `json:"-"`
 
 	Schema *Schema `json:"-"`
 
 	first_page_id string
+	// page chain read from meta.tdb, until the table's pages are opened
+	page_chain *PageChain
+	// set when the index files failed to load and the indexes must be rebuilt from pages
+	needs_repair bool
+
+	codec      *rowCodec
+	codec_once sync.Once
 
 	parent *Table
 }
@@ -30,6 +42,7 @@ func (t *Table) NewSnapshot() *Table {
 		Name:    t.Name,
 		Fields:  pkg.NewInsertSortMap[string, *Field](),
 		Indexes: make([]string, len(t.Indexes)),
+		Properties: maps.Clone(t.Properties),
         parent: t,
 	}
 	for _, f := range t.Fields.Idx {
@@ -46,10 +59,16 @@ func (t *Table) ApplySnapshot(snapshot *Table) {
 
 func (t *Table) MarshalJSON() ([]byte, error) {
 	type T Table
+	var chain *PageChain
+	if t.Schema != nil && t.Schema.Data.Has(t.Name) {
+		c := t.Rows().Chain()
+		chain = &c
+	}
 	return json.Marshal(struct {
 		*T
 		IdTracker int64
-	}{(*T)(t), t.IdTracker.Load()})
+		PageChain *PageChain `json:",omitempty"`
+	}{(*T)(t), t.IdTracker.Load(), chain})
 }
 
 func (t *Table) UnmarshalJSON(data []byte) error {
@@ -57,11 +76,13 @@ func (t *Table) UnmarshalJSON(data []byte) error {
 	buf := struct {
 		*T
 		IdTracker int64
+		PageChain *PageChain
 	}{T: (*T)(t)}
 	if err := json.Unmarshal(data, &buf); err != nil {
 		return err
 	}
 	t.IdTracker.Store(buf.IdTracker)
+	t.page_chain = buf.PageChain
 	return nil
 }
 
@@ -123,7 +144,11 @@ const (
 	PRIMARY_INDEX_FILE = "primary_index.tdb"
 )
 
-func (t *Table) WriteToFile() error {
+// WriteToFile writes the table's pages and commits its indexes along with the rest of the schema
+func (t *Table) WriteToFile() error { return t.Schema.writeToFile() }
+
+// writeIndexes writes the table's index files for generation gen
+func (t *Table) writeIndexes(gen uint64) error {
 	indexes_bufs, err := t.IndexBytes()
 	if err != nil {
 		return err
@@ -136,22 +161,15 @@ func (t *Table) WriteToFile() error {
 		}
 	}
 
-	err = os.WriteFile(path.Join(base, INDEX_FILE), indexes_bufs.IndexBuf.Bytes(), 0o644)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(path.Join(base, PRIMARY_INDEX_FILE), indexes_bufs.PrimaryIndexBuf.Bytes(), 0o644)
-	if err != nil {
-		return err
-	}
-
-	err = t.Rows().PM.p.WriteToFile(base, t.Schema.InMem())
+	c := t.Schema.cipher()
+	index_name := path.Join(t.Schema.Name, t.Name, generationFile(INDEX_FILE, gen))
+	err = pkg.WriteFileAtomic(path.Join(base, generationFile(INDEX_FILE, gen)), c.EncryptFile(indexes_bufs.IndexBuf.Bytes(), index_name), 0o644)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	primary_index_name := path.Join(t.Schema.Name, t.Name, generationFile(PRIMARY_INDEX_FILE, gen))
+	return pkg.WriteFileAtomic(path.Join(base, generationFile(PRIMARY_INDEX_FILE, gen)), c.EncryptFile(indexes_bufs.PrimaryIndexBuf.Bytes(), primary_index_name), 0o644)
 }
 
 type TdbIndexesBuilder struct {
@@ -159,18 +177,25 @@ type TdbIndexesBuilder struct {
 	PrimaryIndexes TDBTablePageRefs
 }
 
-func BuildTableIndexesFromPath(base, name string) (*TdbIndexesBuilder, error) {
-	index_file := path.Join(base, name, INDEX_FILE)
+func BuildTableIndexesFromPath(base, name string, gen uint64, c *pkg.Cipher) (*TdbIndexesBuilder, error) {
+	index_file := path.Join(base, name, generationFile(INDEX_FILE, gen))
 	index_buf, err := os.ReadFile(index_file)
 	if err != nil {
 		return nil, err
 	}
+	// files are named by their path relative to the db directory, which holds the schema's directory
+	if index_buf, err = c.DecryptFile(index_buf, path.Join(path.Base(base), name, generationFile(INDEX_FILE, gen))); err != nil {
+		return nil, err
+	}
 
-	primary_index_file := path.Join(base, name, PRIMARY_INDEX_FILE)
+	primary_index_file := path.Join(base, name, generationFile(PRIMARY_INDEX_FILE, gen))
 	primary_index_buf, err := os.ReadFile(primary_index_file)
 	if err != nil {
 		return nil, err
 	}
+	if primary_index_buf, err = c.DecryptFile(primary_index_buf, path.Join(path.Base(base), name, generationFile(PRIMARY_INDEX_FILE, gen))); err != nil {
+		return nil, err
+	}
 
 	indexes := TdbIndexesBuilder{}
 	err = gob.NewDecoder(bytes.NewReader(index_buf)).Decode(&indexes.Indexes)
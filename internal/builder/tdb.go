@@ -1,6 +1,7 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/tobsdb/tobsdb/internal/auth"
+	"github.com/tobsdb/tobsdb/internal/paging"
 	"github.com/tobsdb/tobsdb/pkg"
 )
 
@@ -18,6 +20,14 @@ type TDBWriteSettings struct {
 	WritePath     string
 	InMem         bool
 	WriteInterval time.Duration
+	// number of pages each schema keeps in memory besides the last page of every table
+	PageCacheSize int
+	// compression of pages written to disk. pages already on disk are read with the compression they were written with
+	Compression paging.Compression
+	// encrypts every file of the db except schema manifests. files are not encrypted when nil
+	Cipher *pkg.Cipher
+	// time between sweeps of expired rows; see Sweeper
+	SweepInterval time.Duration
 }
 
 func NewWriteSettings(write_path string, in_mem bool, write_interval_ms int) *TDBWriteSettings {
@@ -27,7 +37,7 @@ func NewWriteSettings(write_path string, in_mem bool, write_interval_ms int) *TD
 			pkg.FatalLog("Must either provide db path or use in-memory mode")
 		}
 	}
-	return &TDBWriteSettings{write_path, in_mem, write_interval}
+	return &TDBWriteSettings{write_path, in_mem, write_interval, DEFAULT_PAGE_CACHE_SIZE, paging.CompressionNone, nil, DEFAULT_SWEEP_INTERVAL}
 }
 
 type (
@@ -105,18 +115,21 @@ func ReadFromFile(tdb *TobsDB) (data TdbSchemaMap, users TdbUserMap) {
 		return
 	}
 
-	f, open_err := os.Open(path.Join(tdb.WriteSettings.WritePath, "meta.tdb"))
-	if open_err != nil {
-		if !errors.Is(open_err, &os.PathError{}) {
-			pkg.ErrorLog("failed to open db file;", open_err)
+	meta_data, read_err := os.ReadFile(path.Join(tdb.WriteSettings.WritePath, META_FILE))
+	if read_err != nil {
+		if !errors.Is(read_err, &os.PathError{}) {
+			pkg.ErrorLog("failed to open db file;", read_err)
 			return
 		}
-		pkg.ErrorLog(open_err)
+		pkg.ErrorLog(read_err)
+	}
+	meta_data, err := tdb.WriteSettings.Cipher.DecryptFile(meta_data, META_FILE)
+	if err != nil {
+		pkg.FatalLog(err)
 	}
-	defer f.Close()
 
 	meta := &TdbMeta{[]string{}, TdbUserMap{}}
-	err := json.NewDecoder(f).Decode(meta)
+	err = json.NewDecoder(bytes.NewReader(meta_data)).Decode(meta)
 	if err != nil {
 		if err == io.EOF {
 			pkg.WarnLog("read empty db file")
@@ -128,11 +141,15 @@ func ReadFromFile(tdb *TobsDB) (data TdbSchemaMap, users TdbUserMap) {
 
 	users = meta.Users
 	for _, key := range meta.SchemaKeys {
-		s, err := NewSchemaFromPath(tdb.WriteSettings.WritePath, key)
+		s, err := NewSchemaFromPath(tdb.WriteSettings.WritePath, key, tdb.WriteSettings.Cipher)
 		if err != nil {
 			pkg.FatalLog(err)
 		}
 		s.Tdb = tdb
+		s.openPages()
+		if err := s.repairPending(); err != nil {
+			pkg.FatalLog(err)
+		}
 		data.Set(key, s)
 	}
 
@@ -159,7 +176,8 @@ func (tdb *TobsDB) WriteToFile() {
 		os.Mkdir(tdb.WriteSettings.WritePath, 0o755)
 	}
 
-	if err := os.WriteFile(path.Join(tdb.WriteSettings.WritePath, "meta.tdb"), meta_data, 0o644); err != nil {
+	meta_data = tdb.WriteSettings.Cipher.EncryptFile(meta_data, META_FILE)
+	if err := pkg.WriteFileAtomic(path.Join(tdb.WriteSettings.WritePath, META_FILE), meta_data, 0o644); err != nil {
 		pkg.FatalLog(err)
 	}
 
@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -79,8 +80,9 @@ type WsRequest struct {
 	ReqId  int           `json:"__tdb_client_req_id__"` // used in tdb clients
 }
 
-func HandleConnection(tdb *builder.TobsDB, conn net.Conn) {
-	ctx := NewConnCtx(conn)
+func HandleConnection(server_ctx context.Context, tdb *builder.TobsDB, conn net.Conn) {
+	ctx := NewConnCtx(server_ctx, conn)
+	defer ctx.cancel()
 	defer conn.Close()
 	defer pkg.InfoLog("Connection closed from", conn.RemoteAddr())
 	for {
@@ -105,22 +107,21 @@ func HandleConnection(tdb *builder.TobsDB, conn net.Conn) {
 			continue
 		}
 
-		if ctx.Schema != nil && ctx.Schema.WriteTicker != nil {
-			pkg.LockWrap(ctx.Schema, func() {
-				ctx.Schema.WriteTicker.Reset(tdb.WriteSettings.WriteInterval)
-			})
-		}
-
 		var req WsRequest
 		if err := json.Unmarshal(buf, &req); err != nil {
 			pkg.ErrorLog("parsing request", err)
 			continue
 		}
 
+		// changes pushed to subscriptions wait for the response,
+		// so the response to a subscribe request comes before its changes
+		ctx.write_locker.Lock()
+		ctx.req_id = req.ReqId
 		res := ActionHandler(tdb, req.Action, ctx, buf)
 		res.ReqId = req.ReqId
-
-		if _, err := ctx.WriteResponse(res); err != nil {
+		_, err = ctx.write(res.Marshal())
+		ctx.write_locker.Unlock()
+		if err != nil {
 			pkg.ErrorLog("writing response", err)
 			return
 		}
@@ -1,8 +1,10 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/tobsdb/tobsdb/internal/auth"
@@ -17,17 +19,38 @@ type ConnCtx struct {
 	isAuthed    bool
 	shouldClose bool
 
+	// canceled when the connection is closed or the server shuts down
+	context context.Context
+	cancel  context.CancelFunc
+
 	User   *auth.TdbUser
 	Schema *builder.Schema
 
 	TxCtx *transaction.TransactionCtx
+
+	// held while writing a frame, since subscriptions write changes from their own goroutines
+	write_locker      sync.Mutex
+	subscriptions     pkg.Map[int, *builder.ChangeSubscription]
+	last_subscription int
+	// client id of the request being handled
+	req_id int
 }
 
 // New connections have a 30 second deadline.
 // If the deadline is reached, and the connection is not authenticated, the connection is closed.
-func NewConnCtx(c net.Conn) *ConnCtx {
+func NewConnCtx(parent context.Context, c net.Conn) *ConnCtx {
 	c.SetDeadline(time.Now().Add(30 * time.Second))
-	return &ConnCtx{c, 0, false, false, nil, nil, nil}
+	conn_ctx, cancel := context.WithCancel(parent)
+	return &ConnCtx{conn: c, context: conn_ctx, cancel: cancel}
+}
+
+// Context returns the context requests on the connection run with.
+// Long reads, such as table scans, stop when it is canceled.
+func (ctx *ConnCtx) Context() context.Context {
+	if ctx.context == nil {
+		return context.Background()
+	}
+	return ctx.context
 }
 
 // SetAuthed marks the connection as authenticated and removes the deadline.
@@ -49,6 +72,12 @@ func (c *ConnCtx) Read() ([]byte, error) {
 }
 
 func (ctx *ConnCtx) Write(buf []byte) (int, error) {
+	ctx.write_locker.Lock()
+	defer ctx.write_locker.Unlock()
+	return ctx.write(buf)
+}
+
+func (ctx *ConnCtx) write(buf []byte) (int, error) {
 	if ctx.shouldClose {
 		return 0, errors.New(shouldCloseError)
 	}
@@ -56,3 +85,11 @@ func (ctx *ConnCtx) Write(buf []byte) (int, error) {
 }
 func (ctx *ConnCtx) WriteString(buf string) (int, error)   { return ctx.Write([]byte(buf)) }
 func (ctx *ConnCtx) WriteResponse(r Response) (int, error) { return ctx.Write(r.Marshal()) }
+
+// writePart writes part of the response to the request being handled, ahead of the response itself.
+// Handlers run while the write lock is held, so it is not taken again.
+func (ctx *ConnCtx) writePart(r Response) error {
+	r.ReqId = ctx.req_id
+	_, err := ctx.write(r.Marshal())
+	return err
+}
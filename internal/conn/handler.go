@@ -1,20 +1,31 @@
 package conn
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/auth"
 	"github.com/tobsdb/tobsdb/internal/builder"
 	"github.com/tobsdb/tobsdb/internal/query"
 	"github.com/tobsdb/tobsdb/internal/transaction"
+	"github.com/tobsdb/tobsdb/pkg"
 )
 
 type Response struct {
 	Data    any    `json:"data"`
 	Message string `json:"message"`
 	Status  int    `json:"status"`
+	// cursor to the next page of a findMany response
+	Cursor string `json:"cursor,omitempty"`
+	// id of the subscription a pushed change belongs to
+	Subscription int `json:"subscription,omitempty"`
 	// don't manually set this. it comes from the client
 	ReqId int `json:"__tdb_client_req_id__"`
 }
@@ -74,6 +85,14 @@ func CreateReqHandler(schema *builder.Schema, raw []byte) Response {
 type CreateManyRequest struct {
 	Table string           `json:"table"`
 	Data  []query.QueryArg `json:"data"`
+	// skip rows that conflict on a unique field instead of failing the request
+	SkipDuplicates bool `json:"skipDuplicates"`
+}
+
+type CreateManyResult struct {
+	Created []builder.TDBTableRow `json:"created"`
+	// indices of the skipped rows in the request data, empty without skipDuplicates
+	Skipped []int `json:"skipped"`
 }
 
 func CreateManyReqHandler(schema *builder.Schema, raw []byte) Response {
@@ -88,29 +107,29 @@ func CreateManyReqHandler(schema *builder.Schema, raw []byte) Response {
 	}
 
 	table := schema.Tables.Get(req.Table)
-	created_rows := []map[string]any{}
-	for _, row := range req.Data {
-		res, err := query.Create(table, row)
-		if err != nil {
-			if query_error, ok := err.(*query.QueryError); ok {
-				return NewErrorResponse(query_error.Status(), query_error.Error())
-			}
-			return NewErrorResponse(http.StatusBadRequest, err.Error())
+	created_rows, skipped, err := query.CreateMany(table, req.Data, req.SkipDuplicates)
+	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
 		}
-		created_rows = append(created_rows, res)
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
 	schema.UpdateLastChange()
-	return NewResponse(
-		http.StatusCreated,
-		fmt.Sprintf("Created %d new rows in table %s", len(created_rows), table.Name),
-		created_rows,
-	)
+	message := fmt.Sprintf("Created %d new rows in table %s", len(created_rows), table.Name)
+	if req.SkipDuplicates {
+		message += fmt.Sprintf(", skipped %d duplicates", len(skipped))
+	}
+	return NewResponse(http.StatusCreated, message, CreateManyResult{created_rows, skipped})
 }
 
 type FindRequest struct {
 	Table string         `json:"table"`
 	Where query.QueryArg `json:"where"`
+	// also find soft deleted rows
+	IncludeDeleted bool `json:"includeDeleted"`
+	// find the row as it was at this time, in tables with the history prop
+	AsOf *time.Time `json:"asOf"`
 }
 
 func FindReqHandler(schema *builder.Schema, raw []byte) Response {
@@ -125,7 +144,16 @@ func FindReqHandler(schema *builder.Schema, raw []byte) Response {
 	}
 
 	table := schema.Tables.Get(req.Table)
-	res, err := query.FindUnique(table, req.Where)
+	find := query.FindUnique
+	if req.IncludeDeleted {
+		find = query.FindUniqueIncludeDeleted
+	}
+	if req.AsOf != nil {
+		find = func(table *builder.Table, where query.QueryArg) (builder.TDBTableRow, error) {
+			return query.FindUniqueAsOf(table, where, *req.AsOf, req.IncludeDeleted)
+		}
+	}
+	res, err := find(table, req.Where)
 	if err != nil {
 		if query_error, ok := err.(*query.QueryError); ok {
 			return NewErrorResponse(query_error.Status(), query_error.Error())
@@ -141,15 +169,22 @@ func FindReqHandler(schema *builder.Schema, raw []byte) Response {
 }
 
 type FindManyRequest struct {
-	Table   string                   `json:"table"`
-	Where   query.QueryArg           `json:"where"`
-	OrderBy map[string]query.OrderBy `json:"orderBy"`
-	Take    int                      `json:"take"`
-	Skip    int                      `json:"skip"`
-	Cursor  map[string]any           `json:"cursor"`
+	Table   string            `json:"table"`
+	Where   query.QueryArg    `json:"where"`
+	OrderBy query.OrderByList `json:"orderBy"`
+	Take    int               `json:"take"`
+	Skip    int               `json:"skip"`
+	// either a where-like object marking the first row
+	// or the opaque cursor returned with a previous findMany response
+	Cursor   any      `json:"cursor"`
+	Distinct []string `json:"distinct"`
+	// also find soft deleted rows
+	IncludeDeleted bool `json:"includeDeleted"`
+	// find the rows as they were at this time, in tables with the history prop
+	AsOf *time.Time `json:"asOf"`
 }
 
-func FindManyReqHandler(schema *builder.Schema, raw []byte) Response {
+func FindManyReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte) Response {
 	var req FindManyRequest
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
@@ -161,30 +196,87 @@ func FindManyReqHandler(schema *builder.Schema, raw []byte) Response {
 	}
 
 	table := schema.Tables.Get(req.Table)
-	res, err := query.FindWithArgs(table, query.FindArgs{
-		Where:   req.Where,
-		Take:    req.Take,
-		OrderBy: req.OrderBy,
-		Cursor:  req.Cursor,
-		Skip:    req.Skip,
-	}, true)
+	args := query.FindArgs{
+		Where:    req.Where,
+		Take:     req.Take,
+		OrderBy:  req.OrderBy,
+		Skip:     req.Skip,
+		Distinct: req.Distinct,
+
+		IncludeDeleted: req.IncludeDeleted,
+		AsOf:           req.AsOf,
+	}
+	switch cursor := req.Cursor.(type) {
+	case string:
+		args.After = cursor
+	case map[string]any:
+		args.Cursor = cursor
+	}
+
+	res, err := query.FindWithArgs(req_ctx, table, args, true)
 	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
-	return NewResponse(
+	response := NewResponse(
 		http.StatusOK,
 		fmt.Sprintf("Found %d rows in table %s", len(res), table.Name),
 		res,
 	)
+	if req.Take > 0 && len(res) == req.Take {
+		cursor, err := query.NewCursor(table, req.OrderBy, res[len(res)-1])
+		if err != nil {
+			return NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		response.Cursor = cursor
+	}
+	return response
+}
+
+type DistinctRequest struct {
+	Table  string         `json:"table"`
+	Where  query.QueryArg `json:"where"`
+	Fields []string       `json:"fields"`
+}
+
+func DistinctReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte) Response {
+	var req DistinctRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+
+	table := schema.Tables.Get(req.Table)
+	res, err := query.Distinct(req_ctx, table, req.Fields, req.Where)
+	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return NewResponse(
+		http.StatusOK,
+		fmt.Sprintf("Found %d distinct values in table %s", len(res), table.Name),
+		res,
+	)
 }
 
 type DeleteRequest struct {
 	Table string         `json:"table"`
 	Where query.QueryArg `json:"where"`
+	// only delete the row if it still has this version
+	IfVersion *int `json:"ifVersion"`
 }
 
-func DeleteReqHandler(schema *builder.Schema, raw []byte) Response {
+func DeleteReqHandler(schema *builder.Schema, raw []byte, actor string) Response {
 	var req DeleteRequest
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
@@ -204,7 +296,21 @@ func DeleteReqHandler(schema *builder.Schema, raw []byte) Response {
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
-	query.Delete(table, row)
+	if req.IfVersion != nil {
+		if err := query.CheckVersion(row, *req.IfVersion); err != nil {
+			query_error := err.(*query.QueryError)
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+	}
+
+	row, err = query.Delete(table, row, actor)
+	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
 	schema.UpdateLastChange()
 	return NewResponse(
 		http.StatusOK,
@@ -213,7 +319,7 @@ func DeleteReqHandler(schema *builder.Schema, raw []byte) Response {
 	)
 }
 
-func DeleteManyReqHandler(schema *builder.Schema, raw []byte) Response {
+func DeleteManyReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte, actor string) Response {
 	var req DeleteRequest
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
@@ -225,13 +331,20 @@ func DeleteManyReqHandler(schema *builder.Schema, raw []byte) Response {
 	}
 
 	table := schema.Tables.Get(req.Table)
-	rows, err := query.Find(table, req.Where, false)
+	rows, err := query.Find(req_ctx, table, req.Where, false)
 	if err != nil {
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
-	for _, row := range rows {
-		query.Delete(table, row)
+	for i, row := range rows {
+		res, err := query.Delete(table, row, actor)
+		if err != nil {
+			if query_error, ok := err.(*query.QueryError); ok {
+				return NewErrorResponse(query_error.Status(), query_error.Error())
+			}
+			return NewErrorResponse(http.StatusBadRequest, err.Error())
+		}
+		rows[i] = res
 	}
 
 	schema.UpdateLastChange()
@@ -242,13 +355,84 @@ func DeleteManyReqHandler(schema *builder.Schema, raw []byte) Response {
 	)
 }
 
+// RestoreReqHandler restores the soft deleted rows that match the request's where constraints
+func RestoreReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte) Response {
+	var req DeleteRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+
+	table := schema.Tables.Get(req.Table)
+	if !table.SoftDeletes() {
+		return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("Table %s does not have soft deletes", table.Name))
+	}
+
+	rows, err := query.FindDeleted(req_ctx, table, req.Where)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	restored, err := query.Restore(table, rows)
+	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	schema.UpdateLastChange()
+	return NewResponse(
+		http.StatusOK,
+		fmt.Sprintf("Restored %d rows in table %s", len(restored), table.Name),
+		restored,
+	)
+}
+
+// PurgeReqHandler deletes the soft deleted rows that match the request's where constraints for good
+func PurgeReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte) Response {
+	var req DeleteRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+
+	table := schema.Tables.Get(req.Table)
+	if !table.SoftDeletes() {
+		return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("Table %s does not have soft deletes", table.Name))
+	}
+
+	rows, err := query.FindDeleted(req_ctx, table, req.Where)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	query.Purge(table, rows)
+	schema.UpdateLastChange()
+	return NewResponse(
+		http.StatusOK,
+		fmt.Sprintf("Purged %d rows in table %s", len(rows), table.Name),
+		rows,
+	)
+}
+
 type UpdateRequest struct {
 	Table string         `json:"table"`
 	Where query.QueryArg `json:"where"`
 	Data  query.QueryArg `json:"data"`
+	// only update rows that still have this version
+	IfVersion *int `json:"ifVersion"`
 }
 
-func UpdateReqHandler(schema *builder.Schema, raw []byte) Response {
+func UpdateReqHandler(schema *builder.Schema, raw []byte, actor string) Response {
 	var req UpdateRequest
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
@@ -268,7 +452,14 @@ func UpdateReqHandler(schema *builder.Schema, raw []byte) Response {
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
-	res, err := query.Update(table, row, req.Data)
+	if req.IfVersion != nil {
+		if err := query.CheckVersion(row, *req.IfVersion); err != nil {
+			query_error := err.(*query.QueryError)
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+	}
+
+	res, err := query.Update(table, row, req.Data, actor)
 	if err != nil {
 		if query_error, ok := err.(*query.QueryError); ok {
 			return NewErrorResponse(query_error.Status(), query_error.Error())
@@ -284,8 +475,16 @@ func UpdateReqHandler(schema *builder.Schema, raw []byte) Response {
 	)
 }
 
-func UpdateManyReqHandler(schema *builder.Schema, raw []byte) Response {
-	var req UpdateRequest
+type UpdateManyRequest struct {
+	Table string         `json:"table"`
+	Where query.QueryArg `json:"where"`
+	Data  query.QueryArg `json:"data"`
+	// row id -> version each matched row must still have
+	IfVersion map[int]int `json:"ifVersion"`
+}
+
+func UpdateManyReqHandler(req_ctx context.Context, schema *builder.Schema, raw []byte, actor string) Response {
+	var req UpdateManyRequest
 	err := json.Unmarshal(raw, &req)
 	if err != nil {
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
@@ -295,14 +494,22 @@ func UpdateManyReqHandler(schema *builder.Schema, raw []byte) Response {
 		return NewErrorResponse(http.StatusNotFound, "Table not found")
 	}
 	table := schema.Tables.Get(req.Table)
-	rows, err := query.Find(table, query.QueryArg(req.Where), false)
+	rows, err := query.Find(req_ctx, table, query.QueryArg(req.Where), false)
 	if err != nil {
 		return NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
+	// every row is checked before any row is updated
+	if req.IfVersion != nil {
+		if err := query.CheckVersions(rows, req.IfVersion); err != nil {
+			query_error := err.(*query.QueryError)
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+	}
+
 	for i := 0; i < len(rows); i++ {
 		row := rows[i]
-		res, err := query.Update(table, row, query.QueryArg(req.Data))
+		res, err := query.Update(table, row, query.QueryArg(req.Data), actor)
 		if err != nil {
 			if query_error, ok := err.(*query.QueryError); ok {
 				return NewErrorResponse(query_error.Status(), query_error.Error())
@@ -320,6 +527,48 @@ func UpdateManyReqHandler(schema *builder.Schema, raw []byte) Response {
 	)
 }
 
+type UpsertRequest struct {
+	Table  string         `json:"table"`
+	Where  query.QueryArg `json:"where"`
+	Create query.QueryArg `json:"create"`
+	Update query.QueryArg `json:"update"`
+}
+
+func UpsertReqHandler(schema *builder.Schema, raw []byte, actor string) Response {
+	var req UpsertRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+
+	table := schema.Tables.Get(req.Table)
+	res, created, err := query.Upsert(table, req.Where, req.Create, req.Update, actor)
+	if err != nil {
+		if query_error, ok := err.(*query.QueryError); ok {
+			return NewErrorResponse(query_error.Status(), query_error.Error())
+		}
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	schema.UpdateLastChange()
+	if created {
+		return NewResponse(
+			http.StatusCreated,
+			fmt.Sprintf("Created new row in table %s", table.Name),
+			res,
+		)
+	}
+	return NewResponse(
+		http.StatusOK,
+		fmt.Sprintf("Updated row in table %s", table.Name),
+		res,
+	)
+}
+
 type CreateUserRequest struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
@@ -482,7 +731,336 @@ func ListDBReqHandler(tdb *builder.TobsDB) Response {
 }
 
 func DBStatReqHandler(tdb *builder.TobsDB, ctx *ConnCtx) Response {
-	return NewResponse(http.StatusOK, "Database stats", ctx.Schema)
+	if ctx.Schema == nil {
+		return NewErrorResponse(http.StatusBadRequest, "no database selected")
+	}
+	return NewResponse(http.StatusOK, "Database stats", ctx.Schema.Stats())
+}
+
+type BackupRequest struct {
+	// back up only these databases. all databases are backed up when empty
+	Databases []string `json:"databases"`
+	// file name of the archive in the backups directory of the db path
+	Name string `json:"name"`
+}
+
+type BackupResponse struct {
+	Path     string                  `json:"path"`
+	Manifest *builder.BackupManifest `json:"manifest"`
+}
+
+func BackupReqHandler(tdb *builder.TobsDB, raw []byte) Response {
+	var req BackupRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if tdb.WriteSettings.InMem {
+		return NewErrorResponse(http.StatusBadRequest, builder.ERR_BACKUP_IN_MEM.Error())
+	}
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("backup-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	if strings.ContainsAny(req.Name, `/\`) || req.Name == "." || req.Name == ".." {
+		return NewErrorResponse(http.StatusBadRequest, "invalid backup name")
+	}
+	for _, name := range req.Databases {
+		if !tdb.Data.Has(name) {
+			return NewErrorResponse(http.StatusNotFound, fmt.Sprintf("Database %s not found", name))
+		}
+	}
+
+	location := path.Join(tdb.WriteSettings.WritePath, builder.BACKUP_DIR, req.Name)
+	manifest, err := tdb.BackupToFile(location, req.Databases)
+	if err != nil {
+		return NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return NewResponse(http.StatusOK, "Created backup", BackupResponse{location, manifest})
+}
+
+// EXPORT_PART_SIZE is about how much of a table's rows an export sends in each part
+const EXPORT_PART_SIZE = 1 << 20
+
+// ExportPart is part of the rows of an exported table, sent ahead of the export's response
+type ExportPart struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// exportWriter sends the rows of an exported table to the connection in parts.
+// Parts end at a newline, so they never split a character, and are only larger than EXPORT_PART_SIZE when a row is.
+type exportWriter struct {
+	ctx  *ConnCtx
+	name string
+	buf  []byte
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < EXPORT_PART_SIZE {
+		return len(p), nil
+	}
+	if end := bytes.LastIndexByte(w.buf, '\n'); end >= 0 {
+		if err := w.send(w.buf[:end+1]); err != nil {
+			return 0, err
+		}
+		w.buf = slices.Clone(w.buf[end+1:])
+	}
+	return len(p), nil
+}
+
+// Flush sends the rest of the table's rows
+func (w *exportWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.send(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *exportWriter) send(data []byte) error {
+	return w.ctx.writePart(NewResponse(http.StatusPartialContent,
+		fmt.Sprintf("Exported rows of table %s", w.name),
+		ExportPart{w.name, string(data)}))
+}
+
+type ExportRequest struct {
+	// export only these tables. all tables are exported when empty
+	Tables []string           `json:"tables"`
+	Format query.ExportFormat `json:"format"`
+}
+
+func ExportReqHandler(ctx *ConnCtx, raw []byte) Response {
+	var req ExportRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if ctx.Schema == nil {
+		return NewErrorResponse(http.StatusBadRequest, "no database selected")
+	}
+	if req.Format == "" {
+		req.Format = query.ExportFormatNDJSON
+	}
+	if !req.Format.IsValid() {
+		return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("Invalid export format %s", req.Format))
+	}
+	if len(req.Tables) == 0 {
+		req.Tables = ctx.Schema.Tables.Sorted
+	}
+	for _, name := range req.Tables {
+		if !ctx.Schema.Tables.Has(name) {
+			return NewErrorResponse(http.StatusNotFound, fmt.Sprintf("Table %s not found", name))
+		}
+	}
+
+	// rows are sent in parts ahead of the response, which holds each table's row count and counters
+	res := []query.ExportedTable{}
+	for _, name := range query.ImportOrder(ctx.Schema, req.Tables) {
+		table := ctx.Schema.Tables.Get(name)
+		w := &exportWriter{ctx: ctx, name: name}
+		count, err := query.ExportTable(ctx.Context(), table, w, req.Format)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		res = append(res, query.ExportedTable{Name: name, Rows: count, Counters: query.ExportCounters(table)})
+	}
+	return NewResponse(http.StatusOK, fmt.Sprintf("Exported %d tables", len(res)), res)
+}
+
+type ImportRequest struct {
+	Format query.ExportFormat    `json:"format"`
+	Tables []query.ExportedTable `json:"tables"`
+}
+
+func ImportReqHandler(ctx *ConnCtx, raw []byte) Response {
+	var req ImportRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if ctx.Schema == nil {
+		return NewErrorResponse(http.StatusBadRequest, "no database selected")
+	}
+	if req.Format == "" {
+		req.Format = query.ExportFormatNDJSON
+	}
+	if !req.Format.IsValid() {
+		return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("Invalid export format %s", req.Format))
+	}
+
+	tables := map[string]query.ExportedTable{}
+	names := []string{}
+	for _, t := range req.Tables {
+		if !ctx.Schema.Tables.Has(t.Name) {
+			return NewErrorResponse(http.StatusNotFound, fmt.Sprintf("Table %s not found", t.Name))
+		}
+		tables[t.Name] = t
+		names = append(names, t.Name)
+	}
+
+	res := []query.ExportedTable{}
+	for _, name := range query.ImportOrder(ctx.Schema, names) {
+		table := ctx.Schema.Tables.Get(name)
+		rows, err := query.DecodeRows(table, strings.NewReader(tables[name].Data), req.Format)
+		if err != nil {
+			return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		counters := tables[name].Counters
+		count, err := query.Import(table, rows, &counters)
+		if err != nil {
+			status := http.StatusBadRequest
+			if query_error, ok := err.(*query.QueryError); ok {
+				status = query_error.Status()
+			}
+			return NewErrorResponse(status, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		// tables imported before a failing one are kept
+		ctx.Schema.UpdateLastChange()
+		res = append(res, query.ExportedTable{Name: name, Rows: count, Counters: query.ExportCounters(table)})
+	}
+	return NewResponse(http.StatusOK, fmt.Sprintf("Imported %d tables", len(res)), res)
+}
+
+type CompactRequest struct {
+	// compact only this table. all tables are compacted when empty
+	Table string `json:"table"`
+}
+
+func CompactReqHandler(ctx *ConnCtx, raw []byte) Response {
+	var req CompactRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if ctx.Schema == nil {
+		return NewErrorResponse(http.StatusBadRequest, "no database selected")
+	}
+
+	if req.Table == "" {
+		stats, err := ctx.Schema.Compact(false)
+		if err != nil {
+			return NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		return NewResponse(http.StatusOK, fmt.Sprintf("Compacted database %s", ctx.Schema.Name), stats)
+	}
+
+	if !ctx.Schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+	stats, err := ctx.Schema.Tables.Get(req.Table).Compact()
+	if err != nil {
+		return NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return NewResponse(http.StatusOK, fmt.Sprintf("Compacted table %s", req.Table),
+		[]*builder.CompactStats{stats})
+}
+
+type SubscribeRequest struct {
+	Table string         `json:"table"`
+	Where query.QueryArg `json:"where"`
+	// resume after this change of a previous subscription's stream
+	After  *uint64 `json:"after"`
+	Stream string  `json:"stream"`
+}
+
+type Subscription struct {
+	Id     int    `json:"id"`
+	Stream string `json:"stream"`
+	// the last change before the subscription's first change
+	Seq uint64 `json:"seq"`
+}
+
+// SubscribeReqHandler pushes the changes to rows of a table that match where to the connection,
+// until the connection is closed or the subscription is ended with an unsubscribe request.
+// Changes are sent as responses with the subscription's id and the Change as data.
+func SubscribeReqHandler(ctx *ConnCtx, raw []byte) Response {
+	var req SubscribeRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !ctx.Schema.Tables.Has(req.Table) {
+		return NewErrorResponse(http.StatusNotFound, "Table not found")
+	}
+
+	table := ctx.Schema.Tables.Get(req.Table)
+	feed := ctx.Schema.Changes()
+	sub, err := feed.Subscribe(req.Stream, req.After)
+	if err != nil {
+		return NewErrorResponse(http.StatusGone, err.Error())
+	}
+	if ctx.subscriptions == nil {
+		ctx.subscriptions = pkg.Map[int, *builder.ChangeSubscription]{}
+	}
+	ctx.last_subscription++
+	id := ctx.last_subscription
+	ctx.subscriptions.Set(id, sub)
+
+	go func() {
+		stop := context.AfterFunc(ctx.Context(), sub.Close)
+		defer stop()
+		defer sub.Close()
+
+		last := sub.After()
+		for change := range sub.Changes() {
+			last = change.Seq
+			if change.Table != table.Name {
+				continue
+			}
+			if !(change.Before != nil && query.Matches(table, change.Before, req.Where)) &&
+				!(change.After != nil && query.Matches(table, change.After, req.Where)) {
+				continue
+			}
+			res := NewResponse(http.StatusOK, fmt.Sprintf("Change in table %s", table.Name), change)
+			res.Subscription = id
+			if _, err := ctx.WriteResponse(res); err != nil {
+				return
+			}
+		}
+
+		if sub.Overflowed() {
+			res := NewErrorResponse(http.StatusGone,
+				fmt.Sprintf("Subscription %d fell behind and was closed after change %d", id, last))
+			res.Subscription = id
+			ctx.WriteResponse(res)
+		}
+	}()
+
+	return NewResponse(
+		http.StatusOK,
+		fmt.Sprintf("Subscribed to table %s", table.Name),
+		Subscription{Id: id, Stream: feed.Stream(), Seq: sub.After()},
+	)
+}
+
+type UnsubscribeRequest struct {
+	Id int `json:"id"`
+}
+
+func UnsubscribeReqHandler(ctx *ConnCtx, raw []byte) Response {
+	var req UnsubscribeRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil {
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	if !ctx.subscriptions.Has(req.Id) {
+		return NewErrorResponse(http.StatusNotFound, "Subscription not found")
+	}
+
+	ctx.subscriptions.Get(req.Id).Close()
+	ctx.subscriptions.Delete(req.Id)
+	return NewResponse(http.StatusOK, fmt.Sprintf("Unsubscribed from subscription %d", req.Id), nil)
 }
 
 func StartTransactionReqHandler(ctx *ConnCtx) Response {
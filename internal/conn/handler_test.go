@@ -1,13 +1,19 @@
 package conn_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/tobsdb/tobsdb/internal/auth"
 	"github.com/tobsdb/tobsdb/internal/builder"
 	. "github.com/tobsdb/tobsdb/internal/conn"
+	"github.com/tobsdb/tobsdb/internal/query"
 	"github.com/tobsdb/tobsdb/pkg"
 	"gotest.tools/assert"
 )
@@ -63,7 +69,57 @@ func TestCreateReqHandler(t *testing.T) {
 	})
 }
 
-func TestCreateManyReqHandler(t *testing.T) {}
+func TestCreateManyReqHandler(t *testing.T) {
+	createMany := func(skip_duplicates bool, values ...int) []byte {
+		data := []map[string]any{}
+		for _, v := range values {
+			data = append(data, map[string]any{"b": v})
+		}
+		v, _ := json.Marshal(map[string]any{"table": "a", "data": data, "skipDuplicates": skip_duplicates})
+		return v
+	}
+
+	t.Run("simple create many", func(t *testing.T) {
+		schema := newTestSchema()
+		res := CreateManyReqHandler(schema, createMany(false, 1, 2, 3))
+
+		assert.Equal(t, res.Status, http.StatusCreated, res.Message)
+		assert.Equal(t, res.Message, "Created 3 new rows in table a")
+		result := res.Data.(CreateManyResult)
+		assert.Equal(t, len(result.Created), 3)
+		assert.DeepEqual(t, result.Skipped, []int{})
+		assert.Equal(t, schema.Tables.Get("a").Rows().Len(), 3)
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		schema := newPopulatedTestSchema(3)
+		res := CreateManyReqHandler(schema, createMany(false, 4, 5, 2, 6))
+
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.ErrorContains(t, fmt.Errorf(res.Message), "row 2")
+		assert.Equal(t, schema.Tables.Get("a").Rows().Len(), 3)
+		assert.Assert(t, !schema.Tables.Get("a").IndexMap("b").Has(4))
+	})
+
+	t.Run("duplicates in request", func(t *testing.T) {
+		schema := newTestSchema()
+		res := CreateManyReqHandler(schema, createMany(false, 1, 2, 1))
+
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.Equal(t, schema.Tables.Get("a").Rows().Len(), 0)
+	})
+
+	t.Run("skip duplicates", func(t *testing.T) {
+		schema := newPopulatedTestSchema(3)
+		res := CreateManyReqHandler(schema, createMany(true, 4, 2, 5, 4))
+
+		assert.Equal(t, res.Status, http.StatusCreated, res.Message)
+		result := res.Data.(CreateManyResult)
+		assert.Equal(t, len(result.Created), 2)
+		assert.DeepEqual(t, result.Skipped, []int{1, 3})
+		assert.Equal(t, schema.Tables.Get("a").Rows().Len(), 5)
+	})
+}
 
 func TestFindReqHandler(t *testing.T) {
 	schema := newPopulatedTestSchema(10)
@@ -97,14 +153,36 @@ func TestFindReqHandler(t *testing.T) {
 	})
 }
 
-func TestFindManyReqHandler(t *testing.T) {}
+func TestFindManyReqHandler(t *testing.T) {
+	schema := newPopulatedTestSchema(10)
+
+	t.Run("paginate with cursor", func(t *testing.T) {
+		res := FindManyReqHandler(context.Background(), schema, []byte(`{"table": "a", "take": 4}`))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Assert(t, res.Cursor != "")
+
+		seen := len(res.Data.([]builder.TDBTableRow))
+		for res.Cursor != "" {
+			raw, _ := json.Marshal(map[string]any{"table": "a", "take": 4, "cursor": res.Cursor})
+			res = FindManyReqHandler(context.Background(), schema, raw)
+			assert.Equal(t, res.Status, http.StatusOK, res.Message)
+			seen += len(res.Data.([]builder.TDBTableRow))
+		}
+		assert.Equal(t, seen, 10)
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		res := FindManyReqHandler(context.Background(), schema, []byte(`{"table": "a", "cursor": "abc"}`))
+		assert.Equal(t, res.Status, http.StatusBadRequest, res.Message)
+	})
+}
 
 func TestUpdateReqHandler(t *testing.T) {
 	schema := newPopulatedTestSchema(10)
 
 	t.Run("simple update", func(t *testing.T) {
 		res := UpdateReqHandler(schema,
-			reqEncode("a", map[string]any{"b": 15}, map[string]any{"b": 5}))
+			reqEncode("a", map[string]any{"b": 15}, map[string]any{"b": 5}), "")
 
 		assert.Equal(t, res.Status, http.StatusOK, res.Message)
 		assert.ErrorContains(t, fmt.Errorf(res.Message), "Updated row")
@@ -112,31 +190,372 @@ func TestUpdateReqHandler(t *testing.T) {
 
 	t.Run("duplicate update", func(t *testing.T) {
 		res := UpdateReqHandler(schema,
-			reqEncode("a", map[string]any{"b": 7}, map[string]any{"b": 6}))
+			reqEncode("a", map[string]any{"b": 7}, map[string]any{"b": 6}), "")
 
 		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
 		assert.ErrorContains(t, fmt.Errorf(res.Message), "already exists")
 	})
+
+	t.Run("if version", func(t *testing.T) {
+		update := func(where, b, version int) Response {
+			raw, _ := json.Marshal(map[string]any{
+				"table": "a", "where": map[string]any{"b": where}, "data": map[string]any{"b": b}, "ifVersion": version,
+			})
+			return UpdateReqHandler(schema, raw, "")
+		}
+
+		res := update(1, 100, 1)
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Data.(builder.TDBTableRow).Get(builder.SYS_VERSION), 2)
+
+		// another client read version 1 before the update
+		res = update(100, 101, 1)
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.ErrorContains(t, fmt.Errorf(res.Message), "version is 2, expected 1")
+	})
 }
 
-func TestUpdateManyReqHandler(t *testing.T) {}
+func TestUpdateManyReqHandler(t *testing.T) {
+	schema := newPopulatedTestSchema(10)
+
+	t.Run("if version", func(t *testing.T) {
+		UpdateReqHandler(schema, reqEncode("a", map[string]any{"b": 20}, map[string]any{"b": 2}), "")
+		updateMany := func(versions map[string]any) Response {
+			raw, _ := json.Marshal(map[string]any{
+				"table": "a", "where": map[string]any{"b": map[string]any{"lt": 4}}, "data": map[string]any{"b": map[string]any{"increment": 100}}, "ifVersion": versions,
+			})
+			return UpdateManyReqHandler(context.Background(), schema, raw, "")
+		}
+
+		// row 2 no longer matches where since it was read
+		res := updateMany(map[string]any{"1": 1, "2": 1, "3": 1})
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.Equal(t, res.Message, "Row 2 changed: it no longer matches where")
+
+		res = updateMany(map[string]any{"1": 1})
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.Equal(t, res.Message, "Row 3 changed: it matches where but has no version in ifVersion")
+
+		res = updateMany(map[string]any{"1": 1, "3": 2})
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+		assert.Equal(t, res.Message, "Row 3 changed: version is 1, expected 2")
+		// no row is updated
+		res = FindReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 1}))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+
+		res = updateMany(map[string]any{"1": 1, "3": 1})
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, len(res.Data.([]builder.TDBTableRow)), 2)
+	})
+}
+
+func TestUpsertReqHandler(t *testing.T) {
+	schema := newPopulatedTestSchema(10)
+	upsert := func(b int) []byte {
+		v, _ := json.Marshal(map[string]any{
+			"table":  "a",
+			"where":  map[string]any{"b": b},
+			"create": map[string]any{"b": b},
+			"update": map[string]any{"b": b + 100},
+		})
+		return v
+	}
+
+	t.Run("update existing", func(t *testing.T) {
+		res := UpsertReqHandler(schema, upsert(5), "")
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Data.(pkg.Map[string, any])["b"], 105)
+	})
+
+	t.Run("create missing", func(t *testing.T) {
+		res := UpsertReqHandler(schema, upsert(5), "")
+		assert.Equal(t, res.Status, http.StatusCreated, res.Message)
+		assert.Equal(t, res.Data.(pkg.Map[string, any])["b"], 5)
+	})
+}
 
 func TestDeleteReqHandler(t *testing.T) {
 	schema := newPopulatedTestSchema(10)
 
 	t.Run("simple delete", func(t *testing.T) {
-		res := DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 5}))
+		res := DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 5}), "")
 
 		assert.Equal(t, res.Status, http.StatusOK, res.Message)
 		assert.ErrorContains(t, fmt.Errorf(res.Message), "Deleted row")
 	})
 
 	t.Run("not found", func(t *testing.T) {
-		res := DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 100}))
+		res := DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 100}), "")
 
 		assert.Equal(t, res.Status, http.StatusNotFound, res.Message)
 		assert.ErrorContains(t, fmt.Errorf(res.Message), "No row found")
 	})
+
+	t.Run("if version", func(t *testing.T) {
+		raw, _ := json.Marshal(map[string]any{"table": "a", "where": map[string]any{"b": 6}, "ifVersion": 2})
+		res := DeleteReqHandler(schema, raw, "")
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+
+		raw, _ = json.Marshal(map[string]any{"table": "a", "where": map[string]any{"b": 6}, "ifVersion": 1})
+		res = DeleteReqHandler(schema, raw, "")
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+	})
 }
 
 func TestDeleteManyReqHandler(t *testing.T) {}
+
+func TestRestoreReqHandler(t *testing.T) {
+	newSoftDeleteSchema := func() *builder.Schema {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a softDelete(true) {
+    b Int unique(true)
+}`, nil, false)
+		for i := 1; i <= 3; i++ {
+			CreateReqHandler(schema, reqEncode("a", map[string]any{"b": i}, nil))
+		}
+		return schema
+	}
+	ctx := context.Background()
+
+	t.Run("restore", func(t *testing.T) {
+		schema := newSoftDeleteSchema()
+		res := DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 2}), "")
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Assert(t, builder.IsDeleted(res.Data.(builder.TDBTableRow)))
+
+		res = FindReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 2}))
+		assert.Equal(t, res.Status, http.StatusNotFound, res.Message)
+		raw, _ := json.Marshal(map[string]any{"table": "a", "where": map[string]any{"b": 2}, "includeDeleted": true})
+		res = FindReqHandler(schema, raw)
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+
+		res = RestoreReqHandler(ctx, schema, reqEncode("a", nil, nil))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Message, "Restored 1 rows in table a")
+		res = FindReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 2}))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		schema := newSoftDeleteSchema()
+		DeleteReqHandler(schema, reqEncode("a", nil, map[string]any{"b": 2}), "")
+		res := CreateReqHandler(schema, reqEncode("a", map[string]any{"b": 2}, nil))
+		assert.Equal(t, res.Status, http.StatusCreated, res.Message)
+
+		res = RestoreReqHandler(ctx, schema, reqEncode("a", nil, map[string]any{"b": 2}))
+		assert.Equal(t, res.Status, http.StatusConflict, res.Message)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		schema := newSoftDeleteSchema()
+		DeleteManyReqHandler(ctx, schema, reqEncode("a", nil, map[string]any{"b": 1}), "")
+		DeleteManyReqHandler(ctx, schema, reqEncode("a", nil, map[string]any{"b": 3}), "")
+
+		res := PurgeReqHandler(ctx, schema, reqEncode("a", nil, map[string]any{"b": 3}))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Message, "Purged 1 rows in table a")
+		assert.Equal(t, schema.Tables.Get("a").Rows().Len(), 2)
+
+		res = RestoreReqHandler(ctx, schema, reqEncode("a", nil, map[string]any{"b": 3}))
+		assert.Equal(t, res.Message, "Restored 0 rows in table a")
+	})
+
+	t.Run("table without soft deletes", func(t *testing.T) {
+		res := PurgeReqHandler(ctx, newTestSchema(), reqEncode("a", nil, nil))
+		assert.Equal(t, res.Status, http.StatusBadRequest, res.Message)
+		assert.Equal(t, res.Message, "Table a does not have soft deletes")
+	})
+}
+
+func TestHistoryReqHandlers(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a history(true) {
+    b Int unique(true)
+    c String
+}`, nil, false)
+	u := auth.NewUser("test", "test")
+	schema.AddUser(u, auth.TdbUserRoleReadWrite)
+	conn_ctx := &ConnCtx{User: u, Schema: schema}
+	asOf := func(where map[string]any, at time.Time) []byte {
+		v, _ := json.Marshal(map[string]any{"table": "a", "where": where, "asOf": at})
+		return v
+	}
+
+	res := ActionHandler(nil, RequestActionCreate, conn_ctx, reqEncode("a", map[string]any{"b": 1, "c": "x"}, nil))
+	assert.Equal(t, res.Status, http.StatusCreated, res.Message)
+	time.Sleep(time.Millisecond)
+	created := time.Now()
+	time.Sleep(time.Millisecond)
+	res = ActionHandler(nil, RequestActionUpdate, conn_ctx, reqEncode("a", map[string]any{"c": "y"}, map[string]any{"b": 1}))
+	assert.Equal(t, res.Status, http.StatusOK, res.Message)
+
+	t.Run("asOf", func(t *testing.T) {
+		res := FindReqHandler(schema, asOf(map[string]any{"b": 1}, created))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Data.(builder.TDBTableRow).Get("c"), "x")
+
+		res = FindManyReqHandler(context.Background(), schema, asOf(nil, time.Now()))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		assert.Equal(t, res.Data.([]builder.TDBTableRow)[0].Get("c"), "y")
+	})
+
+	t.Run("actor", func(t *testing.T) {
+		entries := schema.Tables.Get("a__history").Rows()
+		assert.Equal(t, entries.Len(), 1)
+		entry, _ := entries.Get(1)
+		assert.Equal(t, entry.Get(builder.HISTORY_FIELD_ACTOR), u.Id)
+	})
+
+	t.Run("history table is read only", func(t *testing.T) {
+		res := ActionHandler(nil, RequestActionDeleteMany, conn_ctx, reqEncode("a__history", nil, nil))
+		assert.Equal(t, res.Status, http.StatusForbidden, res.Message)
+		assert.Equal(t, schema.Tables.Get("a__history").Rows().Len(), 1)
+
+		res = ActionHandler(nil, RequestActionFindMany, conn_ctx, reqEncode("a__history", nil, nil))
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+	})
+
+	t.Run("table without history", func(t *testing.T) {
+		res := FindManyReqHandler(context.Background(), newTestSchema(), asOf(nil, created))
+		assert.Equal(t, res.Status, http.StatusBadRequest, res.Message)
+		assert.Equal(t, res.Message, "Table a does not keep history")
+	})
+}
+
+func TestSubscribeReqHandler(t *testing.T) {
+	schema := newTestSchema()
+	u := auth.NewUser("test", "test")
+	schema.AddUser(u, auth.TdbUserRoleReadWrite)
+	server, client := net.Pipe()
+	defer client.Close()
+	conn_ctx := NewConnCtx(context.Background(), server)
+	conn_ctx.User = u
+	conn_ctx.Schema = schema
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readChange := func(t *testing.T) (Response, builder.Change) {
+		buf, err := pkg.ConnReadBytes(client)
+		assert.NilError(t, err)
+		var res struct {
+			Response
+			Data builder.Change `json:"data"`
+		}
+		assert.NilError(t, json.Unmarshal(buf, &res))
+		return res.Response, res.Data
+	}
+	subscribe := func(req map[string]any) Response {
+		raw, _ := json.Marshal(req)
+		return ActionHandler(nil, RequestActionSubscribe, conn_ctx, raw)
+	}
+	write := func(action RequestAction, data, where map[string]any) {
+		res := ActionHandler(nil, action, conn_ctx, reqEncode("a", data, where))
+		assert.Assert(t, !res.IsError(), res.Message)
+	}
+
+	res := subscribe(map[string]any{"table": "a", "where": map[string]any{"b": 2}})
+	assert.Equal(t, res.Status, http.StatusOK, res.Message)
+	sub := res.Data.(Subscription)
+	assert.Equal(t, sub.Id, 1)
+
+	write(RequestActionCreate, map[string]any{"b": 1}, nil)
+	write(RequestActionCreate, map[string]any{"b": 2}, nil)
+	write(RequestActionUpdate, map[string]any{"b": 3}, map[string]any{"b": 2})
+	write(RequestActionDelete, nil, map[string]any{"b": 3})
+
+	t.Run("changes", func(t *testing.T) {
+		res, change := readChange(t)
+		assert.Equal(t, res.Subscription, sub.Id)
+		assert.Equal(t, change.Operation, builder.ChangeOperationCreate)
+		assert.Equal(t, change.Seq, sub.Seq+2)
+		assert.Equal(t, change.After.Get("b"), float64(2))
+
+		// the row no longer matches but it did before the update
+		_, change = readChange(t)
+		assert.Equal(t, change.Operation, builder.ChangeOperationUpdate)
+		assert.Equal(t, change.Before.Get("b"), float64(2))
+		assert.Equal(t, change.After.Get("b"), float64(3))
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		raw, _ := json.Marshal(map[string]any{"id": sub.Id})
+		res := ActionHandler(nil, RequestActionUnsubscribe, conn_ctx, raw)
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		res = ActionHandler(nil, RequestActionUnsubscribe, conn_ctx, raw)
+		assert.Equal(t, res.Status, http.StatusNotFound, res.Message)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		res := subscribe(map[string]any{"table": "a", "stream": sub.Stream, "after": sub.Seq + 2})
+		assert.Equal(t, res.Status, http.StatusOK, res.Message)
+		resumed := res.Data.(Subscription)
+		assert.Equal(t, resumed.Id, 2)
+		assert.Equal(t, resumed.Seq, sub.Seq+2)
+
+		res, change := readChange(t)
+		assert.Equal(t, res.Subscription, resumed.Id)
+		assert.Equal(t, change.Operation, builder.ChangeOperationUpdate)
+		_, change = readChange(t)
+		assert.Equal(t, change.Operation, builder.ChangeOperationDelete)
+		assert.Assert(t, change.After == nil)
+	})
+
+	t.Run("unknown stream", func(t *testing.T) {
+		res := subscribe(map[string]any{"table": "a", "stream": "x", "after": 1})
+		assert.Equal(t, res.Status, http.StatusGone, res.Message)
+	})
+}
+
+func TestExportReqHandler(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString("$TABLE a {\n b String\n}", nil, false)
+	for i := range 30 {
+		CreateReqHandler(schema, reqEncode("a", map[string]any{"b": fmt.Sprintf("%d%s", i, strings.Repeat("é", 50_000))}, nil))
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn_ctx := NewConnCtx(context.Background(), server)
+	conn_ctx.Schema = schema
+
+	go func() {
+		res := ExportReqHandler(conn_ctx, []byte(`{"tables": ["a"]}`))
+		conn_ctx.WriteResponse(res)
+	}()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var data strings.Builder
+	parts := 0
+	for {
+		buf, err := pkg.ConnReadBytes(client)
+		assert.NilError(t, err)
+		var res struct {
+			Response
+			Data json.RawMessage `json:"data"`
+		}
+		assert.NilError(t, json.Unmarshal(buf, &res))
+		if res.Status != http.StatusPartialContent {
+			assert.Equal(t, res.Status, http.StatusOK, res.Message)
+			var tables []query.ExportedTable
+			assert.NilError(t, json.Unmarshal(res.Data, &tables))
+			assert.Equal(t, len(tables), 1)
+			assert.Equal(t, tables[0].Rows, 30)
+			assert.Equal(t, tables[0].Data, "")
+			break
+		}
+
+		var part ExportPart
+		assert.NilError(t, json.Unmarshal(res.Data, &part))
+		assert.Equal(t, part.Name, "a")
+		// parts end with a row
+		assert.Assert(t, strings.HasSuffix(part.Data, "\n"))
+		data.WriteString(part.Data)
+		parts++
+	}
+	assert.Assert(t, parts > 1)
+
+	dst, _ := builder.NewSchemaFromString("$TABLE a {\n b String\n}", nil, false)
+	rows, err := query.DecodeRows(dst.Tables.Get("a"), strings.NewReader(data.String()), query.ExportFormatNDJSON)
+	assert.NilError(t, err)
+	count, err := query.Import(dst.Tables.Get("a"), rows, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 30)
+	assert.Equal(t, dst.Tables.Get("a").Row(30).Get("b"), schema.Tables.Get("a").Row(30).Get("b"))
+}
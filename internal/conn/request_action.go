@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -17,10 +18,18 @@ const (
 	RequestActionCreateMany RequestAction = "createMany"
 	RequestActionFind       RequestAction = "findUnique"
 	RequestActionFindMany   RequestAction = "findMany"
+	RequestActionDistinct   RequestAction = "distinct"
 	RequestActionDelete     RequestAction = "deleteUnique"
 	RequestActionDeleteMany RequestAction = "deleteMany"
 	RequestActionUpdate     RequestAction = "updateUnique"
 	RequestActionUpdateMany RequestAction = "updateMany"
+	RequestActionUpsert     RequestAction = "upsert"
+	RequestActionRestore    RequestAction = "restore"
+	RequestActionPurge      RequestAction = "purge"
+
+	// subscription actions
+	RequestActionSubscribe   RequestAction = "subscribe"
+	RequestActionUnsubscribe RequestAction = "unsubscribe"
 
 	// database actions
 	RequestActionCreateDB RequestAction = "createDatabase"
@@ -28,6 +37,10 @@ const (
 	RequestActionDropDB   RequestAction = "dropDatabase"
 	RequestActionListDB   RequestAction = "listDatabases"
 	RequestActionDBStat   RequestAction = "databaseStats"
+	RequestActionCompact  RequestAction = "compact"
+	RequestActionBackup   RequestAction = "backup"
+	RequestActionExport   RequestAction = "export"
+	RequestActionImport   RequestAction = "import"
 
 	// table actions
 	RequestActionDropTable RequestAction = "dropTable"
@@ -45,8 +58,20 @@ const (
 )
 
 func (action RequestAction) IsReadOnly() bool {
-	return action == RequestActionFind || action == RequestActionFindMany ||
-		action == RequestActionDBStat || action == RequestActionListDB || action == RequestActionUseDB
+	return action == RequestActionFind || action == RequestActionFindMany || action == RequestActionDistinct ||
+		action == RequestActionDBStat || action == RequestActionListDB || action == RequestActionUseDB ||
+		action == RequestActionSubscribe || action == RequestActionUnsubscribe
+}
+
+// WritesRows reports whether the action writes the rows of the table named in its request
+func (action RequestAction) WritesRows() bool {
+	switch action {
+	default:
+		return false
+	case RequestActionCreate, RequestActionCreateMany, RequestActionDelete, RequestActionDeleteMany,
+		RequestActionUpdate, RequestActionUpdateMany, RequestActionUpsert, RequestActionRestore, RequestActionPurge:
+		return true
+	}
 }
 
 func (action RequestAction) IsDBAction() bool {
@@ -55,11 +80,18 @@ func (action RequestAction) IsDBAction() bool {
 		return false
 	case RequestActionCreateDB, RequestActionDropDB, RequestActionListDB,
 		RequestActionDBStat, RequestActionDropTable, RequestActionCreateUser, RequestActionDeleteUser,
-		RequestActionUpdateUserRole:
+		RequestActionUpdateUserRole, RequestActionCompact, RequestActionBackup,
+		RequestActionExport, RequestActionImport:
 		return true
 	}
 }
 
+// LocksSchemas reports whether the action locks the schemas it reads itself,
+// instead of holding the lock of the schema in use for the whole request.
+func (action RequestAction) LocksSchemas() bool {
+	return action == RequestActionBackup
+}
+
 func ActionHandler(tdb *builder.TobsDB, action RequestAction, ctx *ConnCtx, raw []byte) Response {
 	if action.IsReadOnly() {
 		if !ctx.Schema.UserHasClearance(ctx.User, auth.TdbUserRoleReadOnly) {
@@ -73,7 +105,7 @@ func ActionHandler(tdb *builder.TobsDB, action RequestAction, ctx *ConnCtx, raw
 		if !ctx.Schema.UserHasClearance(ctx.User, auth.TdbUserRoleReadWrite) {
 			return NewErrorResponse(http.StatusForbidden, auth.InsufficientPermissions.Error())
 		}
-		if ctx.Schema != nil {
+		if ctx.Schema != nil && !action.LocksSchemas() {
 			ctx.Schema.GetLocker().Lock()
 			defer ctx.Schema.GetLocker().Unlock()
 		}
@@ -99,6 +131,10 @@ func ActionHandler(tdb *builder.TobsDB, action RequestAction, ctx *ConnCtx, raw
         }
     }
 
+    if action.WritesRows() && writesHistoryTable(ctx.TxCtx.Schema, raw) {
+        return NewErrorResponse(http.StatusForbidden, "history tables are read only")
+    }
+
     res := getActionResponse(action, tdb, ctx, raw)
     if !res.IsError() && !ctx.TxCtx.Persisted {
         err := ctx.TxCtx.Commit(ctx.Schema)
@@ -121,6 +157,14 @@ func getActionResponse(action RequestAction, tdb *builder.TobsDB, ctx *ConnCtx,
 		return ListDBReqHandler(tdb)
 	case RequestActionDBStat:
 		return DBStatReqHandler(tdb, ctx)
+	case RequestActionCompact:
+		return CompactReqHandler(ctx, raw)
+	case RequestActionBackup:
+		return BackupReqHandler(tdb, raw)
+	case RequestActionExport:
+		return ExportReqHandler(ctx, raw)
+	case RequestActionImport:
+		return ImportReqHandler(ctx, raw)
 	case RequestActionCreateUser:
 		return CreateUserReqHandler(tdb, raw)
 	case RequestActionDeleteUser:
@@ -134,15 +178,27 @@ func getActionResponse(action RequestAction, tdb *builder.TobsDB, ctx *ConnCtx,
 	case RequestActionFind:
 		return FindReqHandler(ctx.TxCtx.Schema, raw)
 	case RequestActionFindMany:
-		return FindManyReqHandler(ctx.TxCtx.Schema, raw)
+		return FindManyReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw)
+	case RequestActionDistinct:
+		return DistinctReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw)
 	case RequestActionDelete:
-		return DeleteReqHandler(ctx.TxCtx.Schema, raw)
+		return DeleteReqHandler(ctx.TxCtx.Schema, raw, ctx.User.Id)
 	case RequestActionDeleteMany:
-		return DeleteManyReqHandler(ctx.TxCtx.Schema, raw)
+		return DeleteManyReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw, ctx.User.Id)
 	case RequestActionUpdate:
-		return UpdateReqHandler(ctx.TxCtx.Schema, raw)
+		return UpdateReqHandler(ctx.TxCtx.Schema, raw, ctx.User.Id)
 	case RequestActionUpdateMany:
-		return UpdateManyReqHandler(ctx.TxCtx.Schema, raw)
+		return UpdateManyReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw, ctx.User.Id)
+	case RequestActionUpsert:
+		return UpsertReqHandler(ctx.TxCtx.Schema, raw, ctx.User.Id)
+	case RequestActionRestore:
+		return RestoreReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw)
+	case RequestActionPurge:
+		return PurgeReqHandler(ctx.Context(), ctx.TxCtx.Schema, raw)
+	case RequestActionSubscribe:
+		return SubscribeReqHandler(ctx, raw)
+	case RequestActionUnsubscribe:
+		return UnsubscribeReqHandler(ctx, raw)
 	case RequestActionTransaction:
 		return StartTransactionReqHandler(ctx)
 	case RequestActionCommit:
@@ -153,3 +209,15 @@ func getActionResponse(action RequestAction, tdb *builder.TobsDB, ctx *ConnCtx,
 		return NewErrorResponse(http.StatusBadRequest, fmt.Sprintf("unknown action: %s", action))
 	}
 }
+
+// writesHistoryTable reports whether a row action request targets a history table,
+// which only change with the rows of the table they keep the history of
+func writesHistoryTable(schema *builder.Schema, raw []byte) bool {
+	var req struct {
+		Table string `json:"table"`
+	}
+	if json.Unmarshal(raw, &req) != nil || !schema.Tables.Has(req.Table) {
+		return false
+	}
+	return schema.Tables.Get(req.Table).HistoryOf() != nil
+}
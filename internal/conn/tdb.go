@@ -1,15 +1,16 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/query"
 	"github.com/tobsdb/tobsdb/pkg"
 )
 
@@ -17,6 +18,10 @@ func Listen(tdb *builder.TobsDB, port int) {
 	exit := make(chan os.Signal, 2)
 	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
 
+	// canceled on shutdown to stop requests that are still running
+	server_ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+
 	listener, err := net.Listen("tcp4", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		pkg.FatalLog(err)
@@ -32,17 +37,25 @@ func Listen(tdb *builder.TobsDB, port int) {
 				pkg.ErrorLog(err)
 			}
 			pkg.InfoLog("Connection from", conn.RemoteAddr())
-			go HandleConnection(tdb, conn)
+			go HandleConnection(server_ctx, tdb, conn)
 		}
 	}()
 
+	checkpointer := builder.NewCheckpointer(tdb)
+	checkpointer.Start()
+	sweeper := builder.NewSweeper(tdb)
+	sweeper.OnExpired = query.AfterExpired
+	sweeper.Start()
+
 	pkg.InfoLog("TobsDB listening on port", port)
 	<-exit
 	pkg.DebugLog("Shutting down...")
+	shutdown()
 	if err := listener.Close(); err != nil {
 		pkg.ErrorLog("failed to close listener", err)
 	}
-	tdb.WriteToFile()
+	sweeper.Stop()
+	checkpointer.Stop()
 }
 
 func ResolveSchema(tdb *builder.TobsDB, r ConnRequest) (*builder.Schema, error) {
@@ -59,28 +72,10 @@ func ResolveSchema(tdb *builder.TobsDB, r ConnRequest) (*builder.Schema, error)
 		schema = _schema
 		schema.Name = r.DB
 		schema.Tdb = tdb
+		// written by the next checkpoint
+		schema.UpdateLastChange()
 		tdb.Data.Set(r.DB, schema)
 	}
 
-	if !tdb.WriteSettings.InMem {
-		schema.WriteTicker = time.NewTicker(tdb.WriteSettings.WriteInterval)
-		schema.LastChange = time.Now()
-
-		go func() {
-			if schema.WriteTicker == nil {
-				return
-			}
-			last_write := schema.LastChange
-			for {
-				<-schema.WriteTicker.C
-				if schema.LastChange.After(last_write) {
-					pkg.DebugLog("writing database", schema.Name)
-					schema.WriteToFile()
-					last_write = schema.LastChange
-				}
-			}
-		}()
-	}
-
 	return schema, nil
 }
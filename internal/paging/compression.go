@@ -0,0 +1,146 @@
+package paging
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// Compression is the algorithm a page's data is compressed with on disk.
+// Pages are always uncompressed in memory.
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionFlate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+func (c Compression) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "flate":
+		return CompressionFlate, nil
+	}
+	return CompressionNone, fmt.Errorf("unsupported compression %s", name)
+}
+
+var flate_writers = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// compress returns the page data as stored with c: the size of the data as a uvarint followed by the compressed data.
+// It returns false when c is CompressionNone or the data does not get smaller.
+func compress(c Compression, data []byte) ([]byte, bool) {
+	if c != CompressionFlate || len(data) == 0 {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+
+	w := flate_writers.Get().(*flate.Writer)
+	defer flate_writers.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+func decompress(id uuid.UUID, c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > MAX_PAGE_SIZE {
+			return nil, corruptPage(id, "invalid compressed size")
+		}
+		buf := make([]byte, size)
+		r := flate.NewReader(bytes.NewReader(data[n:]))
+		defer r.Close()
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, corruptPage(id, "decompress: %s", err)
+		}
+		return buf, nil
+	}
+	return nil, corruptPage(id, "%s: unsupported compression %d", ERR_INVALID_PAGE_HEADER, byte(c))
+}
+
+// SetCompression sets the algorithm the page is compressed with when it is written
+func (p *Page) SetCompression(c Compression) { p.compression = c }
+
+// PageSize is the size of a page's data in memory and on disk, excluding the header
+type PageSize struct {
+	Raw    int64
+	Stored int64
+}
+
+// StatPage reads the size of a page from its file header without loading the page
+func StatPage(base string, id uuid.UUID) (PageSize, error) {
+	f, err := os.Open(path.Join(base, id.String()))
+	if err != nil {
+		return PageSize{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return PageSize{}, err
+	}
+
+	header := make([]byte, PAGE_HEADER_SIZE+binary.MaxVarintLen64)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return PageSize{}, err
+	}
+	header = header[:n]
+
+	header_size := PAGE_HEADER_SIZE
+	switch {
+	case len(header) >= LEGACY_PAGE_HEADER_SIZE && uuid.UUID(header[0:16]) == id:
+		header_size = LEGACY_PAGE_HEADER_SIZE
+	case len(header) < PAGE_HEADER_SIZE || [4]byte(header[0:4]) != PAGE_MAGIC || header[4] != PAGE_VERSION:
+		return PageSize{}, corruptPage(id, "%s", ERR_INVALID_PAGE_HEADER)
+	}
+
+	stored := info.Size() - int64(header_size)
+	size := PageSize{stored, stored}
+	if header_size == PAGE_HEADER_SIZE && header[5]&PAGE_FLAG_ENCRYPTED != 0 {
+		size.Raw -= pkg.CIPHER_OVERHEAD
+	}
+	if header_size == PAGE_HEADER_SIZE && Compression(header[6]) != CompressionNone {
+		raw, n := binary.Uvarint(header[PAGE_HEADER_SIZE:])
+		if n <= 0 {
+			return PageSize{}, corruptPage(id, "invalid compressed size")
+		}
+		size.Raw = int64(raw)
+	}
+	return size, nil
+}
@@ -0,0 +1,77 @@
+package paging_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"gotest.tools/assert"
+)
+
+func readRecords(t *testing.T, p *paging.Page) [][]byte {
+	records := [][]byte{}
+	r := p.NewReader()
+	for r.ReadNext() {
+		records = append(records, bytes.Clone(r.Buf))
+	}
+	assert.NilError(t, r.Err)
+	return records
+}
+
+func TestPageCompression(t *testing.T) {
+	base := t.TempDir()
+	text := bytes.Repeat([]byte("compressible text "), 200)
+	large := bytes.Repeat([]byte("a large record "), 10_000)
+
+	p := paging.NewPage(uuid.Nil, uuid.Nil)
+	p.SetCompression(paging.CompressionFlate)
+	for i := 0; i < 20; i++ {
+		assert.NilError(t, p.Push(text, false))
+	}
+	assert.NilError(t, p.Push(large, false))
+	assert.NilError(t, p.WriteToFile(base, false))
+
+	size, err := paging.StatPage(base, p.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, size.Raw, int64(p.Size()))
+	assert.Assert(t, size.Stored < size.Raw/10)
+
+	loaded, err := paging.LoadPageUUID(base, p.Id, nil)
+	assert.NilError(t, err)
+	records := readRecords(t, loaded)
+	assert.Equal(t, len(records), 21)
+	assert.Assert(t, bytes.Equal(records[0], text))
+	assert.Assert(t, bytes.Equal(records[20], large))
+
+	// pages that don't get smaller are stored uncompressed
+	random := make([]byte, 1000)
+	rand.Read(random)
+	raw := paging.NewPage(uuid.Nil, uuid.Nil)
+	raw.SetCompression(paging.CompressionFlate)
+	assert.NilError(t, raw.Push(random, false))
+	assert.NilError(t, raw.WriteToFile(base, false))
+	size, err = paging.StatPage(base, raw.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, size.Raw, size.Stored)
+	loaded, err = paging.LoadPageUUID(base, raw.Id, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(readRecords(t, loaded)[0], random))
+
+	// uncompressed pages keep loading once compression is enabled
+	plain := paging.NewPage(uuid.Nil, uuid.Nil)
+	assert.NilError(t, plain.Push(text, false))
+	assert.NilError(t, plain.WriteToFile(base, false))
+	data, err := os.ReadFile(path.Join(base, plain.Id.String()))
+	assert.NilError(t, err)
+	assert.Equal(t, len(data), paging.PAGE_HEADER_SIZE+plain.Size())
+	loaded, err = paging.LoadPageUUID(base, plain.Id, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(readRecords(t, loaded)[0], text))
+
+	_, err = paging.ParseCompression("zip")
+	assert.ErrorContains(t, err, "unsupported compression")
+}
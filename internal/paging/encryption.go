@@ -0,0 +1,67 @@
+package paging
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// SetCipher sets the cipher the page is encrypted with when it is written.
+// Pages are written unencrypted when c is nil.
+func (p *Page) SetCipher(c *pkg.Cipher) { p.cipher = c }
+
+// sizePrefix returns the length of the uncompressed size that starts compressed page data
+func sizePrefix(data []byte, compression Compression) int {
+	if compression == CompressionNone {
+		return 0
+	}
+	_, n := binary.Uvarint(data)
+	return max(n, 0)
+}
+
+// encrypt seals page data as stored on disk.
+// The size prefix of compressed data stays readable so StatPage does not need the key.
+// The page id is authenticated with the data so pages cannot be swapped.
+func (p *Page) encrypt(data []byte, compression Compression) []byte {
+	prefix := sizePrefix(data, compression)
+	return append(data[:prefix:prefix], p.cipher.Seal(data[prefix:], p.Id[:])...)
+}
+
+// decrypt opens page data sealed by encrypt.
+// A page must be encrypted exactly when a cipher is given.
+func decrypt(id uuid.UUID, c *pkg.Cipher, data []byte, flags byte, compression Compression) ([]byte, error) {
+	encrypted := flags&PAGE_FLAG_ENCRYPTED != 0
+	switch {
+	case !encrypted && c == nil:
+		return data, nil
+	case !encrypted:
+		return nil, errors.Join(pkg.ERR_NOT_ENCRYPTED, errors.New("page "+id.String()))
+	case c == nil:
+		return nil, errors.Join(pkg.ERR_ENCRYPTED, errors.New("page "+id.String()))
+	}
+
+	prefix := sizePrefix(data, compression)
+	plain, err := c.Open(data[prefix:], id[:])
+	if err != nil {
+		return nil, corruptPage(id, "%s", err)
+	}
+	return append(data[:prefix:prefix], plain...), nil
+}
+
+// RekeyPage rewrites a page file encrypted with from so it is encrypted with to.
+// Either cipher may be nil for an unencrypted page.
+// It returns false when the page is already encrypted with to, such as when a rekey is resumed.
+func RekeyPage(base string, id uuid.UUID, from, to *pkg.Cipher) (bool, error) {
+	p, err := LoadPageUUID(base, id, from)
+	if err != nil {
+		if _, to_err := LoadPageUUID(base, id, to); to_err == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	p.cipher = to
+	p.modified = true
+	return true, p.WriteToFile(base, false)
+}
@@ -1,10 +1,10 @@
 package paging
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
@@ -14,8 +14,29 @@ import (
 )
 
 const (
-	MAX_PAGE_SIZE    = 1000 * 1000 * 2 // 2MB
-	PAGE_HEADER_SIZE = 48
+	MAX_PAGE_SIZE = 1000 * 1000 * 2 // 2MB
+	// largest record that can be stored, across its overflow pages
+	MAX_DATA_SIZE = 1000 * 1000 * 64 // 64MB
+	// records larger than this are written to overflow pages
+	MAX_INLINE_SIZE = 1<<16 - 1
+
+	PAGE_HEADER_SIZE = 60
+	// header size of pages written before the header was versioned
+	LEGACY_PAGE_HEADER_SIZE = 48
+
+	PAGE_VERSION = 2
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var PAGE_MAGIC = [4]byte{'T', 'D', 'B', 'P'}
+
+// page flags
+const (
+	// the page holds a chunk of a single large record instead of blocks
+	PAGE_FLAG_OVERFLOW byte = 1 << iota
+	// the page data is encrypted. it is only set on disk
+	PAGE_FLAG_ENCRYPTED
 )
 
 type Page struct {
@@ -24,61 +45,246 @@ type Page struct {
 	Prev uuid.UUID
 	Next uuid.UUID
 
-	buf []byte
+	flags byte
+	buf   []byte
+	// algorithm the page is compressed with when it is written
+	compression Compression
+	// cipher the page is encrypted with when it is written, and its overflow pages are read with
+	cipher *pkg.Cipher
 
 	modified bool
+
+	// directory the page was loaded from or written to; used to read its overflow pages
+	base string
+	// overflow pages that have not been written to base yet
+	overflow map[uuid.UUID]*Page
 }
 
 func NewPage(prev_page_id, next_page_id uuid.UUID) *Page {
-	return &Page{uuid.New(), prev_page_id, next_page_id, []byte{}, false}
+	return NewPageWithId(uuid.New(), prev_page_id, next_page_id)
 }
 
 func NewPageWithId(page_id, prev_page_id, next_page_id uuid.UUID) *Page {
-	return &Page{page_id, prev_page_id, next_page_id, []byte{}, false}
+	return &Page{Id: page_id, Prev: prev_page_id, Next: next_page_id, buf: []byte{}}
+}
+
+var (
+	ERR_INVALID_PAGE_HEADER = errors.New("invalid page headers")
+	ERR_CORRUPT_PAGE        = errors.New("corrupt page")
+	ERR_PAGE_NOT_FOUND      = errors.New("page not found")
+)
+
+// CorruptPageError reports a page file that failed verification
+type CorruptPageError struct {
+	Id     uuid.UUID
+	Reason string
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("%s %s: %s", ERR_CORRUPT_PAGE, e.Id, e.Reason)
+}
+
+func (e *CorruptPageError) Unwrap() error { return ERR_CORRUPT_PAGE }
+
+func corruptPage(id uuid.UUID, format string, args ...any) error {
+	return &CorruptPageError{id, fmt.Sprintf(format, args...)}
 }
 
-var ERR_INVALID_PAGE_HEADER = errors.New("invalid page headers")
+// checksum returns the CRC32C of a page file, skipping the bytes the checksum is stored in
+func checksum(data []byte) uint32 {
+	sum := crc32.Update(0, crc32c, data[0:8])
+	return crc32.Update(sum, crc32c, data[12:])
+}
+
+func LoadPageUUID(base string, id uuid.UUID, c *pkg.Cipher) (*Page, error) {
+	return LoadPage(base, id.String(), c)
+}
 
-func LoadPageUUID(base string, id uuid.UUID) (*Page, error) { return LoadPage(base, id.String()) }
-func LoadPage(base string, id string) (*Page, error) {
-	location := path.Join(base, id)
-	if _, err := os.Stat(location); os.IsNotExist(err) {
-		return NewPageWithId(uuid.MustParse(id), uuid.Nil, uuid.Nil), nil
+// LoadPage reads the page with id from base, decrypting it with c.
+// A page that fails verification is reported with a *CorruptPageError,
+// and a page without a file with ERR_PAGE_NOT_FOUND.
+func LoadPage(base string, id string, c *pkg.Cipher) (*Page, error) {
+	data, err := os.ReadFile(path.Join(base, id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ERR_PAGE_NOT_FOUND, id)
 	}
-	data, err := os.ReadFile(location)
 	if err != nil {
 		return nil, err
 	}
+	expected_id := uuid.MustParse(id)
+
+	if len(data) >= LEGACY_PAGE_HEADER_SIZE && uuid.UUID(data[0:16]) == expected_id {
+		if c != nil {
+			return nil, errors.Join(pkg.ERR_NOT_ENCRYPTED, errors.New("page "+id))
+		}
+		return loadLegacyPage(base, data)
+	}
+
+	if len(data) < LEGACY_PAGE_HEADER_SIZE || [4]byte(data[0:4]) != PAGE_MAGIC {
+		return nil, corruptPage(expected_id, "%s: bad magic", ERR_INVALID_PAGE_HEADER)
+	}
+	if version := data[4]; version != PAGE_VERSION {
+		return nil, corruptPage(expected_id, "%s: unsupported version %d", ERR_INVALID_PAGE_HEADER, version)
+	}
+	if len(data) < PAGE_HEADER_SIZE {
+		return nil, corruptPage(expected_id, "%s: truncated", ERR_INVALID_PAGE_HEADER)
+	}
+	if binary.BigEndian.Uint32(data[8:12]) != checksum(data) {
+		return nil, corruptPage(expected_id, "checksum mismatch")
+	}
+	links := data[PAGE_HEADER_SIZE-48 : PAGE_HEADER_SIZE]
+
+	page_id := uuid.UUID(links[0:16])
+	if page_id != expected_id {
+		return nil, corruptPage(expected_id, "page id mismatch %s", page_id)
+	}
+
+	p := NewPageWithId(page_id, uuid.UUID(links[16:32]), uuid.UUID(links[32:48]))
+	p.flags = data[5] &^ PAGE_FLAG_ENCRYPTED
+	p.compression = Compression(data[6])
+	if p.buf, err = decrypt(page_id, c, data[PAGE_HEADER_SIZE:], data[5], p.compression); err != nil {
+		return nil, err
+	}
+	if p.buf, err = decompress(page_id, p.compression, p.buf); err != nil {
+		return nil, err
+	}
+	p.base = base
+	p.cipher = c
+	return p, nil
+}
 
-	page_id, err := uuid.FromBytes(data[0:16])
+// ListPages returns the ids of the page files in base, including overflow pages
+func ListPages(base string) ([]uuid.UUID, error) {
+	entries, err := os.ReadDir(base)
 	if err != nil {
-		pkg.FatalLog(ERR_INVALID_PAGE_HEADER, "page ID", err)
+		return nil, err
+	}
+	ids := []uuid.UUID{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		id, err := uuid.Parse(e.Name())
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
 	}
+	return ids, nil
+}
 
-	prev_page_id, err := uuid.FromBytes(data[16:32])
+// PageAfter returns the id of the page file in base that follows the page with id in its chain,
+// or uuid.Nil when there is none.
+// Only page headers are read, so it can step over a page that is missing or fails verification.
+func PageAfter(base string, id uuid.UUID) (uuid.UUID, error) {
+	ids, err := ListPages(base)
 	if err != nil {
-		pkg.FatalLog(ERR_INVALID_PAGE_HEADER, "previous page ID", err)
+		return uuid.Nil, err
+	}
+	for _, next := range ids {
+		prev, ok, err := readPrevLink(path.Join(base, next.String()), next)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if ok && prev == id {
+			return next, nil
+		}
 	}
+	return uuid.Nil, nil
+}
 
-	next_page_id, err := uuid.FromBytes(data[32:48])
+// readPrevLink reads the previous page link from the header of a page file.
+// ok is false for overflow pages and files with an unreadable header.
+func readPrevLink(location string, id uuid.UUID) (prev uuid.UUID, ok bool, err error) {
+	f, err := os.Open(location)
 	if err != nil {
-		pkg.FatalLog(ERR_INVALID_PAGE_HEADER, "next page ID", err)
+		return uuid.Nil, false, err
+	}
+	defer f.Close()
+	header := make([]byte, PAGE_HEADER_SIZE)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return uuid.Nil, false, err
 	}
+	header = header[:n]
 
-	page_buf := data[PAGE_HEADER_SIZE:]
+	if len(header) >= LEGACY_PAGE_HEADER_SIZE && uuid.UUID(header[0:16]) == id {
+		return uuid.UUID(header[16:32]), true, nil
+	}
+	if len(header) < PAGE_HEADER_SIZE || [4]byte(header[0:4]) != PAGE_MAGIC || header[4] != PAGE_VERSION ||
+		header[5]&PAGE_FLAG_OVERFLOW != 0 {
+		return uuid.Nil, false, nil
+	}
+	links := header[PAGE_HEADER_SIZE-48 : PAGE_HEADER_SIZE]
+	if uuid.UUID(links[0:16]) != id {
+		return uuid.Nil, false, nil
+	}
+	return uuid.UUID(links[16:32]), true, nil
+}
 
-	if id != page_id.String() {
-		pkg.FatalLog("LoadPage", "page id mismatch", id, page_id.String())
+// QuarantinePage moves a corrupt page's file out of the way so it is no longer read, keeping it for inspection.
+// It returns the new location of the file.
+func QuarantinePage(base string, id uuid.UUID) (string, error) {
+	location := path.Join(base, id.String())
+	quarantined := location + ".corrupt"
+	err := os.Rename(location, quarantined)
+	if os.IsNotExist(err) {
+		return "", nil
 	}
+	return quarantined, err
+}
+
+// loadLegacyPage reads a page written before the header was versioned,
+// when each block was prefixed with its size as a uint16.
+// The blocks are converted to the current format and the page is marked as modified
+// so it is upgraded the next time it is written.
+func loadLegacyPage(base string, data []byte) (*Page, error) {
+	page_id, _ := uuid.FromBytes(data[0:16])
+	prev_page_id, _ := uuid.FromBytes(data[16:32])
+	next_page_id, _ := uuid.FromBytes(data[32:48])
+
+	p := NewPageWithId(page_id, prev_page_id, next_page_id)
+	p.base = base
+	p.modified = true
 
-	return &Page{page_id, prev_page_id, next_page_id, []byte(page_buf), false}, nil
+	legacy := data[LEGACY_PAGE_HEADER_SIZE:]
+	for len(legacy) > 0 {
+		if len(legacy) < 2 {
+			return nil, corruptPage(page_id, "legacy block: %s", io.ErrUnexpectedEOF)
+		}
+		size := int(binary.BigEndian.Uint16(legacy))
+		legacy = legacy[2:]
+		if len(legacy) < size {
+			return nil, corruptPage(page_id, "legacy block: %s", io.ErrUnexpectedEOF)
+		}
+		p.pushInline(legacy[:size])
+		legacy = legacy[size:]
+	}
+	return p, nil
 }
 
-// The first 48 bytes are reserved for page links.
+// The first 8 bytes of a page hold the magic number, format version, flags and the compression of the page data,
+// followed by a CRC32C checksum of the rest of the file.
+// The next 48 bytes are reserved for page links.
 // 16 for each of the current, previous, and next page ids.
 // The rest (`MAX_PAGE_SIZE`) is the page data.
 func (page *Page) WriteToFile(base string, in_mem bool) error {
-	if in_mem || !page.modified {
+	if in_mem {
+		return nil
+	}
+
+	// overflow pages are written first so the page never points to missing data
+	for id, o := range page.overflow {
+		o.compression = page.compression
+		o.cipher = page.cipher
+		if err := o.WriteToFile(base, in_mem); err != nil {
+			return err
+		}
+		delete(page.overflow, id)
+	}
+	page.base = base
+
+	if !page.modified {
 		return nil
 	}
 	page_id, err := page.Id.MarshalBinary()
@@ -100,13 +306,27 @@ func (page *Page) WriteToFile(base string, in_mem bool) error {
 
 	location := path.Join(base, page.Id.String())
 
-	buf := []byte{}
+	data, compression := page.buf, CompressionNone
+	if compressed, ok := compress(page.compression, page.buf); ok {
+		data, compression = compressed, page.compression
+	}
+	flags := page.flags
+	if page.cipher != nil {
+		data = page.encrypt(data, compression)
+		flags |= PAGE_FLAG_ENCRYPTED
+	}
+
+	buf := make([]byte, 0, PAGE_HEADER_SIZE+len(data))
+	buf = append(buf, PAGE_MAGIC[:]...)
+	buf = append(buf, PAGE_VERSION, flags, byte(compression), 0)
+	buf = append(buf, 0, 0, 0, 0)
 	buf = append(buf, page_id...)
 	buf = append(buf, prev_page_id...)
 	buf = append(buf, next_page_id...)
-	buf = append(buf, page.buf...)
+	buf = append(buf, data...)
+	binary.BigEndian.PutUint32(buf[8:12], checksum(buf))
 
-	err = os.WriteFile(location, buf, 0o644)
+	err = pkg.WriteFileAtomic(location, buf, 0o644)
 	if err != nil {
 		return err
 	}
@@ -114,70 +334,248 @@ func (page *Page) WriteToFile(base string, in_mem bool) error {
 	return nil
 }
 
+// SetNext links the page to the page after it
+func (p *Page) SetNext(id uuid.UUID) {
+	p.Next = id
+	p.modified = true
+}
+
+// SetPrev links the page to the page before it
+func (p *Page) SetPrev(id uuid.UUID) {
+	p.Prev = id
+	p.modified = true
+}
+
+// IsOverflow reports whether the page holds a chunk of a large record rather than blocks
+func (p *Page) IsOverflow() bool { return p.flags&PAGE_FLAG_OVERFLOW != 0 }
+
+// Size returns the size of the page data, excluding the header
+func (p *Page) Size() int { return len(p.buf) }
+
+// RemovePage deletes a page's file, and the overflow pages of its records, from base
+func RemovePage(base string, id uuid.UUID, c *pkg.Cipher) error {
+	p, err := LoadPageUUID(base, id, c)
+	if errors.Is(err, ERR_PAGE_NOT_FOUND) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	overflow, err := p.overflowPages()
+	if err != nil {
+		return err
+	}
+	for _, o := range append(overflow, id) {
+		err := os.Remove(path.Join(base, o.String()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 var (
 	ERR_PAGE_OVERFLOW = errors.New("page overflow")
 	ERR_MAX_DATA_SIZE = errors.New("maximum data size exceeded")
 )
 
-// data block header size
-const block_header_size = 2
+// data block kinds
+const (
+	// the record follows the block header
+	block_inline byte = iota
+	// the block holds the id of the first overflow page the record is stored in
+	block_overflow
+)
+
+// largest block header: kind and size as a uvarint
+const max_block_header_size = 1 + binary.MaxVarintLen64
 
+func (p *Page) pushInline(data []byte) {
+	p.buf = append(p.buf, block_inline)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(data)))
+	p.buf = append(p.buf, data...)
+	p.modified = true
+}
+
+// pushOverflow splits data across a chain of new overflow pages and adds a block pointing to the first one
+func (p *Page) pushOverflow(data []byte) {
+	if p.overflow == nil {
+		p.overflow = map[uuid.UUID]*Page{}
+	}
+
+	var first, prev *Page
+	for start := 0; start < len(data); start += MAX_PAGE_SIZE {
+		chunk := data[start:min(start+MAX_PAGE_SIZE, len(data))]
+		o := NewPage(p.Id, uuid.Nil)
+		o.flags = PAGE_FLAG_OVERFLOW
+		o.buf = chunk
+		o.modified = true
+		if prev == nil {
+			first = o
+		} else {
+			prev.Next = o.Id
+		}
+		p.overflow[o.Id] = o
+		prev = o
+	}
+
+	p.buf = append(p.buf, block_overflow)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(data)))
+	p.buf = append(p.buf, first.Id[:]...)
+	p.modified = true
+}
+
+// Push adds a record to the page.
+// Records larger than MAX_INLINE_SIZE are stored in overflow pages, except in memory.
 func (p *Page) Push(data []byte, in_mem bool) error {
 	buf_size := len(p.buf)
 	data_size := len(data)
 
-	if data_size > MAX_PAGE_SIZE-block_header_size {
+	if data_size > MAX_DATA_SIZE {
 		return ERR_MAX_DATA_SIZE
 	}
 
-	if !in_mem && data_size+block_header_size+buf_size > MAX_PAGE_SIZE {
-		return ERR_PAGE_OVERFLOW
+	if in_mem {
+		p.pushInline(data)
+		return nil
 	}
 
-	// prefix each data block with its size
-	header := make([]byte, block_header_size)
-	binary.BigEndian.PutUint16(header, uint16(data_size))
-	p.buf = append(p.buf, header...)
-	p.buf = append(p.buf, data...)
-	p.modified = true
+	if data_size > MAX_INLINE_SIZE {
+		if max_block_header_size+16+buf_size > MAX_PAGE_SIZE {
+			return ERR_PAGE_OVERFLOW
+		}
+		p.pushOverflow(data)
+		return nil
+	}
 
+	if data_size+max_block_header_size+buf_size > MAX_PAGE_SIZE {
+		return ERR_PAGE_OVERFLOW
+	}
+	p.pushInline(data)
 	return nil
 }
 
+// loadOverflow returns the overflow page with id
+func (p *Page) loadOverflow(id uuid.UUID) (*Page, error) {
+	if o, ok := p.overflow[id]; ok {
+		return o, nil
+	}
+	if p.base == "" {
+		return nil, fmt.Errorf("overflow page %s not found", id)
+	}
+	o, err := LoadPageUUID(p.base, id, p.cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !o.IsOverflow() {
+		return nil, corruptPage(id, "not an overflow page")
+	}
+	return o, nil
+}
+
+// readOverflow reassembles a record of size bytes from the overflow chain starting at id
+func (p *Page) readOverflow(id uuid.UUID, size int) ([]byte, error) {
+	buf := make([]byte, 0, size)
+	for id != uuid.Nil && len(buf) < size {
+		o, err := p.loadOverflow(id)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, o.buf...)
+		id = o.Next
+	}
+	if len(buf) != size {
+		return nil, corruptPage(p.Id, "overflow record: %s", io.ErrUnexpectedEOF)
+	}
+	return buf, nil
+}
+
+// overflowPages returns the ids of every overflow page referenced by the page's records
+func (p *Page) overflowPages() ([]uuid.UUID, error) {
+	ids := []uuid.UUID{}
+	r := p.NewReader()
+	for r.readBlock() {
+		for id := r.overflow; id != uuid.Nil; {
+			o, err := p.loadOverflow(id)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+			id = o.Next
+		}
+	}
+	return ids, r.Err
+}
+
 func (p *Page) NewReader() *PageReader {
-	return &PageReader{nil, p, nil}
+	return &PageReader{p: p}
 }
 
 type PageReader struct {
-	r   *bufio.Reader
 	p   *Page
+	off int
 	Buf []byte
+	// set when a record could not be read
+	Err error
+
+	// first overflow page and size of the current record, when it is not inline
+	overflow uuid.UUID
+	size     int
 }
 
-func (r *PageReader) ReadNext() bool {
-	if r.r == nil {
-		r.r = bufio.NewReader(bytes.NewReader(r.p.buf[:]))
+// readBlock reads the next block header, and the record when it is inline
+func (r *PageReader) readBlock() bool {
+	buf := r.p.buf
+	if r.Err != nil || r.off >= len(buf) {
+		return false
 	}
 
-	// decode the data block size from the header
-	header := make([]byte, block_header_size)
-	_, err := io.ReadFull(r.r, header)
-	if err != nil {
-		if err == io.ErrUnexpectedEOF {
-			pkg.FatalLog("ReadNext", err)
-		}
+	kind := buf[r.off]
+	size, n := binary.Uvarint(buf[r.off+1:])
+	if n <= 0 {
+		r.Err = corruptPage(r.p.Id, "invalid block header")
 		return false
 	}
-	size := binary.BigEndian.Uint16(header)
+	off := r.off + 1 + n
 
-	buf := make([]byte, size)
-	_, err = io.ReadFull(r.r, buf)
-	if err != nil {
-		if err == io.ErrUnexpectedEOF {
-			pkg.FatalLog("ReadNext", err)
+	switch kind {
+	case block_inline:
+		if off+int(size) > len(buf) {
+			r.Err = corruptPage(r.p.Id, "block: %s", io.ErrUnexpectedEOF)
+			return false
+		}
+		r.Buf = buf[off : off+int(size)]
+		r.overflow = uuid.Nil
+		r.off = off + int(size)
+	case block_overflow:
+		if off+16 > len(buf) {
+			r.Err = corruptPage(r.p.Id, "block: %s", io.ErrUnexpectedEOF)
+			return false
 		}
+		r.Buf = nil
+		r.overflow = uuid.UUID(buf[off : off+16])
+		r.off = off + 16
+	default:
+		r.Err = corruptPage(r.p.Id, "invalid block kind %d", kind)
 		return false
 	}
-	r.Buf = buf
+	r.size = int(size)
+	return true
+}
+
+// ReadNext reads the next record into Buf.
+// It returns false when there are no more records or a record could not be read, in which case Err is set.
+func (r *PageReader) ReadNext() bool {
+	if !r.readBlock() {
+		return false
+	}
+	if r.overflow != uuid.Nil {
+		buf, err := r.p.readOverflow(r.overflow, r.size)
+		if err != nil {
+			r.Err = err
+			return false
+		}
+		r.Buf = buf
+	}
 	return true
 }
@@ -2,7 +2,11 @@ package paging_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/google/uuid"
@@ -33,3 +37,141 @@ func TestPageRead(t *testing.T) {
 		i++
 	}
 }
+
+func countFiles(t *testing.T, base string) int {
+	entries, err := os.ReadDir(base)
+	assert.NilError(t, err)
+	return len(entries)
+}
+
+func TestPageOverflow(t *testing.T) {
+	base := t.TempDir()
+	p := paging.NewPage(uuid.Nil, uuid.Nil)
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("x"), paging.MAX_PAGE_SIZE*2+100)
+	assert.NilError(t, p.Push(small, false))
+	assert.NilError(t, p.Push(large, false))
+	assert.NilError(t, p.Push(small, false))
+	// the large record is not stored in the page itself
+	assert.Assert(t, p.Size() < 100)
+
+	read := func(p *paging.Page) [][]byte {
+		records := [][]byte{}
+		r := p.NewReader()
+		for r.ReadNext() {
+			records = append(records, r.Buf)
+		}
+		assert.NilError(t, r.Err)
+		return records
+	}
+
+	records := read(p)
+	assert.Equal(t, len(records), 3)
+	assert.Assert(t, bytes.Equal(records[1], large))
+
+	assert.NilError(t, p.WriteToFile(base, false))
+	// the page and 3 overflow pages
+	assert.Equal(t, countFiles(t, base), 4)
+
+	loaded, err := paging.LoadPageUUID(base, p.Id, nil)
+	assert.NilError(t, err)
+	records = read(loaded)
+	assert.Equal(t, len(records), 3)
+	assert.Assert(t, bytes.Equal(records[0], small))
+	assert.Assert(t, bytes.Equal(records[1], large))
+	assert.Assert(t, bytes.Equal(records[2], small))
+
+	assert.NilError(t, paging.RemovePage(base, p.Id, nil))
+	assert.Equal(t, countFiles(t, base), 0)
+}
+
+func TestPageMaxDataSize(t *testing.T) {
+	p := paging.NewPage(uuid.Nil, uuid.Nil)
+	err := p.Push(make([]byte, paging.MAX_DATA_SIZE+1), false)
+	assert.Equal(t, err, paging.ERR_MAX_DATA_SIZE)
+}
+
+func TestLoadLegacyPage(t *testing.T) {
+	base := t.TempDir()
+	id, next := uuid.New(), uuid.New()
+
+	// legacy format: 48 bytes of page links followed by uint16 sized blocks
+	data := []byte{}
+	data = append(data, id[:]...)
+	data = append(data, uuid.Nil[:]...)
+	data = append(data, next[:]...)
+	for _, record := range []string{"a", "bc"} {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(record)))
+		data = append(data, record...)
+	}
+	assert.NilError(t, os.WriteFile(path.Join(base, id.String()), data, 0o644))
+
+	p, err := paging.LoadPageUUID(base, id, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, p.Next, next)
+
+	check := func(p *paging.Page) {
+		r := p.NewReader()
+		assert.Assert(t, r.ReadNext())
+		assert.Equal(t, string(r.Buf), "a")
+		assert.Assert(t, r.ReadNext())
+		assert.Equal(t, string(r.Buf), "bc")
+		assert.Assert(t, !r.ReadNext())
+		assert.NilError(t, r.Err)
+	}
+	check(p)
+
+	// the page is upgraded to the current format when it is written
+	assert.NilError(t, p.WriteToFile(base, false))
+	written, err := os.ReadFile(path.Join(base, id.String()))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, [4]byte(written[0:4]), paging.PAGE_MAGIC)
+	assert.Equal(t, written[4], byte(paging.PAGE_VERSION))
+
+	p, err = paging.LoadPageUUID(base, id, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, p.Next, next)
+	check(p)
+}
+
+func TestPageChecksum(t *testing.T) {
+	base := t.TempDir()
+	p := paging.NewPage(uuid.Nil, uuid.Nil)
+	assert.NilError(t, p.Push([]byte("record"), false))
+	assert.NilError(t, p.WriteToFile(base, false))
+
+	location := path.Join(base, p.Id.String())
+	data, err := os.ReadFile(location)
+	assert.NilError(t, err)
+
+	_, err = paging.LoadPageUUID(base, p.Id, nil)
+	assert.NilError(t, err)
+
+	// flip a bit in the page data
+	data[len(data)-1] ^= 1
+	assert.NilError(t, os.WriteFile(location, data, 0o644))
+	_, err = paging.LoadPageUUID(base, p.Id, nil)
+	assert.Assert(t, errors.Is(err, paging.ERR_CORRUPT_PAGE))
+	var corrupt *paging.CorruptPageError
+	assert.Assert(t, errors.As(err, &corrupt))
+	assert.Equal(t, corrupt.Id, p.Id)
+
+	// only the current version carries a checksum, so no other version is read
+	data[len(data)-1] ^= 1
+	data[4] = paging.PAGE_VERSION - 1
+	assert.NilError(t, os.WriteFile(location, data, 0o644))
+	_, err = paging.LoadPageUUID(base, p.Id, nil)
+	assert.ErrorContains(t, err, "unsupported version")
+
+	// truncated write
+	assert.NilError(t, os.WriteFile(location, data[:20], 0o644))
+	_, err = paging.LoadPageUUID(base, p.Id, nil)
+	assert.Assert(t, errors.Is(err, paging.ERR_CORRUPT_PAGE))
+
+	quarantined, err := paging.QuarantinePage(base, p.Id)
+	assert.NilError(t, err)
+	assert.Equal(t, quarantined, location+".corrupt")
+	_, err = os.Stat(location)
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -14,3 +14,8 @@ func ParseVectorProp(value string) (types.FieldType, int) {
 	v_type, v_level, _ := props.ParseVectorPropSafe(value)
 	return v_type, v_level
 }
+
+func ParseCopyProp(value string) (string, string) {
+	relation_field, field, _ := props.ParseCopyPropSafe(value)
+	return relation_field, field
+}
@@ -23,6 +23,8 @@ type ParserData struct {
 	Name         string
 	Builtin_type types.FieldType
 	Properties   map[props.FieldProp]any
+	// props of a table, set on ParserStateTableStart
+	TableProperties map[props.TableProp]any
 }
 
 const (
@@ -36,8 +38,10 @@ func LineParser(line string) (LineParserState, *ParserData, error) {
 		name_end := strings.Index(line, " ")
 
 		if name_end > 0 {
-			open_bracket := strings.TrimSpace(line[name_end:])
-			if open_bracket != "{" {
+			rest := strings.TrimSpace(line[name_end:])
+			raw_table_props, ok := strings.CutSuffix(rest, "{")
+			// anything other than props between the name and the bracket is part of the name
+			if !ok || (len(raw_table_props) > 0 && !strings.Contains(raw_table_props, "(")) {
 				return ParserStateIdle, nil, errors.New("Table name cannot include space")
 			}
 			name := line[:name_end]
@@ -45,7 +49,12 @@ func LineParser(line string) (LineParserState, *ParserData, error) {
 				return ParserStateIdle, nil,
 					fmt.Errorf("Table name contains invalid characters: %s", name)
 			}
-			return ParserStateTableStart, &ParserData{Name: name}, nil
+			table_props, err := parseRawProps(splitProps(raw_table_props), "table",
+				props.TableProp.IsValid, props.ValidateTablePropValue)
+			if err != nil {
+				return ParserStateIdle, nil, err
+			}
+			return ParserStateTableStart, &ParserData{Name: name, TableProperties: table_props}, nil
 		}
 		return ParserStateIdle, nil, errors.New("Invalid line")
 	}
@@ -54,10 +63,7 @@ func LineParser(line string) (LineParserState, *ParserData, error) {
 		return ParserStateTableEnd, nil, nil
 	}
 
-	// regex splits by whitespace execpt inside parentheses: `(` and `)`
-	// also allows for escaped parentheses `\(` and `\)` to avoid splitting
-	r := regexp.MustCompile(`(?m)(\w+)|(\((?:[^\\)]|\\.)*\))`)
-	splits := r.FindAllString(line, -1)
+	splits := splitProps(line)
 	if len(splits) == 0 {
 		return ParserStateIdle, nil, fmt.Errorf("Invalid line: %s", line)
 	}
@@ -78,12 +84,13 @@ func LineParser(line string) (LineParserState, *ParserData, error) {
 
 	raw_field_props := splits[2:]
 
-	field_props, err := parseRawFieldProps(raw_field_props)
+	field_props, err := parseRawProps(raw_field_props, "field",
+		props.FieldProp.IsValid, props.ValidatePropValue)
 	if err != nil {
 		return ParserStateIdle, nil, err
 	}
 
-	return ParserStateNewField, &ParserData{splits[0], builtin_type, field_props}, nil
+	return ParserStateNewField, &ParserData{Name: splits[0], Builtin_type: builtin_type, Properties: field_props}, nil
 }
 
 func checkAlphanumericUnderScore(name string) bool {
@@ -95,13 +102,24 @@ func checkAlphanumericUnderScore(name string) bool {
 	return r.MatchString(name)
 }
 
-func parseRawFieldProps(raw []string) (map[props.FieldProp]any, error) {
-	field_props := make(map[props.FieldProp]any)
+// regex splits by whitespace execpt inside parentheses: `(` and `)`
+// also allows for escaped parentheses `\(` and `\)` to avoid splitting
+var props_regex = regexp.MustCompile(`(?m)(\w+)|(\((?:[^\\)]|\\.)*\))`)
+
+func splitProps(line string) []string {
+	return props_regex.FindAllString(line, -1)
+}
+
+// parseRawProps parses the `name(value)` pairs of a field or table line; kind is used in errors
+func parseRawProps[P ~string](raw []string, kind string,
+	is_valid func(P) bool, validate func(P, string) (any, error),
+) (map[P]any, error) {
+	parsed_props := make(map[P]any)
 
 	for i := 0; i < len(raw); i += 2 {
-		prop_name := props.FieldProp(raw[i])
-		if !prop_name.IsValid() {
-			return nil, fmt.Errorf("Invalid field prop: %s", prop_name)
+		prop_name := P(raw[i])
+		if !is_valid(prop_name) {
+			return nil, fmt.Errorf("Invalid %s prop: %s", kind, prop_name)
 		}
 		j := i + 1
 		if j >= len(raw) {
@@ -119,12 +137,12 @@ func parseRawFieldProps(raw []string) (map[props.FieldProp]any, error) {
 		// replace escaped parentheses with real parentheses
 		value = strings.ReplaceAll(value, "\\)", ")")
 		value = strings.ReplaceAll(value, "\\(", "(")
-		prop_value, err := props.ValidatePropValue(prop_name, value)
+		prop_value, err := validate(prop_name, value)
 		if err != nil {
 			return nil, err
 		}
-		field_props[prop_name] = prop_value
+		parsed_props[prop_name] = prop_value
 	}
 
-	return field_props, nil
+	return parsed_props, nil
 }
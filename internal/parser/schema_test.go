@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	. "github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
 	"github.com/tobsdb/tobsdb/internal/types"
 	"gotest.tools/assert"
 )
@@ -45,6 +46,29 @@ func TestLineParser(t *testing.T) {
 		assert.Equal(t, state, ParserStateIdle)
 	})
 
+	t.Run("table declaration with props", func(t *testing.T) {
+		state, data, err := LineParser("$TABLE a ttl(24h) {")
+
+		assert.NilError(t, err)
+		assert.Equal(t, state, ParserStateTableStart)
+		assert.Equal(t, data.Name, "a")
+		assert.Equal(t, data.TableProperties[props.TablePropTTL], "24h")
+	})
+
+	t.Run("unknown table prop", func(t *testing.T) {
+		state, _, err := LineParser("$TABLE a unique(true) {")
+
+		assert.ErrorContains(t, err, "Invalid table prop: unique")
+		assert.Equal(t, state, ParserStateIdle)
+	})
+
+	t.Run("invalid table prop value", func(t *testing.T) {
+		state, _, err := LineParser("$TABLE a ttl(-1h) {")
+
+		assert.ErrorContains(t, err, "ttl(-1h) is not a valid prop")
+		assert.Equal(t, state, ParserStateIdle)
+	})
+
 	t.Run("table declaration end", func(t *testing.T) {
 		state, _, err := LineParser("}")
 
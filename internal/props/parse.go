@@ -20,6 +20,25 @@ func ParseRelationPropSafe(relation string) (string, string, error) {
 	return table, field, nil
 }
 
+// ParseCopyPropSafe returns the relation field and field of copy(relation_field.field),
+// or no relation field for copy(field)
+func ParseCopyPropSafe(value string) (string, string, error) {
+	parsed_val := strings.Split(value, ".")
+	if len(parsed_val) > 2 {
+		return "", "", fmt.Errorf("Invalid syntax: copy(%s)", value)
+	}
+	for i := range parsed_val {
+		parsed_val[i] = strings.TrimSpace(parsed_val[i])
+		if len(parsed_val[i]) == 0 {
+			return "", "", fmt.Errorf("Invalid syntax: copy(%s)", value)
+		}
+	}
+	if len(parsed_val) == 1 {
+		return "", parsed_val[0], nil
+	}
+	return parsed_val[0], parsed_val[1], nil
+}
+
 func ParseVectorPropSafe(value string) (types.FieldType, int, error) {
 	parsed_val := strings.Split(value, ",")
 
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type FieldProp string
@@ -11,6 +13,7 @@ type FieldProp string
 var VALID_BUILTIN_PROPS = []FieldProp{
 	FieldPropOptional, FieldPropDefault, FieldPropRelation,
 	FieldPropKey, FieldPropUnique, FieldPropVector,
+	FieldPropCopy, FieldPropCounter,
 }
 
 const (
@@ -18,8 +21,10 @@ const (
 	FieldPropDefault  FieldProp = "default"
 	FieldPropRelation FieldProp = "relation" // relation(table.field)
 	FieldPropKey      FieldProp = "key"
-	FieldPropUnique   FieldProp = "unique" // unique(true/false)
-	FieldPropVector   FieldProp = "vector" // vector(type, level)
+	FieldPropUnique   FieldProp = "unique"  // unique(true/false)
+	FieldPropVector   FieldProp = "vector"  // vector(type, level)
+	FieldPropCopy     FieldProp = "copy"    // copy(field) or copy(relation_field.field)
+	FieldPropCounter  FieldProp = "counter" // counter(field); on relation fields
 )
 
 func (p FieldProp) IsValid() bool {
@@ -55,6 +60,16 @@ func ValidatePropValue(name FieldProp, value string) (any, error) {
 			return nil, err
 		}
 		return value, nil
+	case FieldPropCopy:
+		_, _, err := ParseCopyPropSafe(value)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	case FieldPropCounter:
+		if value = strings.TrimSpace(value); len(value) > 0 && !strings.ContainsAny(value, " ,.") {
+			return value, nil
+		}
 	}
 
 	return nil, invalidPropError(name, value)
@@ -63,3 +78,39 @@ func ValidatePropValue(name FieldProp, value string) (any, error) {
 func invalidPropError(name FieldProp, value string) error {
 	return fmt.Errorf("%s(%s) is not a valid prop", name, value)
 }
+
+type TableProp string
+
+var VALID_TABLE_PROPS = []TableProp{TablePropTTL, TablePropExpiresAt, TablePropSoftDelete, TablePropHistory}
+
+const (
+	TablePropTTL        TableProp = "ttl"        // ttl(duration); e.g. ttl(24h)
+	TablePropExpiresAt  TableProp = "expiresAt"  // expiresAt(field)
+	TablePropSoftDelete TableProp = "softDelete" // softDelete(true/false)
+	TablePropHistory    TableProp = "history"    // history(true/false)
+)
+
+func (p TableProp) IsValid() bool {
+	return slices.Contains(VALID_TABLE_PROPS, p)
+}
+
+func ValidateTablePropValue(name TableProp, value string) (any, error) {
+	switch name {
+	case TablePropTTL:
+		ttl, err := time.ParseDuration(value)
+		if err == nil && ttl > 0 {
+			return value, nil
+		}
+	case TablePropExpiresAt:
+		if value = strings.TrimSpace(value); len(value) > 0 && !strings.ContainsAny(value, " ,") {
+			return value, nil
+		}
+	case TablePropSoftDelete, TablePropHistory:
+		value, err := strconv.ParseBool(value)
+		if err == nil {
+			return value, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s(%s) is not a valid prop", name, value)
+}
@@ -0,0 +1,143 @@
+package query
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
+)
+
+// createBatch holds the rows built so far by CreateMany,
+// so rows can be checked against each other before any of them are written.
+type createBatch struct {
+	table *builder.Table
+	rows  []builder.TDBTableRow
+	// field name -> index keys of the values, see builder.FormatIndexValue
+	unique map[string]map[string]bool
+}
+
+func newCreateBatch(table *builder.Table) *createBatch {
+	return &createBatch{table, []builder.TDBTableRow{}, map[string]map[string]bool{}}
+}
+
+func (b *createBatch) validateUnique(field *builder.Field, value any) error {
+	if b == nil || field.IndexLevel() < builder.IndexLevelUnique {
+		return nil
+	}
+	if b.unique[field.Name][builder.FormatIndexValue(value)] {
+		return NewQueryError(
+			http.StatusConflict,
+			fmt.Sprintf("Value for unique field %s already exists", field.Name),
+		)
+	}
+	return nil
+}
+
+// hasRelation reports whether a row earlier in the batch satisfies the field's relation
+func (b *createBatch) hasRelation(field *builder.Field, value any) bool {
+	if b == nil {
+		return false
+	}
+	rel_table_name, rel_field_name := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+	if rel_table_name != b.table.Name {
+		return false
+	}
+	rel_field := b.table.Fields.Get(rel_field_name)
+	for _, row := range b.rows {
+		if rel_field.Compare(row.Get(rel_field_name), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *createBatch) push(row builder.TDBTableRow) {
+	for _, field := range b.table.Fields.Idx {
+		if field.IndexLevel() < builder.IndexLevelUnique || row.Get(field.Name) == nil {
+			continue
+		}
+		if b.unique[field.Name] == nil {
+			b.unique[field.Name] = map[string]bool{}
+		}
+		b.unique[field.Name][builder.FormatIndexValue(row.Get(field.Name))] = true
+	}
+	b.rows = append(b.rows, row)
+}
+
+// incrementTrackers saves the autoincrement counters of the table's fields
+// so they can be restored when a row is not created.
+func incrementTrackers(table *builder.Table) func() {
+	saved := map[string]int64{}
+	for _, field := range table.Fields.Idx {
+		saved[field.Name] = field.IncrementTracker.Load()
+	}
+	return func() {
+		for _, field := range table.Fields.Idx {
+			field.IncrementTracker.Store(saved[field.Name])
+		}
+	}
+}
+
+func isConflict(err error) bool {
+	query_error, ok := err.(*QueryError)
+	return ok && query_error.Status() == http.StatusConflict
+}
+
+// CreateMany creates all the rows in data or none of them.
+// Every row is validated, against the table and each other, before any row is written.
+//
+// With skip_duplicates, rows that conflict on a unique field are left out instead of failing the batch.
+// The indices of those rows in data are returned as skipped.
+func CreateMany(table *builder.Table, data []QueryArg, skip_duplicates bool) (created []builder.TDBTableRow, skipped []int, err error) {
+	batch := newCreateBatch(table)
+	skipped = []int{}
+	restore_all := incrementTrackers(table)
+	inputs := make([]QueryArg, 0, len(data))
+	for i, input := range data {
+		restore := incrementTrackers(table)
+		input, err := beforeWrite(table, HookBeforeCreate, nil, input)
+		var row builder.TDBTableRow
+		if err == nil {
+			row, err = buildRow(table, input, batch)
+		}
+		if err != nil {
+			if skip_duplicates && isConflict(err) {
+				restore()
+				skipped = append(skipped, i)
+				continue
+			}
+			restore_all()
+			if query_error, ok := err.(*QueryError); ok {
+				return nil, nil, NewQueryError(query_error.Status(), fmt.Sprintf("row %d: %s", i, query_error.Error()))
+			}
+			return nil, nil, fmt.Errorf("row %d: %s", i, err.Error())
+		}
+		batch.push(row)
+		inputs = append(inputs, input)
+	}
+
+	now := time.Now()
+	last_id := table.IdTracker.Load()
+	for i, row := range batch.rows {
+		applyCopies(table, row, inputs[i])
+		setRowKey(table, row, table.CreateId())
+		builder.SetVersion(row, 1)
+		table.SetExpiry(row, now)
+		table.SetValidFrom(row, now)
+	}
+	if err := table.Rows().InsertMany(batch.rows); err != nil {
+		// none of the rows were created, so their ids can be used again
+		table.IdTracker.Store(last_id)
+		restore_all()
+		return nil, nil, err
+	}
+	for i, row := range batch.rows {
+		indexRow(table, row)
+		table.RecordChange(builder.ChangeOperationCreate, nil, row, now)
+		runHooks(&HookCtx{Table: table, Event: HookAfterCreate, Data: inputs[i], After: row})
+	}
+	return batch.rows, skipped, nil
+}
@@ -0,0 +1,118 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/props"
+)
+
+// cursorToken is the decoded form of the opaque cursor returned by findMany.
+// It holds the order by values and primary key of the last row of a page,
+// so the next page can be found by comparing keys rather than positions.
+type cursorToken struct {
+	Order  []OrderByField
+	Values []any
+	Key    int
+}
+
+func NewCursor(table *builder.Table, order_by OrderByList, row builder.TDBTableRow) (string, error) {
+	keys := orderKeys(table, order_by)
+	token := cursorToken{Order: keys, Values: make([]any, len(keys)), Key: builder.GetPrimaryKey(row)}
+	for i, key := range keys {
+		token.Values[i] = row.Get(key.Field)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeCursor(table *builder.Table, order_by OrderByList, cursor string) (*cursorToken, error) {
+	invalidCursorError := NewQueryError(http.StatusBadRequest, "Invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidCursorError
+	}
+
+	var token cursorToken
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&token); err != nil {
+		return nil, invalidCursorError
+	}
+
+	// a cursor is only valid for the ordering it was created with
+	if !slices.Equal(token.Order, orderKeys(table, order_by)) || len(token.Values) != len(token.Order) {
+		return nil, NewQueryError(http.StatusBadRequest, "Cursor does not match orderBy")
+	}
+	return &token, nil
+}
+
+func (c *cursorToken) Row() builder.TDBTableRow {
+	row := builder.TDBTableRow{}
+	for i, key := range c.Order {
+		row.Set(key.Field, c.Values[i])
+	}
+	builder.SetPrimaryKey(row, c.Key)
+	return row
+}
+
+// seekAfterCursor uses the primary index to find the rows after the cursor,
+// reading rows one at a time until limit rows match the where constraints.
+// It is only valid when rows are ordered by primary key alone.
+func seekAfterCursor(table *builder.Table, where QueryArg, c *cursorToken, limit int, include_deleted bool) []builder.TDBTableRow {
+	found := []builder.TDBTableRow{}
+	now := time.Now()
+	for key := range table.Rows().KeysAfter(c.Key) {
+		row := table.Row(key)
+		if row == nil || !isVisible(table, row, now, include_deleted) || !compareUtil(table, row, where) {
+			continue
+		}
+		found = append(found, row)
+		if limit > 0 && len(found) == limit {
+			break
+		}
+	}
+	return found
+}
+
+// canSeekIndex reports whether the rows after the cursor can be found by seeking the unique index
+// of the only order by field. The field must be required, since rows where it is null aren't in the index.
+// Soft deleted rows aren't in indexes either.
+func canSeekIndex(table *builder.Table, keys []OrderByField, c *cursorToken, include_deleted bool) bool {
+	if len(keys) != 1 || include_deleted || c.Values[0] == nil {
+		return false
+	}
+	field := table.Fields.Get(keys[0].Field)
+	is_opt, _ := field.Properties.Get(props.FieldPropOptional).(bool)
+	return field.IndexLevel() == builder.IndexLevelUnique && !is_opt
+}
+
+// seekIndexAfterCursor uses the unique index of the order by field to find the rows after the cursor,
+// reading rows one at a time until limit rows match the where constraints.
+// It is only valid when canSeekIndex is true.
+func seekIndexAfterCursor(ctx context.Context, table *builder.Table, where QueryArg, key OrderByField, c *cursorToken, limit int) ([]builder.TDBTableRow, error) {
+	found := []builder.TDBTableRow{}
+	now := time.Now()
+	for id, err := range table.IndexSeek(ctx, key.Field, c.Values[0], key.Order == OrderByDesc) {
+		if err != nil {
+			return nil, err
+		}
+		row := table.Row(id)
+		if row == nil || !isVisible(table, row, now, false) || !compareUtil(table, row, where) {
+			continue
+		}
+		found = append(found, row)
+		if limit > 0 && len(found) == limit {
+			break
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,85 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+func validateDistinctFields(table *builder.Table, fields []string) error {
+	if len(fields) == 0 {
+		return NewQueryError(http.StatusBadRequest, "Distinct fields cannot be empty")
+	}
+	for _, name := range fields {
+		if !table.Fields.Has(name) {
+			return NewQueryError(http.StatusBadRequest,
+				fmt.Sprintf("Distinct field %s does not exist on table %s", name, table.Name))
+		}
+	}
+	return nil
+}
+
+// distinctKey formats the values of fields in row so that rows with equal values share a key
+func distinctKey(row builder.TDBTableRow, fields []string) string {
+	var key strings.Builder
+	for _, name := range fields {
+		fmt.Fprintf(&key, "%T:%v\x00", row.Get(name), row.Get(name))
+	}
+	return key.String()
+}
+
+// hasUniqueValue reports whether any of fields is a primary or unique field with a value in row,
+// in which case no other row shares the row's tuple.
+// Null values aren't indexed, so rows may share a null unique field.
+func hasUniqueValue(table *builder.Table, fields []string, row builder.TDBTableRow) bool {
+	for _, name := range fields {
+		if table.Fields.Get(name).IndexLevel() > builder.IndexLevelNone && row.Get(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// distinctRows keeps the first row for each distinct tuple of fields
+func distinctRows(table *builder.Table, fields []string, rows []builder.TDBTableRow) []builder.TDBTableRow {
+	seen := map[string]bool{}
+	return pkg.Filter(rows, func(row builder.TDBTableRow) bool {
+		if hasUniqueValue(table, fields, row) {
+			return true
+		}
+		key := distinctKey(row, fields)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		return true
+	})
+}
+
+// Distinct returns the unique tuples of values for fields among the rows matching where.
+// Each tuple only contains the requested fields.
+func Distinct(ctx context.Context, table *builder.Table, fields []string, where QueryArg) ([]builder.TDBTableRow, error) {
+	if err := validateDistinctFields(table, fields); err != nil {
+		return nil, err
+	}
+
+	found, err := findManyUtil(ctx, table, where, true, false)
+	if err != nil {
+		return nil, err
+	}
+	rows := distinctRows(table, fields, found)
+
+	tuples := make([]builder.TDBTableRow, 0, len(rows))
+	for _, row := range rows {
+		tuple := builder.TDBTableRow{}
+		for _, name := range fields {
+			tuple.Set(name, row.Get(name))
+		}
+		tuples = append(tuples, tuple)
+	}
+	return tuples, nil
+}
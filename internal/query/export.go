@@ -0,0 +1,649 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/paging"
+	"github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+type ExportFormat string
+
+const (
+	// one JSON object per row, separated by newlines
+	ExportFormatNDJSON ExportFormat = "ndjson"
+	// a header with the column names followed by one record per row
+	ExportFormatCSV ExportFormat = "csv"
+)
+
+func (f ExportFormat) IsValid() bool {
+	return f == ExportFormatNDJSON || f == ExportFormatCSV
+}
+
+// Ext returns the file extension of tables exported in the format
+func (f ExportFormat) Ext() string { return "." + string(f) }
+
+// TableCounters are the id and autoincrement counters of a table.
+// They are exported with the table's rows so an import does not reuse values of deleted rows.
+type TableCounters struct {
+	Id int64 `json:"id"`
+	// autoincrement field name -> last value
+	Fields map[string]int64 `json:"fields"`
+}
+
+func isAutoIncrement(field *builder.Field) bool {
+	return field.BuiltinType == types.FieldTypeInt &&
+		field.Properties.Get(props.FieldPropDefault) == "autoincrement"
+}
+
+func ExportCounters(table *builder.Table) TableCounters {
+	counters := TableCounters{table.IdTracker.Load(), map[string]int64{}}
+	for _, field := range table.Fields.Idx {
+		if isAutoIncrement(field) {
+			counters.Fields[field.Name] = field.IncrementTracker.Load()
+		}
+	}
+	return counters
+}
+
+// systemColumns returns the system fields the table's rows are exported with
+func systemColumns(table *builder.Table) []string {
+	columns := []string{builder.SYS_PRIMARY_KEY, builder.SYS_VERSION}
+	if table.TTL() > 0 {
+		columns = append(columns, builder.SYS_EXPIRES_AT)
+	}
+	if table.SoftDeletes() {
+		columns = append(columns, builder.SYS_DELETED_AT)
+	}
+	return columns
+}
+
+// exportColumns returns the columns of an exported table, its system fields followed by its fields
+func exportColumns(table *builder.Table) []string {
+	return append(systemColumns(table), table.Fields.Sorted...)
+}
+
+// ExportTable writes every row of the table that has not expired to w and returns the number of rows written.
+// Soft deleted rows are exported along with when they were deleted, so they can still be restored after an import.
+func ExportTable(ctx context.Context, table *builder.Table, w io.Writer, format ExportFormat) (int, error) {
+	count := 0
+	now := time.Now()
+	switch format {
+	case ExportFormatNDJSON:
+		enc := json.NewEncoder(w)
+		for row, err := range table.Rows().Scan(ctx) {
+			if err != nil {
+				return count, err
+			}
+			if !isVisible(table, row, now, true) {
+				continue
+			}
+			if err := enc.Encode(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+		return count, nil
+	case ExportFormatCSV:
+		columns := exportColumns(table)
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return count, err
+		}
+		record := make([]string, len(columns))
+		for row, err := range table.Rows().Scan(ctx) {
+			if err != nil {
+				return count, err
+			}
+			if !isVisible(table, row, now, true) {
+				continue
+			}
+			for i, name := range columns {
+				value, err := formatCSVValue(row.Get(name))
+				if err != nil {
+					return count, err
+				}
+				record[i] = value
+			}
+			if err := cw.Write(record); err != nil {
+				return count, err
+			}
+			count++
+		}
+		cw.Flush()
+		return count, cw.Error()
+	}
+	return count, fmt.Errorf("invalid export format %s", format)
+}
+
+func formatCSVValue(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case int:
+		return strconv.Itoa(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(value), nil
+	default:
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+}
+
+// DecodeRows reads the rows of a table exported in format.
+// Values are only decoded from their encoding; they are validated against the table's fields on import.
+func DecodeRows(table *builder.Table, r io.Reader, format ExportFormat) ([]QueryArg, error) {
+	switch format {
+	case ExportFormatNDJSON:
+		return decodeNDJSON(table, r)
+	case ExportFormatCSV:
+		return decodeCSV(table, r)
+	}
+	return nil, fmt.Errorf("invalid export format %s", format)
+}
+
+func decodeNDJSON(table *builder.Table, r io.Reader) ([]QueryArg, error) {
+	rows := []QueryArg{}
+	scanner := bufio.NewScanner(r)
+	// a row's JSON can be larger than its stored record, which is at most paging.MAX_DATA_SIZE
+	scanner.Buffer(nil, 2*paging.MAX_DATA_SIZE)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var row QueryArg
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		// []byte values are encoded as base64 strings
+		for _, field := range table.Fields.Idx {
+			if value, ok := row.Get(field.Name).(string); ok && field.BuiltinType == types.FieldTypeBytes {
+				data, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid bytes for %s: %w", line, field.Name, err)
+				}
+				row[field.Name] = data
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func decodeCSV(table *builder.Table, r io.Reader) ([]QueryArg, error) {
+	cr := csv.NewReader(r)
+	columns, err := cr.Read()
+	if err == io.EOF {
+		return []QueryArg{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	system := systemColumns(table)
+	for _, name := range columns {
+		if !slices.Contains(system, name) && !table.Fields.Has(name) {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+	}
+
+	rows := []QueryArg{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := QueryArg{}
+		for i, name := range columns {
+			var value any
+			if field := table.Fields.Get(name); field != nil {
+				value, err = parseCSVValue(field, record[i])
+			} else {
+				value, err = parseCSVSystemValue(name, record[i])
+			}
+			if err != nil {
+				line, _ := cr.FieldPos(i)
+				return nil, fmt.Errorf("line %d: invalid value for %s: %w", line, name, err)
+			}
+			row[name] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseCSVSystemValue converts a CSV cell of a system column to the value an NDJSON export holds
+func parseCSVSystemValue(name, value string) (any, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if name == builder.SYS_PRIMARY_KEY || name == builder.SYS_VERSION {
+		return strconv.Atoi(value)
+	}
+	// times are parsed when the row is imported
+	return value, nil
+}
+
+// parseCSVValue converts a CSV cell to the value a client would send for the field.
+// Empty cells are null, except for required String fields.
+func parseCSVValue(field *builder.Field, value string) (any, error) {
+	if value == "" {
+		is_opt, _ := field.Properties.Get(props.FieldPropOptional).(bool)
+		if field.BuiltinType == types.FieldTypeString && !is_opt {
+			return value, nil
+		}
+		return nil, nil
+	}
+
+	switch field.BuiltinType {
+	case types.FieldTypeInt:
+		return strconv.Atoi(value)
+	case types.FieldTypeFloat:
+		return strconv.ParseFloat(value, 64)
+	case types.FieldTypeBytes:
+		return base64.StdEncoding.DecodeString(value)
+	case types.FieldTypeVector:
+		var v []any
+		err := json.Unmarshal([]byte(value), &v)
+		return v, err
+	}
+	return value, nil
+}
+
+// buildImportRow validates an imported row like buildRow, but keeps the row's id and primary key.
+// Relations are validated once every row has been built.
+func buildImportRow(table *builder.Table, data QueryArg, batch *createBatch) (builder.TDBTableRow, error) {
+	row := make(builder.TDBTableRow)
+
+	// soft deleted rows are not in the unique indexes until they are restored
+	if deleted_at, ok := data.Get(builder.SYS_DELETED_AT).(string); ok && table.SoftDeletes() {
+		at, err := time.Parse(time.RFC3339Nano, deleted_at)
+		if err != nil {
+			return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("invalid %s %s", builder.SYS_DELETED_AT, deleted_at))
+		}
+		row.Set(builder.SYS_DELETED_AT, at)
+	}
+	is_deleted := builder.IsDeleted(row)
+	for _, field := range table.Fields.Idx {
+		if field.IndexLevel() == builder.IndexLevelPrimary {
+			continue
+		}
+
+		input := data.Get(field.Name)
+		// defaults only fill in columns missing from the import, not null values
+		res, err := field.ValidateType(input, !data.Has(field.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		if res != nil && !is_deleted {
+			if err := validateUnique(table, field, res); err != nil {
+				return nil, err
+			}
+			if err := batch.validateUnique(field, res); err != nil {
+				return nil, err
+			}
+		}
+		row.Set(field.Name, res)
+	}
+
+	id := data.Get(builder.SYS_PRIMARY_KEY)
+	if id == nil && table.PrimaryKey() != nil {
+		id = data.Get(table.PrimaryKey().Name)
+	}
+	if id != nil {
+		key, ok := id.(int)
+		if !ok {
+			f, is_float := id.(float64)
+			if !is_float || f != float64(int(f)) {
+				return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("invalid row id %v", id))
+			}
+			key = int(f)
+		}
+		if key <= 0 {
+			return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("invalid row id %d", key))
+		}
+		builder.SetPrimaryKey(row, key)
+	}
+
+	// exports keep the version of each row
+	if version := data.Get(builder.SYS_VERSION); version != nil {
+		v := pkg.NumToInt(version)
+		if f, is_float := version.(float64); (is_float && f != float64(v)) || v < 1 {
+			return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("invalid %s %v", builder.SYS_VERSION, version))
+		}
+		builder.SetVersion(row, v)
+	}
+
+	// exports of tables with a ttl prop keep when each row expires
+	if expires_at, ok := data.Get(builder.SYS_EXPIRES_AT).(string); ok && table.TTL() > 0 {
+		at, err := time.Parse(time.RFC3339Nano, expires_at)
+		if err != nil {
+			return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("invalid %s %s", builder.SYS_EXPIRES_AT, expires_at))
+		}
+		row.Set(builder.SYS_EXPIRES_AT, at)
+	}
+	return row, nil
+}
+
+// relationValues returns the values that satisfy the field's relation in an import,
+// so each row is checked without scanning the related table.
+// Those are the values of the visible rows of the related table and, for relations to the same table, of the imported rows.
+func relationValues(table *builder.Table, field *builder.Field, batch *createBatch) (map[string]bool, error) {
+	rel_table_name, rel_field_name := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+	rel_table := table.Schema.Tables.Get(rel_table_name)
+	values := map[string]bool{}
+	add := func(row builder.TDBTableRow) {
+		if value := row.Get(rel_field_name); value != nil {
+			values[fmt.Sprintf("%v", value)] = true
+		}
+	}
+
+	now := time.Now()
+	for row, err := range rel_table.Rows().Scan(context.Background()) {
+		if err != nil {
+			return nil, err
+		}
+		if isVisible(rel_table, row, now, false) {
+			add(row)
+		}
+	}
+	if rel_table_name == table.Name {
+		for _, row := range batch.rows {
+			add(row)
+		}
+	}
+	return values, nil
+}
+
+// Import adds the rows of an exported table, keeping their ids.
+// Every row is validated before any row is written, so either all the rows are imported or none of them are.
+// Rows without an id get a new one.
+//
+// Rows may refer to any row already in the database or in the same import.
+// The table's counters are raised to the highest of their current value, the imported values and counters.
+func Import(table *builder.Table, data []QueryArg, counters *TableCounters) (int, error) {
+	batch := newCreateBatch(table)
+	restore := incrementTrackers(table)
+	fail := func(i int, err error) (int, error) {
+		restore()
+		if query_error, ok := err.(*QueryError); ok {
+			return 0, NewQueryError(query_error.Status(), fmt.Sprintf("row %d: %s", i, query_error.Error()))
+		}
+		return 0, fmt.Errorf("row %d: %s", i, err.Error())
+	}
+
+	ids := map[int]bool{}
+	max_id := table.IdTracker.Load()
+	for i, input := range data {
+		row, err := buildImportRow(table, input, batch)
+		if err != nil {
+			return fail(i, err)
+		}
+		if row.Has(builder.SYS_PRIMARY_KEY) {
+			key := builder.GetPrimaryKey(row)
+			if ids[key] || table.Rows().Has(key) {
+				return fail(i, NewQueryError(http.StatusConflict, fmt.Sprintf("row %d already exists", key)))
+			}
+			ids[key] = true
+			max_id = max(max_id, int64(key))
+		}
+		if builder.IsDeleted(row) {
+			// soft deleted rows don't hold on to their unique values
+			batch.rows = append(batch.rows, row)
+			continue
+		}
+		batch.push(row)
+	}
+
+	// relations are checked once every row is built so rows can refer to rows later in the import
+	for _, field := range table.Fields.Idx {
+		if !field.Properties.Has(props.FieldPropRelation) || field.BuiltinType == types.FieldTypeVector {
+			continue
+		}
+		values, err := relationValues(table, field, batch)
+		if err != nil {
+			restore()
+			return 0, err
+		}
+		for i, row := range batch.rows {
+			value := row.Get(field.Name)
+			if value == nil && field.Properties.Has(props.FieldPropOptional) {
+				continue
+			}
+			if value == nil || !values[fmt.Sprintf("%v", value)] {
+				rel_table_name, rel_field_name := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+				return fail(i, fmt.Errorf("No row found for relation %s.%s -> %s.%s",
+					table.Name, field.Name, rel_table_name, rel_field_name))
+			}
+		}
+	}
+
+	if counters != nil {
+		max_id = max(max_id, counters.Id)
+	}
+	// counters are only raised once the rows are written, so a failed import leaves them unchanged
+	last_id := max_id
+	now := time.Now()
+	for _, row := range batch.rows {
+		key := builder.GetPrimaryKey(row)
+		if !row.Has(builder.SYS_PRIMARY_KEY) {
+			last_id++
+			key = int(last_id)
+		}
+		setRowKey(table, row, key)
+		if !row.Has(builder.SYS_VERSION) {
+			builder.SetVersion(row, 1)
+		}
+		if !row.Has(builder.SYS_EXPIRES_AT) {
+			table.SetExpiry(row, now)
+		}
+		table.SetValidFrom(row, now)
+	}
+
+	increments := map[*builder.Field]int64{}
+	for _, field := range table.Fields.Idx {
+		if !isAutoIncrement(field) {
+			continue
+		}
+		last := field.IncrementTracker.Load()
+		if counters != nil {
+			last = max(last, counters.Fields[field.Name])
+		}
+		for _, row := range batch.rows {
+			if value, ok := row.Get(field.Name).(int); ok {
+				last = max(last, int64(value))
+			}
+		}
+		increments[field] = last
+	}
+
+	if err := table.Rows().InsertMany(batch.rows); err != nil {
+		restore()
+		return 0, err
+	}
+	table.IdTracker.Store(last_id)
+	for field, last := range increments {
+		field.IncrementTracker.Store(last)
+	}
+	for _, row := range batch.rows {
+		if !builder.IsDeleted(row) {
+			indexRow(table, row)
+		}
+		table.RecordChange(builder.ChangeOperationCreate, nil, row, now)
+	}
+	return len(batch.rows), nil
+}
+
+// ImportOrder sorts table names so that tables come after the tables their relations refer to.
+// Tables in a relation cycle keep their order.
+func ImportOrder(schema *builder.Schema, names []string) []string {
+	deps := map[string][]string{}
+	for _, name := range names {
+		table := schema.Tables.Get(name)
+		for _, field := range table.Fields.Idx {
+			if !field.Properties.Has(props.FieldPropRelation) {
+				continue
+			}
+			rel_table, _ := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+			if rel_table != name && slices.Contains(names, rel_table) {
+				deps[name] = append(deps[name], rel_table)
+			}
+		}
+	}
+
+	order := []string{}
+	state := map[string]int{} // 1: visiting, 2: done
+	var visit func(name string)
+	visit = func(name string) {
+		if state[name] != 0 {
+			return
+		}
+		state[name] = 1
+		for _, dep := range deps[name] {
+			visit(dep)
+		}
+		state[name] = 2
+		order = append(order, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+const EXPORT_MANIFEST_FILE = "export.json"
+
+// ExportManifest describes a directory of exported tables, one file per table
+type ExportManifest struct {
+	Format   ExportFormat    `json:"format"`
+	Database string          `json:"database"`
+	Tables   []ExportedTable `json:"tables"`
+}
+
+type ExportedTable struct {
+	Name     string        `json:"name"`
+	Rows     int           `json:"rows"`
+	Counters TableCounters `json:"counters"`
+	// the exported rows, when they are not written to a file
+	Data string `json:"data,omitempty"`
+}
+
+// ExportSchema writes the named tables of the schema, or all of them when names is empty,
+// to dir along with a manifest that ImportSchema reads.
+func ExportSchema(ctx context.Context, schema *builder.Schema, dir string, format ExportFormat, names []string) (*ExportManifest, error) {
+	if !format.IsValid() {
+		return nil, fmt.Errorf("invalid export format %s", format)
+	}
+	if len(names) == 0 {
+		names = schema.Tables.Sorted
+	}
+	for _, name := range names {
+		if !schema.Tables.Has(name) {
+			return nil, fmt.Errorf("table %s not found", name)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	manifest := &ExportManifest{format, schema.Name, []ExportedTable{}}
+	for _, name := range ImportOrder(schema, names) {
+		table := schema.Tables.Get(name)
+		count := 0
+		err := pkg.WriteFileAtomicFunc(filepath.Join(dir, name+format.Ext()), 0o644, func(w io.Writer) error {
+			bw := bufio.NewWriter(w)
+			n, err := ExportTable(ctx, table, bw, format)
+			if err != nil {
+				return fmt.Errorf("export %s: %w", name, err)
+			}
+			count = n
+			return bw.Flush()
+		})
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append(manifest.Tables, ExportedTable{name, count, ExportCounters(table), ""})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return manifest, pkg.WriteFileAtomic(filepath.Join(dir, EXPORT_MANIFEST_FILE), data, 0o644)
+}
+
+// ImportSchema imports the tables exported to dir by ExportSchema.
+// Each table is imported as a whole or not at all; tables imported before a failing one are kept.
+func ImportSchema(schema *builder.Schema, dir string) ([]ExportedTable, error) {
+	data, err := os.ReadFile(filepath.Join(dir, EXPORT_MANIFEST_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid export manifest: %w", err)
+	}
+	if !manifest.Format.IsValid() {
+		return nil, fmt.Errorf("invalid export format %s", manifest.Format)
+	}
+
+	tables := map[string]ExportedTable{}
+	names := []string{}
+	for _, t := range manifest.Tables {
+		if !schema.Tables.Has(t.Name) {
+			return nil, fmt.Errorf("table %s not found", t.Name)
+		}
+		tables[t.Name] = t
+		names = append(names, t.Name)
+	}
+
+	res := []ExportedTable{}
+	for _, name := range ImportOrder(schema, names) {
+		table := schema.Tables.Get(name)
+		f, err := os.Open(filepath.Join(dir, name+manifest.Format.Ext()))
+		if err != nil {
+			return res, err
+		}
+		rows, err := DecodeRows(table, f, manifest.Format)
+		f.Close()
+		if err != nil {
+			return res, fmt.Errorf("import %s: %w", name, err)
+		}
+		counters := tables[name].Counters
+		count, err := Import(table, rows, &counters)
+		if err != nil {
+			return res, fmt.Errorf("import %s: %w", name, err)
+		}
+		res = append(res, ExportedTable{name, count, ExportCounters(table), ""})
+	}
+	return res, nil
+}
@@ -0,0 +1,218 @@
+package query_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	. "github.com/tobsdb/tobsdb/internal/query"
+	"gotest.tools/assert"
+)
+
+const exportTestSchema = `
+$TABLE user {
+    id Int key(primary)
+    name String unique(true)
+    n Int default(autoincrement)
+    created Date
+    score Float optional(true)
+    avatar Bytes optional(true)
+    tags Vector vector(String) optional(true)
+}
+$TABLE post {
+    author Int relation(user.id)
+    reply Int relation(post.n) optional(true)
+    n Int unique(true)
+}
+`
+
+func newExportTestSchema(t *testing.T) *builder.Schema {
+	schema, err := builder.NewSchemaFromString(exportTestSchema, nil, false)
+	assert.NilError(t, err)
+	return schema
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []ExportFormat{ExportFormatNDJSON, ExportFormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			src := newExportTestSchema(t)
+			user := src.Tables.Get("user")
+			created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			_, err := Create(user, QueryArg{"name": "a", "created": created, "score": 1.5,
+				"avatar": []byte{0, 1, 2}, "tags": []any{"x", "y"}})
+			assert.NilError(t, err)
+			deleted, err := Create(user, QueryArg{"name": "b", "created": created})
+			assert.NilError(t, err)
+			_, err = Create(user, QueryArg{"name": "c", "created": created})
+			assert.NilError(t, err)
+			Delete(user, deleted, "")
+
+			post := src.Tables.Get("post")
+			_, err = Create(post, QueryArg{"author": 3, "n": 1})
+			assert.NilError(t, err)
+			_, err = Create(post, QueryArg{"author": 1, "n": 2, "reply": 1})
+			assert.NilError(t, err)
+
+			dst := newExportTestSchema(t)
+			// posts first, so relations to users must be resolved by import order
+			for _, name := range ImportOrder(src, []string{"post", "user"}) {
+				var buf bytes.Buffer
+				count, err := ExportTable(context.Background(), src.Tables.Get(name), &buf, format)
+				assert.NilError(t, err)
+				assert.Equal(t, count, 2)
+
+				table := dst.Tables.Get(name)
+				rows, err := DecodeRows(table, &buf, format)
+				assert.NilError(t, err)
+				counters := ExportCounters(src.Tables.Get(name))
+				count, err = Import(table, rows, &counters)
+				assert.NilError(t, err)
+				assert.Equal(t, count, 2)
+			}
+
+			user = dst.Tables.Get("user")
+			row, err := FindUnique(user, QueryArg{"name": "a"})
+			assert.NilError(t, err)
+			assert.Equal(t, builder.GetPrimaryKey(row), 1)
+			assert.Equal(t, row.Get("id"), 1)
+			assert.Equal(t, row.Get("n"), 1)
+			assert.Assert(t, row.Get("created").(time.Time).Equal(created))
+			assert.Equal(t, row.Get("score"), 1.5)
+			assert.DeepEqual(t, row.Get("avatar"), []byte{0, 1, 2})
+			assert.DeepEqual(t, row.Get("tags"), []any{"x", "y"})
+
+			row, err = FindUnique(user, QueryArg{"id": 3})
+			assert.NilError(t, err)
+			assert.Equal(t, row.Get("name"), "c")
+			assert.Equal(t, row.Get("score"), nil)
+
+			// counters continue after the deleted row
+			row, err = Create(user, QueryArg{"name": "d", "created": created})
+			assert.NilError(t, err)
+			assert.Equal(t, builder.GetPrimaryKey(row), 4)
+			assert.Equal(t, row.Get("n"), 4)
+
+			row, err = FindUnique(dst.Tables.Get("post"), QueryArg{"n": 2})
+			assert.NilError(t, err)
+			assert.Equal(t, row.Get("author"), 1)
+			assert.Equal(t, row.Get("reply"), 1)
+		})
+	}
+}
+
+func TestExportSystemColumns(t *testing.T) {
+	const schema = "$TABLE a softDelete(true) ttl(1h) {\n b String unique(true)\n}"
+	for _, format := range []ExportFormat{ExportFormatNDJSON, ExportFormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			src, err := builder.NewSchemaFromString(schema, nil, false)
+			assert.NilError(t, err)
+			table := src.Tables.Get("a")
+			row, err := Create(table, QueryArg{"b": "x"})
+			assert.NilError(t, err)
+			row, err = Update(table, row, QueryArg{"b": "y"}, "")
+			assert.NilError(t, err)
+			deleted, err := Delete(table, row, "")
+			assert.NilError(t, err)
+			// a row that took the unique value of the deleted row
+			_, err = Create(table, QueryArg{"b": "y"})
+			assert.NilError(t, err)
+
+			var buf bytes.Buffer
+			count, err := ExportTable(context.Background(), table, &buf, format)
+			assert.NilError(t, err)
+			assert.Equal(t, count, 2)
+
+			dst, err := builder.NewSchemaFromString(schema, nil, false)
+			assert.NilError(t, err)
+			table = dst.Tables.Get("a")
+			rows, err := DecodeRows(table, &buf, format)
+			assert.NilError(t, err)
+			_, err = Import(table, rows, nil)
+			assert.NilError(t, err)
+
+			row = table.Row(1)
+			assert.Assert(t, builder.IsDeleted(row))
+			assert.Assert(t, row.Get(builder.SYS_DELETED_AT).(time.Time).Equal(deleted.Get(builder.SYS_DELETED_AT).(time.Time)))
+			assert.Equal(t, builder.GetVersion(row), 3)
+			assert.Assert(t, row.Get(builder.SYS_EXPIRES_AT).(time.Time).Equal(deleted.Get(builder.SYS_EXPIRES_AT).(time.Time)))
+			assert.Equal(t, table.IndexMap("b").Get("y"), 2)
+
+			found, err := FindDeleted(context.Background(), table, nil)
+			assert.NilError(t, err)
+			assert.Equal(t, len(found), 1)
+			_, err = Restore(table, found)
+			assert.Equal(t, err.(*QueryError).Status(), http.StatusConflict)
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	t.Run("relation later in import", func(t *testing.T) {
+		schema := newExportTestSchema(t)
+		_, err := Create(schema.Tables.Get("user"), QueryArg{"name": "a", "created": 0})
+		assert.NilError(t, err)
+		post := schema.Tables.Get("post")
+		count, err := Import(post, []QueryArg{{"author": 1, "n": 1, "reply": 2}, {"author": 1, "n": 2}}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, count, 2)
+	})
+
+	t.Run("missing relation", func(t *testing.T) {
+		schema := newExportTestSchema(t)
+		post := schema.Tables.Get("post")
+		_, err := Import(post, []QueryArg{{"author": 1, "n": 1}}, nil)
+		assert.ErrorContains(t, err, "row 0: No row found for relation")
+		assert.Equal(t, post.Rows().Len(), 0)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		schema, err := builder.NewSchemaFromString("$TABLE a ttl(1h) {\n b String\n}", nil, false)
+		assert.NilError(t, err)
+		table := schema.Tables.Get("a")
+		expires_at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, err = Import(table, []QueryArg{
+			{"b": "kept", builder.SYS_EXPIRES_AT: expires_at.Format(time.RFC3339Nano)},
+			{"b": "new"},
+		}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, table.Row(1).Get(builder.SYS_EXPIRES_AT), expires_at)
+		assert.Assert(t, table.Row(2).Get(builder.SYS_EXPIRES_AT).(time.Time).After(time.Now()))
+
+		_, err = Import(table, []QueryArg{{"b": "bad", builder.SYS_EXPIRES_AT: "tomorrow"}}, nil)
+		assert.ErrorContains(t, err, "row 0: invalid __tdb_expires_at__ tomorrow")
+	})
+
+	t.Run("existing id", func(t *testing.T) {
+		schema := newExportTestSchema(t)
+		user := schema.Tables.Get("user")
+		_, err := Create(user, QueryArg{"name": "a", "created": 0})
+		assert.NilError(t, err)
+
+		_, err = Import(user, []QueryArg{
+			{builder.SYS_PRIMARY_KEY: 2, "name": "b", "created": 0},
+			{builder.SYS_PRIMARY_KEY: 1, "name": "c", "created": 0},
+		}, nil)
+		assert.ErrorContains(t, err, "row 1: row 1 already exists")
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusConflict)
+		assert.Equal(t, user.Rows().Len(), 1)
+		assert.Equal(t, user.IdTracker.Load(), int64(1))
+	})
+
+	t.Run("rows without ids", func(t *testing.T) {
+		schema := newExportTestSchema(t)
+		user := schema.Tables.Get("user")
+		count, err := Import(user, []QueryArg{
+			{"name": "a", "created": 0},
+			{builder.SYS_PRIMARY_KEY: 5, "name": "b", "created": 0},
+		}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, count, 2)
+		row, err := FindUnique(user, QueryArg{"name": "a"})
+		assert.NilError(t, err)
+		assert.Equal(t, builder.GetPrimaryKey(row), 6)
+		assert.Equal(t, row.Get("id"), 6)
+	})
+}
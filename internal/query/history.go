@@ -0,0 +1,75 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+)
+
+// FindUniqueAsOf is FindUnique on the state of a table that keeps history at the time at
+func FindUniqueAsOf(table *builder.Table, where QueryArg, at time.Time, include_deleted bool) (builder.TDBTableRow, error) {
+	if len(where) == 0 {
+		return nil, ERR_EMPTY_WHERE
+	}
+	if !hasUniqueConstraint(table, where) {
+		if len(table.Indexes) > 0 {
+			return nil, fmt.Errorf("Unique fields not included in findUnique request")
+		}
+		return nil, fmt.Errorf("Table does not have any unique fields")
+	}
+
+	found, err := findAsOf(context.Background(), table, where, at, include_deleted)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, NewQueryError(404, fmt.Sprintf("No row found with constraint %v in table %s", where, table.Name))
+	}
+	return found[0], nil
+}
+
+func hasUniqueConstraint(table *builder.Table, where QueryArg) bool {
+	for _, index := range table.Indexes {
+		if where.Has(index) {
+			return true
+		}
+	}
+	return false
+}
+
+// findAsOf returns the rows of a table that keeps history that matched where at the time at.
+// Rows current at that time are read from the table and older versions from its history table.
+func findAsOf(ctx context.Context, table *builder.Table, where QueryArg, at time.Time, include_deleted bool) ([]builder.TDBTableRow, error) {
+	history := table.History()
+	if history == nil {
+		return nil, NewQueryError(http.StatusBadRequest, fmt.Sprintf("Table %s does not keep history", table.Name))
+	}
+
+	found := []builder.TDBTableRow{}
+	keep := func(row builder.TDBTableRow) {
+		if isVisible(table, row, at, include_deleted) && compareUtil(table, row, where) {
+			found = append(found, row)
+		}
+	}
+
+	for row, err := range table.Rows().Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if builder.ValidAt(row, at) {
+			keep(row)
+		}
+	}
+	for entry, err := range history.Rows().Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if version, ok := builder.HistoryVersionAt(entry, at); ok {
+			keep(version)
+		}
+	}
+	return sortRows(table, nil, found), nil
+}
@@ -0,0 +1,213 @@
+package query
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/internal/parser"
+	"github.com/tobsdb/tobsdb/internal/props"
+	"github.com/tobsdb/tobsdb/internal/types"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+type HookEvent string
+
+const (
+	HookBeforeCreate HookEvent = "beforeCreate"
+	HookAfterCreate  HookEvent = "afterCreate"
+	HookBeforeUpdate HookEvent = "beforeUpdate"
+	HookAfterUpdate  HookEvent = "afterUpdate"
+	HookBeforeDelete HookEvent = "beforeDelete"
+	HookAfterDelete  HookEvent = "afterDelete"
+)
+
+func (e HookEvent) isBefore() bool {
+	return e == HookBeforeCreate || e == HookBeforeUpdate || e == HookBeforeDelete
+}
+
+// HookCtx is the write a hook runs for
+type HookCtx struct {
+	Table *builder.Table
+	Event HookEvent
+	// the input of a create or update.
+	// Hooks that run before the write can change it, and the changes are validated like the rest of the input.
+	Data QueryArg
+	// the row before an update or delete
+	Before builder.TDBTableRow
+	// the row after a create or update; only set for hooks that run after the write
+	After builder.TDBTableRow
+}
+
+// Hook runs on a write to a table.
+// An error returned by a hook that runs before the write rejects the write.
+// Writes have already happened when hooks that run after them are called, so their errors are only logged.
+type Hook func(ctx *HookCtx) error
+
+type registeredHook struct {
+	id    int
+	db    string
+	table string
+	event HookEvent
+	hook  Hook
+}
+
+var hooks = struct {
+	locker sync.RWMutex
+	last   int
+	list   []registeredHook
+}{}
+
+// RegisterHook adds a hook that runs on event for the table of the database named db,
+// or for the table in every database when db is empty.
+// Hooks run in the order they were registered, while the schema's write lock is held.
+// It returns a function that removes the hook.
+func RegisterHook(db, table string, event HookEvent, hook Hook) (unregister func()) {
+	hooks.locker.Lock()
+	defer hooks.locker.Unlock()
+	hooks.last++
+	id := hooks.last
+	hooks.list = append(hooks.list, registeredHook{id, db, table, event, hook})
+
+	return func() {
+		hooks.locker.Lock()
+		defer hooks.locker.Unlock()
+		hooks.list = slices.DeleteFunc(hooks.list, func(h registeredHook) bool { return h.id == id })
+	}
+}
+
+func registeredHooks(table *builder.Table, event HookEvent) []Hook {
+	hooks.locker.RLock()
+	defer hooks.locker.RUnlock()
+	db := ""
+	if table.Schema != nil {
+		db = table.Schema.Name
+	}
+	found := []Hook{}
+	for _, h := range hooks.list {
+		if h.event == event && h.table == table.Name && (h.db == "" || h.db == db) {
+			found = append(found, h.hook)
+		}
+	}
+	return found
+}
+
+// runHooks runs the hooks of a write to the table.
+// Hooks declared in the schema run after the registered hooks before a write, and before them after a write.
+func runHooks(ctx *HookCtx) error {
+	registered := registeredHooks(ctx.Table, ctx.Event)
+	if ctx.Event.isBefore() {
+		for _, hook := range registered {
+			if err := hook(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	updateCounters(ctx)
+	for _, hook := range registered {
+		if err := hook(ctx); err != nil {
+			pkg.ErrorLog("hook", ctx.Event, "on table", ctx.Table.Name, "failed:", err)
+		}
+	}
+	return nil
+}
+
+// AfterExpired runs the afterDelete hooks of a row deleted because it expired, such as its counters.
+// An expired row is deleted whether or not hooks would reject it, so the beforeDelete hooks are not run.
+func AfterExpired(table *builder.Table, row builder.TDBTableRow) {
+	runHooks(&HookCtx{Table: table, Event: HookAfterDelete, Before: row})
+}
+
+// beforeWrite runs the hooks before a create or update and returns the input to write
+func beforeWrite(table *builder.Table, event HookEvent, before builder.TDBTableRow, data QueryArg) (QueryArg, error) {
+	ctx := &HookCtx{Table: table, Event: event, Data: maps.Clone(data), Before: before}
+	if ctx.Data == nil {
+		ctx.Data = QueryArg{}
+	}
+	if err := runHooks(ctx); err != nil {
+		return nil, err
+	}
+	return ctx.Data, nil
+}
+
+// applyCopies sets the fields of a row with the copy prop to the value of the field they copy.
+// Copies of fields of a related row are only set when the relation field is part of data.
+func applyCopies(table *builder.Table, row builder.TDBTableRow, data QueryArg) {
+	for _, field := range table.Fields.Idx {
+		value, ok := field.Properties.Get(props.FieldPropCopy).(string)
+		if !ok {
+			continue
+		}
+
+		rel_field_name, source := parser.ParseCopyProp(value)
+		if rel_field_name == "" {
+			row.Set(field.Name, row.Get(source))
+			continue
+		}
+		if !data.Has(rel_field_name) {
+			continue
+		}
+
+		var copied any
+		if related := relatedRow(table, table.Fields.Get(rel_field_name), row.Get(rel_field_name)); related != nil {
+			copied = related.Get(source)
+		}
+		row.Set(field.Name, copied)
+	}
+}
+
+// updateCounters keeps the fields named by counter props of related rows in step with the rows that point to them
+func updateCounters(ctx *HookCtx) {
+	for _, field := range ctx.Table.Fields.Idx {
+		counter, ok := field.Properties.Get(props.FieldPropCounter).(string)
+		if !ok {
+			continue
+		}
+
+		var old_value, new_value any
+		if ctx.Before != nil {
+			old_value = ctx.Before.Get(field.Name)
+		}
+		if ctx.After != nil {
+			new_value = ctx.After.Get(field.Name)
+		}
+		if ctx.Before != nil && ctx.After != nil && field.Compare(old_value, new_value) {
+			continue
+		}
+
+		for _, c := range []struct {
+			value any
+			op    string
+		}{{old_value, "decrement"}, {new_value, "increment"}} {
+			related := relatedRow(ctx.Table, field, c.value)
+			if related == nil {
+				continue
+			}
+			rel_table_name, _ := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+			_, err := Update(ctx.Table.Schema.Tables.Get(rel_table_name), related, QueryArg{counter: map[string]any{c.op: 1}}, "")
+			if err != nil {
+				pkg.ErrorLog("counter", field.Name, "on table", ctx.Table.Name, "failed:", err)
+			}
+		}
+	}
+}
+
+// relatedRow returns the row a non-vector relation field with the value points to, or nil when there is none
+func relatedRow(table *builder.Table, field *builder.Field, value any) builder.TDBTableRow {
+	if value == nil || field.BuiltinType == types.FieldTypeVector {
+		return nil
+	}
+	rel_table_name, rel_field_name := parser.ParseRelationProp(field.Properties.Get(props.FieldPropRelation).(string))
+	rel_table := table.Schema.Tables.Get(rel_table_name)
+	if rel_table.Fields.Get(rel_field_name).IndexLevel() == builder.IndexLevelPrimary {
+		return rel_table.Row(pkg.NumToInt(value))
+	}
+	row, err := findFirst(rel_table, rel_field_name, value)
+	if err != nil {
+		return nil
+	}
+	return row
+}
@@ -0,0 +1,174 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+)
+
+type OrderBy string
+
+const (
+	OrderByAsc  OrderBy = "asc"
+	OrderByDesc OrderBy = "desc"
+)
+
+type OrderByNulls string
+
+const (
+	OrderByNullsFirst OrderByNulls = "first"
+	OrderByNullsLast  OrderByNulls = "last"
+)
+
+type OrderByField struct {
+	Field string
+	Order OrderBy
+	// where nil values are placed.
+	// defaults to first for ascending order and last for descending order.
+	Nulls OrderByNulls
+}
+
+// OrderByList is an ordered list of fields to sort rows by.
+// Earlier fields take precedence over later ones.
+//
+// It can be decoded from either a list or a single object:
+//
+//	[{"lastName": "asc"}, {"createdAt": {"sort": "desc", "nulls": "last"}}]
+//	{"lastName": "asc", "createdAt": "desc"}
+//
+// In both cases fields are used in the order they are written.
+type OrderByList []OrderByField
+
+func (l *OrderByList) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*l = OrderByList{}
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+	case bytes.HasPrefix(data, []byte("[")):
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := l.parseObject(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return l.parseObject(data)
+	}
+}
+
+// parseObject reads the keys of a json object in the order they are written
+func (l *OrderByList) parseObject(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("Invalid orderBy: expected object")
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		o := OrderByField{Field: t.(string)}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			var opts struct {
+				Sort  OrderBy      `json:"sort"`
+				Nulls OrderByNulls `json:"nulls"`
+			}
+			if err := json.Unmarshal(raw, &opts); err != nil {
+				return err
+			}
+			o.Order, o.Nulls = opts.Sort, opts.Nulls
+		} else if err := json.Unmarshal(raw, &o.Order); err != nil {
+			return err
+		}
+
+		if o.Order == "" {
+			o.Order = OrderByAsc
+		}
+		if o.Order != OrderByAsc && o.Order != OrderByDesc {
+			return fmt.Errorf("Invalid orderBy for %s: %s", o.Field, o.Order)
+		}
+		if o.Nulls != "" && o.Nulls != OrderByNullsFirst && o.Nulls != OrderByNullsLast {
+			return fmt.Errorf("Invalid orderBy nulls for %s: %s", o.Field, o.Nulls)
+		}
+		*l = append(*l, o)
+	}
+	return nil
+}
+
+// orderKeys returns the order by fields that exist on the table,
+// with the default nulls placement filled in.
+func orderKeys(table *builder.Table, order_by OrderByList) []OrderByField {
+	keys := []OrderByField{}
+	for _, o := range order_by {
+		if !table.Fields.Has(o.Field) {
+			continue
+		}
+		if o.Nulls == "" {
+			o.Nulls = OrderByNullsFirst
+			if o.Order == OrderByDesc {
+				o.Nulls = OrderByNullsLast
+			}
+		}
+		keys = append(keys, o)
+	}
+	return keys
+}
+
+// compareRows returns -1, 0 or 1 depending on whether a sorts before, with or after b.
+// The primary key is always used as the final tie-breaker so the order is total.
+func compareRows(table *builder.Table, keys []OrderByField, a, b builder.TDBTableRow) int {
+	for _, key := range keys {
+		field := table.Fields.Get(key.Field)
+		x, y := a.Get(field.Name), b.Get(field.Name)
+
+		if x == nil || y == nil {
+			if x == nil && y == nil {
+				continue
+			}
+			// nulls are placed the same way regardless of the sort direction
+			if (x == nil) == (key.Nulls == OrderByNullsFirst) {
+				return -1
+			}
+			return 1
+		}
+
+		c := field.CompareOrder(x, y)
+		if key.Order == OrderByDesc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	pa, pb := builder.GetPrimaryKey(a), builder.GetPrimaryKey(b)
+	if pa < pb {
+		return -1
+	} else if pa > pb {
+		return 1
+	}
+	return 0
+}
+
+func sortRows(table *builder.Table, keys []OrderByField, rows []builder.TDBTableRow) []builder.TDBTableRow {
+	sort.Slice(rows, func(i, j int) bool {
+		return compareRows(table, keys, rows[i], rows[j]) < 0
+	})
+	return rows
+}
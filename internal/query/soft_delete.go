@@ -0,0 +1,79 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/tobsdb/tobsdb/internal/builder"
+	"github.com/tobsdb/tobsdb/pkg"
+)
+
+// FindDeleted returns the soft deleted rows that match where, or every soft deleted row when where is empty
+func FindDeleted(ctx context.Context, table *builder.Table, where QueryArg) ([]builder.TDBTableRow, error) {
+	found, err := findManyUtil(ctx, table, where, true, true)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.Filter(found, builder.IsDeleted), nil
+}
+
+// findDeletedRow returns a soft deleted row matching where by scanning for its value of the unique field index
+func findDeletedRow(table *builder.Table, index string, where QueryArg) builder.TDBTableRow {
+	found, err := filterRows(context.Background(), table, index, where.Get(index), true)
+	if err != nil {
+		return nil
+	}
+	for _, row := range found {
+		if builder.IsDeleted(row) && compareUtil(table, row, where) {
+			return row
+		}
+	}
+	return nil
+}
+
+// Restore undoes the soft delete of rows and adds their unique values back to the indexes.
+// Every row is checked before any row is restored, so either all the rows are restored or none of them are.
+// A row can't be restored while another row uses one of its unique values.
+func Restore(table *builder.Table, rows []builder.TDBTableRow) ([]builder.TDBTableRow, error) {
+	batch := newCreateBatch(table)
+	for i, row := range rows {
+		for _, field := range table.Fields.Idx {
+			value := row.Get(field.Name)
+			if value == nil || field.IndexLevel() < builder.IndexLevelUnique {
+				continue
+			}
+			err := validateUnique(table, field, value)
+			if err == nil {
+				err = batch.validateUnique(field, value)
+			}
+			if err != nil {
+				return nil, NewQueryError(err.(*QueryError).Status(), fmt.Sprintf("row %d: %s", i, err.Error()))
+			}
+		}
+		batch.push(row)
+	}
+
+	restored := make([]builder.TDBTableRow, 0, len(rows))
+	now := time.Now()
+	for _, row := range rows {
+		row := maps.Clone(row)
+		row.Delete(builder.SYS_DELETED_AT)
+		builder.SetVersion(row, builder.GetVersion(row)+1)
+		table.SetValidFrom(row, now)
+		table.Rows().Replace(builder.GetPrimaryKey(row), row)
+		indexRow(table, row)
+		table.RecordChange(builder.ChangeOperationCreate, nil, row, now)
+		runHooks(&HookCtx{Table: table, Event: HookAfterCreate, After: row})
+		restored = append(restored, row)
+	}
+	return restored, nil
+}
+
+// Purge deletes soft deleted rows for good
+func Purge(table *builder.Table, rows []builder.TDBTableRow) {
+	for _, row := range rows {
+		table.Rows().Delete(builder.GetPrimaryKey(row))
+	}
+}
@@ -1,9 +1,12 @@
 package query
 
 import (
+	"context"
 	"fmt"
+	"maps"
 	"net/http"
 	"slices"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
 	"github.com/tobsdb/tobsdb/internal/props"
@@ -27,6 +30,34 @@ func (q QueryArg) Get(key string) any {
 }
 
 func Create(table *builder.Table, data QueryArg) (builder.TDBTableRow, error) {
+	data, err := beforeWrite(table, HookBeforeCreate, nil, data)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := buildRow(table, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	applyCopies(table, row, data)
+
+	primary_key := table.CreateId()
+	setRowKey(table, row, primary_key)
+	builder.SetVersion(row, 1)
+	now := time.Now()
+	table.SetExpiry(row, now)
+	table.SetValidFrom(row, now)
+	indexRow(table, row)
+
+	table.Rows().Insert(primary_key, row)
+	table.RecordChange(builder.ChangeOperationCreate, nil, row, now)
+	runHooks(&HookCtx{Table: table, Event: HookAfterCreate, Data: data, After: row})
+	return row, nil
+}
+
+// buildRow validates data and returns the row it would create without writing anything.
+// Unique values are also checked against the rows already in batch, when given.
+func buildRow(table *builder.Table, data QueryArg, batch *createBatch) (builder.TDBTableRow, error) {
 	row := make(builder.TDBTableRow)
 	for _, field := range table.Fields.Idx {
 		input := data.Get(field.Name)
@@ -36,13 +67,19 @@ func Create(table *builder.Table, data QueryArg) (builder.TDBTableRow, error) {
 			}
 			continue
 		}
+		if field.Properties.Has(props.FieldPropCopy) {
+			if input != nil {
+				return nil, NewQueryError(http.StatusForbidden, fmt.Sprintf("%s is a copy and cannot be explicitly set", field.Name))
+			}
+			continue
+		}
 
 		res, err := field.ValidateType(input, true)
 		if err != nil {
 			return nil, err
 		}
 
-		if field.Properties.Has(props.FieldPropRelation) {
+		if field.Properties.Has(props.FieldPropRelation) && !batch.hasRelation(field, res) {
 			err := validateRelation(table, field, nil, res)
 			if err != nil {
 				return nil, err
@@ -54,18 +91,27 @@ func Create(table *builder.Table, data QueryArg) (builder.TDBTableRow, error) {
 			if err != nil {
 				return nil, err
 			}
+			err = batch.validateUnique(field, res)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		row.Set(field.Name, res)
 	}
+	return row, nil
+}
 
-	primary_key := table.CreateId()
+func setRowKey(table *builder.Table, row builder.TDBTableRow, primary_key int) {
 	builder.SetPrimaryKey(row, primary_key)
 	primary_key_field := table.PrimaryKey()
 	if primary_key_field != nil {
 		row.Set(primary_key_field.Name, primary_key)
 	}
+}
 
+func indexRow(table *builder.Table, row builder.TDBTableRow) {
+	primary_key := builder.GetPrimaryKey(row)
 	for _, index := range table.Indexes {
 		field := table.Fields.Get(index)
 		if field.IndexLevel() == builder.IndexLevelPrimary {
@@ -77,12 +123,16 @@ func Create(table *builder.Table, data QueryArg) (builder.TDBTableRow, error) {
 		}
 		table.IndexMap(index).Set(value, primary_key)
 	}
-
-	table.Rows().Insert(primary_key, row)
-	return row, nil
 }
 
-func Update(table *builder.Table, row builder.TDBTableRow, data QueryArg) (builder.TDBTableRow, error) {
+// Update writes data to the row and returns the updated row.
+// actor is the id of the user making the change, kept in the table's history.
+func Update(table *builder.Table, row builder.TDBTableRow, data QueryArg, actor string) (builder.TDBTableRow, error) {
+	data, err := beforeWrite(table, HookBeforeUpdate, row, data)
+	if err != nil {
+		return nil, err
+	}
+
 	res := make(builder.TDBTableRow)
 	for _, field := range table.Fields.Idx {
 		if !data.Has(field.Name) {
@@ -92,6 +142,9 @@ func Update(table *builder.Table, row builder.TDBTableRow, data QueryArg) (build
 		if field.IndexLevel() == builder.IndexLevelPrimary {
 			return nil, NewQueryError(http.StatusForbidden, "primary key cannot be updated")
 		}
+		if field.Properties.Has(props.FieldPropCopy) {
+			return nil, NewQueryError(http.StatusForbidden, fmt.Sprintf("%s is a copy and cannot be updated", field.Name))
+		}
 
 		input := data.Get(field.Name)
 
@@ -164,6 +217,13 @@ func Update(table *builder.Table, row builder.TDBTableRow, data QueryArg) (build
 
 	primary_key := builder.GetPrimaryKey(row)
 	res = pkg.Map[string, any](pkg.MergeMaps(row, res))
+	applyCopies(table, res, data)
+	builder.SetVersion(res, builder.GetVersion(row)+1)
+	now := time.Now()
+	if err := table.AppendHistory(row, builder.HistoryOperationUpdate, actor, now); err != nil {
+		return nil, err
+	}
+	table.SetValidFrom(res, now)
 	for _, index := range table.Indexes {
 		field := table.Fields.Get(index)
 		if field.IndexLevel() == builder.IndexLevelPrimary {
@@ -184,14 +244,50 @@ func Update(table *builder.Table, row builder.TDBTableRow, data QueryArg) (build
 	}
 
 	table.Rows().Replace(primary_key, res)
+	table.RecordChange(builder.ChangeOperationUpdate, row, res, now)
+	runHooks(&HookCtx{Table: table, Event: HookAfterUpdate, Data: data, Before: row, After: res})
 	return res, nil
 }
 
+// Upsert updates the row matching the unique constraints in where with update,
+// or creates a new row from create when there is no such row.
+// It reports whether a new row was created.
+//
+// Callers must hold the schema's write lock so no row is created in between the lookup and the write.
+func Upsert(table *builder.Table, where, create, update QueryArg, actor string) (builder.TDBTableRow, bool, error) {
+	row, err := FindUnique(table, where)
+	if err != nil {
+		if query_error, ok := err.(*QueryError); !ok || query_error.Status() != http.StatusNotFound {
+			return nil, false, err
+		}
+		row, err := Create(table, create)
+		if err != nil {
+			return nil, false, err
+		}
+		return row, true, nil
+	}
+
+	row, err = Update(table, row, update, actor)
+	if err != nil {
+		return nil, false, err
+	}
+	return row, false, nil
+}
+
 // Note: returns a nil value when no row is found(does not throw errow).
 // Always make sure to account for this case
 func FindUnique(table *builder.Table, where QueryArg) (builder.TDBTableRow, error) {
+	return findUnique(table, where, false)
+}
+
+// FindUniqueIncludeDeleted is FindUnique that also finds soft deleted rows
+func FindUniqueIncludeDeleted(table *builder.Table, where QueryArg) (builder.TDBTableRow, error) {
+	return findUnique(table, where, true)
+}
+
+func findUnique(table *builder.Table, where QueryArg, include_deleted bool) (builder.TDBTableRow, error) {
 	if len(where) == 0 {
-		return nil, fmt.Errorf("Where constraints cannot be empty")
+		return nil, ERR_EMPTY_WHERE
 	}
 
 	for _, index := range table.Indexes {
@@ -206,13 +302,19 @@ func FindUnique(table *builder.Table, where QueryArg) (builder.TDBTableRow, erro
 		} else {
 			index_map := table.IndexMap(index)
 			if !index_map.Has(input) {
+				// soft deleted rows are not in the unique indexes
+				if include_deleted && table.SoftDeletes() {
+					if found := findDeletedRow(table, index, where); found != nil {
+						return found, nil
+					}
+				}
 				return nil, NewQueryError(404, fmt.Sprintf("No row found with constraint %v in table %s", where, table.Name))
 			}
 			id = pkg.NumToInt(index_map.Get(input))
 		}
 
 		found := table.Row(id)
-		if found != nil && compareUtil(table, found, where) {
+		if found != nil && isVisible(table, found, time.Now(), include_deleted) && compareUtil(table, found, where) {
 			return found, nil
 		}
 
@@ -226,38 +328,100 @@ func FindUnique(table *builder.Table, where QueryArg) (builder.TDBTableRow, erro
 	}
 }
 
-func Find(table *builder.Table, where QueryArg, allow_empty_where bool) ([]builder.TDBTableRow, error) {
-	return findManyUtil(table, where, allow_empty_where)
+func Find(ctx context.Context, table *builder.Table, where QueryArg, allow_empty_where bool) ([]builder.TDBTableRow, error) {
+	return findManyUtil(ctx, table, where, allow_empty_where, false)
 }
 
 type FindArgs struct {
 	Where   QueryArg
 	Take    int
 	Skip    int
-	OrderBy map[string]OrderBy
+	OrderBy OrderByList
 	Cursor  QueryArg
+	// After is an opaque cursor returned by a previous call; see NewCursor
+	After string
+	// only keep the first row for each distinct tuple of these fields
+	Distinct []string
+	// also return soft deleted rows
+	IncludeDeleted bool
+	// find the rows as they were at this time, in tables that keep history
+	AsOf *time.Time
 }
 
-func FindWithArgs(table *builder.Table, args FindArgs, allow_empty_where bool) ([]builder.TDBTableRow, error) {
-	res, err := findManyUtil(table, args.Where, allow_empty_where)
-	if err != nil {
-		return []builder.TDBTableRow{}, nil
+// seekLimit returns the number of rows a seek must find for the page, or 0 when it must find them all
+func seekLimit(args FindArgs) int {
+	// distinct rows and the cursor row are only known once every row is found
+	if args.Take == 0 || len(args.Distinct) > 0 || args.Cursor != nil {
+		return 0
 	}
+	return args.Skip + args.Take
+}
 
-	if args.OrderBy != nil {
-		for field, order := range args.OrderBy {
-			if !table.Fields.Has(field) {
-				continue
-			}
-			res = sortRowsByField(table.Fields.Get(field), res, order)
+func FindWithArgs(ctx context.Context, table *builder.Table, args FindArgs, allow_empty_where bool) ([]builder.TDBTableRow, error) {
+	keys := orderKeys(table, args.OrderBy)
+
+	if len(args.Distinct) > 0 {
+		if err := validateDistinctFields(table, args.Distinct); err != nil {
+			return nil, err
+		}
+	}
+
+	var after *cursorToken
+	if args.After != "" {
+		c, err := decodeCursor(table, args.OrderBy, args.After)
+		if err != nil {
+			return nil, err
 		}
+		after = c
+	}
+
+	var res []builder.TDBTableRow
+	if args.AsOf != nil {
+		if !allow_empty_where && len(args.Where) == 0 {
+			return []builder.TDBTableRow{}, nil
+		}
+		found, err := findAsOf(ctx, table, args.Where, *args.AsOf, args.IncludeDeleted)
+		if err != nil {
+			return nil, err
+		}
+		res = sortRows(table, keys, found)
+	} else if after != nil && len(keys) == 0 {
+		// rows are in primary key order so the next page can be read from the primary index
+		res = seekAfterCursor(table, args.Where, after, seekLimit(args), args.IncludeDeleted)
+	} else if after != nil && canSeekIndex(table, keys, after, args.IncludeDeleted) {
+		// rows are in the order of a unique index so the next page can be read from it
+		found, err := seekIndexAfterCursor(ctx, table, args.Where, keys[0], after, seekLimit(args))
+		if err != nil {
+			return nil, err
+		}
+		res = found
+	} else {
+		found, err := findManyUtil(ctx, table, args.Where, allow_empty_where, args.IncludeDeleted)
+		if err == ERR_EMPTY_WHERE {
+			return []builder.TDBTableRow{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = sortRows(table, keys, found)
+	}
+
+	if after != nil && (len(keys) > 0 || args.AsOf != nil) {
+		cursor_row := after.Row()
+		res = pkg.Filter(res, func(row builder.TDBTableRow) bool {
+			return compareRows(table, keys, row, cursor_row) > 0
+		})
+	}
+
+	if len(args.Distinct) > 0 {
+		res = distinctRows(table, args.Distinct, res)
 	}
 
 	if args.Cursor != nil {
 		cursor_idx := slices.IndexFunc(res, func(row builder.TDBTableRow) bool {
 			return compareUtil(table, row, args.Cursor)
 		})
-		if cursor_idx > 0 {
+		if cursor_idx >= 0 {
 			res = res[cursor_idx:]
 		}
 	}
@@ -279,12 +443,39 @@ func FindWithArgs(table *builder.Table, args FindArgs, allow_empty_where bool) (
 	return res, nil
 }
 
-func Delete(table *builder.Table, row builder.TDBTableRow) {
+// Delete deletes the row and returns it.
+// In tables with the softDelete prop the row is only marked as deleted
+// and its unique values can be used by other rows; see Restore and Purge.
+// actor is the id of the user making the change, kept in the table's history.
+func Delete(table *builder.Table, row builder.TDBTableRow, actor string) (builder.TDBTableRow, error) {
+	if err := runHooks(&HookCtx{Table: table, Event: HookBeforeDelete, Before: row}); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := table.AppendHistory(row, builder.HistoryOperationDelete, actor, now); err != nil {
+		return nil, err
+	}
+
 	for _, index := range table.Indexes {
 		if !row.Has(index) || table.Fields.Get(index).IndexLevel() < builder.IndexLevelUnique {
 			continue
 		}
 		table.IndexMap(index).Delete(row.Get(index))
 	}
+
+	if table.SoftDeletes() {
+		deleted := maps.Clone(row)
+		deleted.Set(builder.SYS_DELETED_AT, now)
+		builder.SetVersion(deleted, builder.GetVersion(row)+1)
+		table.SetValidFrom(deleted, now)
+		table.Rows().Replace(builder.GetPrimaryKey(row), deleted)
+		table.RecordChange(builder.ChangeOperationDelete, row, nil, now)
+		runHooks(&HookCtx{Table: table, Event: HookAfterDelete, Before: row})
+		return deleted, nil
+	}
 	table.Rows().Delete(builder.GetPrimaryKey(row))
+	table.RecordChange(builder.ChangeOperationDelete, row, nil, now)
+	runHooks(&HookCtx{Table: table, Event: HookAfterDelete, Before: row})
+	return row, nil
 }
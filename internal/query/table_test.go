@@ -1,12 +1,18 @@
 package query_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
 	. "github.com/tobsdb/tobsdb/internal/query"
+	"github.com/tobsdb/tobsdb/pkg"
 	"gotest.tools/assert"
 )
 
@@ -98,6 +104,61 @@ $TABLE b {
 	})
 }
 
+func TestCreateMany(t *testing.T) {
+	t.Run("relation within batch", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    a Int unique(true)
+    b Int relation(a.a) optional(true)
+}
+            `, nil, false)
+		table := schema.Tables.Get("a")
+		rows, _, err := CreateMany(table, []QueryArg{{"a": 1}, {"a": 2, "b": 1}}, false)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(rows), 2)
+		assert.Equal(t, table.Rows().Len(), 2)
+	})
+
+	t.Run("failed batch restores counters", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    a Int default(autoincrement)
+    b String
+}
+            `, nil, false)
+		table := schema.Tables.Get("a")
+		_, _, err := CreateMany(table, []QueryArg{{"b": "x"}, {"b": 1}}, false)
+		assert.ErrorContains(t, err, "row 1")
+
+		row, err := Create(table, QueryArg{"b": "x"})
+		assert.NilError(t, err)
+		assert.Equal(t, row.Get("a"), 1)
+		assert.Equal(t, builder.GetPrimaryKey(row), 1)
+	})
+
+	t.Run("large batch", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b Int unique(true)
+}
+            `, nil, false)
+		table := schema.Tables.Get("a")
+		data := []QueryArg{}
+		for i := 0; i < 1000; i++ {
+			data = append(data, QueryArg{"b": i})
+		}
+		rows, skipped, err := CreateMany(table, data, true)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(rows), 1000)
+		assert.Equal(t, len(skipped), 0)
+		found, err := FindUnique(table, QueryArg{"b": 999})
+		assert.NilError(t, err)
+		assert.Equal(t, builder.GetPrimaryKey(found), 1000)
+	})
+}
+
 func TestUpdate(t *testing.T) {
 	t.Run("update", func(t *testing.T) {
 		schema, _ := builder.NewSchemaFromString(`
@@ -111,7 +172,7 @@ $TABLE a {
 
 		assert.Equal(t, row.Get("b"), "hello")
 
-		new_row, err := Update(table, row, QueryArg{"c": 69})
+		new_row, err := Update(table, row, QueryArg{"c": 69}, "")
 
 		assert.NilError(t, err)
 		assert.Equal(t, new_row.Get("b"), "hello")
@@ -119,6 +180,30 @@ $TABLE a {
 		assert.Equal(t, table.IndexMap("b").Get("hello"), new_row.Get(builder.SYS_PRIMARY_KEY))
 	})
 
+	t.Run("version", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b String
+}
+        `, nil, false)
+		table := schema.Tables.Get("a")
+		row, _ := Create(table, QueryArg{"b": "hello"})
+		assert.Equal(t, row.Get(builder.SYS_VERSION), 1)
+
+		new_row, err := Update(table, row, QueryArg{"b": "world"}, "")
+		assert.NilError(t, err)
+		assert.Equal(t, new_row.Get(builder.SYS_VERSION), 2)
+		assert.Equal(t, table.Row(1).Get(builder.SYS_VERSION), 2)
+
+		assert.NilError(t, CheckVersion(new_row, 2))
+		err = CheckVersion(new_row, 1)
+		assert.ErrorContains(t, err, "Row 1 changed: version is 2, expected 1")
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusConflict)
+
+		// rows written before row versions
+		assert.NilError(t, CheckVersion(builder.TDBTableRow{builder.SYS_PRIMARY_KEY: 2}, 1))
+	})
+
 	t.Run("duplicate unique field", func(t *testing.T) {
 		schema, _ := builder.NewSchemaFromString(`
 $TABLE a {
@@ -131,13 +216,70 @@ $TABLE a {
 
 		assert.Equal(t, row.Get("b"), "world")
 
-		_, err := Update(table, row, QueryArg{"b": "hello"})
+		_, err := Update(table, row, QueryArg{"b": "hello"}, "")
 
 		assert.ErrorContains(t, err, "already exists")
 		assert.Equal(t, err.(*QueryError).Status(), http.StatusConflict)
 	})
 }
 
+func TestUpsert(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b String unique(true)
+    c Int
+}
+        `, nil, false)
+	table := schema.Tables.Get("a")
+
+	row, created, err := Upsert(table, QueryArg{"b": "hello"}, QueryArg{"b": "hello", "c": 1}, QueryArg{"c": 2}, "")
+	assert.NilError(t, err)
+	assert.Assert(t, created)
+	assert.Equal(t, row.Get("c"), 1)
+
+	row, created, err = Upsert(table, QueryArg{"b": "hello"}, QueryArg{"b": "hello", "c": 1}, QueryArg{"c": 2}, "")
+	assert.NilError(t, err)
+	assert.Assert(t, !created)
+	assert.Equal(t, row.Get("c"), 2)
+	assert.Equal(t, table.Rows().Len(), 1)
+
+	t.Run("invalid create", func(t *testing.T) {
+		_, _, err := Upsert(table, QueryArg{"b": "world"}, QueryArg{"b": "world"}, QueryArg{"c": 2}, "")
+		assert.ErrorContains(t, err, "Invalid field type for c")
+		assert.Equal(t, table.Rows().Len(), 1)
+	})
+
+	t.Run("no unique constraint", func(t *testing.T) {
+		_, _, err := Upsert(table, QueryArg{"c": 2}, QueryArg{"b": "world", "c": 2}, QueryArg{"c": 3}, "")
+		assert.ErrorContains(t, err, "Unique fields not included")
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		wg := sync.WaitGroup{}
+		created_count := atomic.Int32{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pkg.LockWrap(schema, func() {
+					_, created, err := Upsert(table, QueryArg{"b": "concurrent"},
+						QueryArg{"b": "concurrent", "c": 0}, QueryArg{"c": map[string]any{"increment": 1}}, "")
+					assert.NilError(t, err)
+					if created {
+						created_count.Add(1)
+					}
+				})
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, created_count.Load(), int32(1))
+		row, err := FindUnique(table, QueryArg{"b": "concurrent"})
+		assert.NilError(t, err)
+		assert.Equal(t, row.Get("c"), 9)
+	})
+}
+
 func TestFindUnique(t *testing.T) {
 	t.Run("find unique", func(t *testing.T) {
 		schema, _ := builder.NewSchemaFromString(`
@@ -186,7 +328,7 @@ $TABLE a {
 		Create(table, QueryArg{"b": "b2", "c": 2})
 		Create(table, QueryArg{"b": "b3", "c": 3})
 
-		found, err := Find(table, QueryArg{"c": map[string]any{"gte": 2}}, false)
+		found, err := Find(context.Background(), table, QueryArg{"c": map[string]any{"gte": 2}}, false)
 
 		assert.NilError(t, err)
 		assert.Equal(t, len(found), 2)
@@ -200,10 +342,28 @@ $TABLE a {
     `, nil, false)
 		table := schema.Tables.Get("a")
 
-		_, err := Find(table, QueryArg{}, false)
+		_, err := Find(context.Background(), table, QueryArg{}, false)
 
 		assert.Error(t, err, "Where constraints cannot be empty")
 	})
+
+	t.Run("canceled", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b String unique(true)
+    c Int optional(true)
+}
+    `, nil, false)
+		table := schema.Tables.Get("a")
+		Create(table, QueryArg{"b": "b", "c": 1})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Find(ctx, table, QueryArg{"c": 1}, false)
+		assert.Equal(t, err, context.Canceled)
+		_, err = FindWithArgs(ctx, table, FindArgs{}, true)
+		assert.Equal(t, err, context.Canceled)
+	})
 }
 
 func TestFindWithArgs(t *testing.T) {
@@ -218,9 +378,9 @@ $TABLE a {
 	}
 
 	t.Run("order by desc", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
 			Where:   QueryArg{"b": map[string]any{"gt": 5, "lte": 10}},
-			OrderBy: map[string]OrderBy{"b": OrderByDesc},
+			OrderBy: OrderByList{{Field: "b", Order: OrderByDesc}},
 		}, false)
 
 		assert.NilError(t, err)
@@ -236,7 +396,7 @@ $TABLE a {
 	})
 
 	t.Run("cursor", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
 			Where:  QueryArg{"b": map[string]any{"lt": 15}},
 			Cursor: QueryArg{"b": 10},
 		}, false)
@@ -250,7 +410,7 @@ $TABLE a {
 	})
 
 	t.Run("take", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
 			Take: 5,
 		}, true)
 
@@ -263,7 +423,7 @@ $TABLE a {
 	})
 
 	t.Run("skip", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
 			Skip: 5,
 		}, true)
 
@@ -276,7 +436,7 @@ $TABLE a {
 	})
 
 	t.Run("over-skip", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
 			Skip: 25,
 		}, true)
 
@@ -284,9 +444,59 @@ $TABLE a {
 		assert.Equal(t, len(found), 0)
 	})
 
+	t.Run("cursor on first row", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
+			Where:  QueryArg{"b": map[string]any{"gte": 10}},
+			Cursor: QueryArg{"b": 10},
+			Skip:   1,
+		}, false)
+
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 10)
+		assert.Equal(t, found[0].Get("b"), 11)
+	})
+
+	t.Run("cursor token", func(t *testing.T) {
+		page, err := FindWithArgs(context.Background(), table, FindArgs{Take: 5}, true)
+		assert.NilError(t, err)
+		cursor, err := NewCursor(table, nil, page[len(page)-1])
+		assert.NilError(t, err)
+
+		page, err = FindWithArgs(context.Background(), table, FindArgs{Take: 5, After: cursor}, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(page), 5)
+		for i, row := range page {
+			assert.Equal(t, row.Get("b"), i+6)
+		}
+	})
+
+	t.Run("cursor token with order by", func(t *testing.T) {
+		order_by := OrderByList{{Field: "b", Order: OrderByDesc}}
+		page, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 5}, true)
+		assert.NilError(t, err)
+		cursor, err := NewCursor(table, order_by, page[len(page)-1])
+		assert.NilError(t, err)
+
+		page, err = FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 5, After: cursor}, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(page), 5)
+		for i, row := range page {
+			assert.Equal(t, row.Get("b"), 15-i)
+		}
+
+		_, err = FindWithArgs(context.Background(), table, FindArgs{Take: 5, After: cursor}, true)
+		assert.ErrorContains(t, err, "Cursor does not match orderBy")
+	})
+
+	t.Run("invalid cursor token", func(t *testing.T) {
+		_, err := FindWithArgs(context.Background(), table, FindArgs{After: "not a cursor"}, true)
+		assert.ErrorContains(t, err, "Invalid cursor")
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusBadRequest)
+	})
+
 	t.Run("order by and cursor and take", func(t *testing.T) {
-		found, err := FindWithArgs(table, FindArgs{
-			OrderBy: map[string]OrderBy{"b": OrderByDesc},
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
+			OrderBy: OrderByList{{Field: "b", Order: OrderByDesc}},
 			Cursor:  QueryArg{"b": 10},
 			Take:    5,
 		}, true)
@@ -300,6 +510,274 @@ $TABLE a {
 	})
 }
 
+func TestFindWithOrderBy(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    last  String
+    first String optional(true)
+    ok    Bool
+    v     Vector vector(Int)
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	Create(table, QueryArg{"last": "b", "first": "x", "ok": true, "v": []any{1, 2}})
+	Create(table, QueryArg{"last": "a", "first": "y", "ok": false, "v": []any{1}})
+	Create(table, QueryArg{"last": "b", "ok": false, "v": []any{0, 5}})
+	Create(table, QueryArg{"last": "a", "first": "z", "ok": true, "v": []any{2}})
+
+	ids := func(rows []builder.TDBTableRow) []int {
+		res := []int{}
+		for _, row := range rows {
+			res = append(res, builder.GetPrimaryKey(row))
+		}
+		return res
+	}
+
+	t.Run("multiple fields", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			found, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: OrderByList{
+				{Field: "last", Order: OrderByAsc},
+				{Field: "first", Order: OrderByDesc},
+			}}, true)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, ids(found), []int{4, 2, 1, 3})
+		}
+	})
+
+	t.Run("nulls first", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: OrderByList{
+			{Field: "first", Order: OrderByDesc, Nulls: OrderByNullsFirst},
+		}}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(found), []int{3, 4, 2, 1})
+	})
+
+	t.Run("nulls last", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: OrderByList{
+			{Field: "first", Order: OrderByAsc, Nulls: OrderByNullsLast},
+		}}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(found), []int{1, 2, 4, 3})
+	})
+
+	t.Run("bool", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: OrderByList{
+			{Field: "ok", Order: OrderByAsc},
+		}}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(found), []int{2, 3, 1, 4})
+	})
+
+	t.Run("vector", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: OrderByList{
+			{Field: "v", Order: OrderByAsc},
+		}}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(found), []int{3, 2, 1, 4})
+	})
+
+	t.Run("cursor with nulls", func(t *testing.T) {
+		order_by := OrderByList{{Field: "first", Order: OrderByAsc}}
+		page, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 2}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(page), []int{3, 1})
+		cursor, err := NewCursor(table, order_by, page[0])
+		assert.NilError(t, err)
+
+		page, err = FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, After: cursor}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, ids(page), []int{1, 2, 4})
+	})
+}
+
+func TestOrderByListUnmarshal(t *testing.T) {
+	t.Run("list", func(t *testing.T) {
+		var l OrderByList
+		err := json.Unmarshal([]byte(`[{"lastName": "asc"}, {"createdAt": {"sort": "desc", "nulls": "last"}}]`), &l)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, l, OrderByList{
+			{Field: "lastName", Order: OrderByAsc},
+			{Field: "createdAt", Order: OrderByDesc, Nulls: OrderByNullsLast},
+		})
+	})
+
+	t.Run("object keeps key order", func(t *testing.T) {
+		var l OrderByList
+		err := json.Unmarshal([]byte(`{"z": "desc", "a": "asc", "m": "desc"}`), &l)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, l, OrderByList{
+			{Field: "z", Order: OrderByDesc},
+			{Field: "a", Order: OrderByAsc},
+			{Field: "m", Order: OrderByDesc},
+		})
+	})
+
+	t.Run("invalid order", func(t *testing.T) {
+		var l OrderByList
+		err := json.Unmarshal([]byte(`[{"a": "up"}]`), &l)
+		assert.ErrorContains(t, err, "Invalid orderBy for a")
+	})
+}
+
+func TestFindWithCursorConcurrentWrites(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b Int
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	rows := []builder.TDBTableRow{}
+	for i := 1; i <= 10; i++ {
+		row, _ := Create(table, QueryArg{"b": i})
+		rows = append(rows, row)
+	}
+
+	order_by := OrderByList{{Field: "b", Order: OrderByAsc}}
+	page, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 5}, true)
+	assert.NilError(t, err)
+	cursor, err := NewCursor(table, order_by, page[len(page)-1])
+	assert.NilError(t, err)
+
+	// rows deleted or inserted before the cursor must not shift the next page
+	Delete(table, rows[0], "")
+	Delete(table, rows[4], "")
+	Create(table, QueryArg{"b": 0})
+	Create(table, QueryArg{"b": 7})
+
+	page, err = FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 5, After: cursor}, true)
+	assert.NilError(t, err)
+	values := []int{}
+	for _, row := range page {
+		values = append(values, row.Get("b").(int))
+	}
+	assert.DeepEqual(t, values, []int{6, 7, 7, 8, 9})
+}
+
+func TestFindWithCursorUniqueIndex(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b Int unique(true)
+    c Int
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	rows := []builder.TDBTableRow{}
+	for i := 1; i <= 10; i++ {
+		row, _ := Create(table, QueryArg{"b": i * 10, "c": i % 2})
+		rows = append(rows, row)
+	}
+
+	values := func(page []builder.TDBTableRow) []int {
+		values := []int{}
+		for _, row := range page {
+			values = append(values, row.Get("b").(int))
+		}
+		return values
+	}
+
+	// the first seek sorts the index, and the next seek sorts it again after rows are written
+	order_by := OrderByList{{Field: "b", Order: OrderByAsc}}
+	cursor, err := NewCursor(table, order_by, rows[0])
+	assert.NilError(t, err)
+	page, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 2, After: cursor}, true)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, values(page), []int{20, 30})
+
+	_, err = Update(table, rows[3], QueryArg{"b": 35}, "")
+	assert.NilError(t, err)
+	_, err = Create(table, QueryArg{"b": 110, "c": 0})
+	assert.NilError(t, err)
+	_, err = Delete(table, rows[5], "")
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		order OrderBy
+		first []int
+		next  []int
+	}{
+		{OrderByAsc, []int{10, 20, 30}, []int{35, 80, 100, 110}},
+		{OrderByDesc, []int{110, 100, 90}, []int{80, 35, 20}},
+	} {
+		order_by := OrderByList{{Field: "b", Order: tc.order}}
+		page, err := FindWithArgs(context.Background(), table, FindArgs{OrderBy: order_by, Take: 3}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, values(page), tc.first)
+
+		cursor, err := NewCursor(table, order_by, page[len(page)-1])
+		assert.NilError(t, err)
+		page, err = FindWithArgs(context.Background(), table, FindArgs{Where: QueryArg{"c": 0}, OrderBy: order_by, Take: 4, After: cursor}, true)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, values(page), tc.next)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a {
+    b String unique(true)
+    c Int
+    d String
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	for i := 1; i <= 9; i++ {
+		Create(table, QueryArg{"b": fmt.Sprint(i), "c": i % 3, "d": fmt.Sprint(i % 2)})
+	}
+
+	t.Run("single field", func(t *testing.T) {
+		found, err := Distinct(context.Background(), table, []string{"c"}, nil)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, found, []builder.TDBTableRow{{"c": 1}, {"c": 2}, {"c": 0}})
+	})
+
+	t.Run("multiple fields", func(t *testing.T) {
+		found, err := Distinct(context.Background(), table, []string{"c", "d"}, QueryArg{"c": map[string]any{"gt": 0}})
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 4)
+	})
+
+	t.Run("unique index", func(t *testing.T) {
+		found, err := Distinct(context.Background(), table, []string{"b"}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 9)
+		assert.DeepEqual(t, found[0], builder.TDBTableRow{"b": "1"})
+	})
+
+	t.Run("null unique values", func(t *testing.T) {
+		schema, err := builder.NewSchemaFromString(`
+$TABLE e {
+    b String unique(true) optional(true)
+}
+    `, nil, false)
+		assert.NilError(t, err)
+		table := schema.Tables.Get("e")
+		for _, b := range []any{nil, "x", nil, "y"} {
+			_, err := Create(table, QueryArg{"b": b})
+			assert.NilError(t, err)
+		}
+		found, err := Distinct(context.Background(), table, []string{"b"}, nil)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, found, []builder.TDBTableRow{{"b": nil}, {"b": "x"}, {"b": "y"}})
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := Distinct(context.Background(), table, []string{"x"}, nil)
+		assert.ErrorContains(t, err, "Distinct field x does not exist")
+	})
+
+	t.Run("find many", func(t *testing.T) {
+		found, err := FindWithArgs(context.Background(), table, FindArgs{
+			Distinct: []string{"d"},
+			OrderBy:  OrderByList{{Field: "d", Order: OrderByDesc}},
+		}, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 2)
+		assert.Equal(t, found[0].Get("d"), "1")
+		assert.Equal(t, found[0].Get("b"), "1")
+		assert.Equal(t, found[1].Get("d"), "0")
+	})
+}
+
 func TestDelete(t *testing.T) {
 	t.Run("delete", func(t *testing.T) {
 		schema, _ := builder.NewSchemaFromString(`
@@ -312,7 +790,7 @@ $TABLE a {
 
 		assert.Equal(t, len(table.IndexMap("b").Map), 1)
 
-		Delete(table, row)
+		Delete(table, row, "")
 
 		assert.Equal(t, len(table.IndexMap("b").Map), 0)
 		assert.Equal(t, table.Rows().Len(), 0)
@@ -327,9 +805,379 @@ $TABLE a {
 		table := schema.Tables.Get("a")
 		Create(table, QueryArg{"b": "hello"})
 
-		Delete(table, builder.TDBTableRow{"b": "world"})
+		Delete(table, builder.TDBTableRow{"b": "world"}, "")
+
+		assert.Equal(t, table.Rows().Len(), 1)
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	expire := func(table *builder.Table, row builder.TDBTableRow) {
+		row.Set(builder.SYS_EXPIRES_AT, time.Now().Add(-time.Second))
+		table.Rows().Replace(builder.GetPrimaryKey(row), row)
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a ttl(1h) {
+    b String unique(true)
+}
+    `, nil, false)
+		table := schema.Tables.Get("a")
+		row, err := Create(table, QueryArg{"b": "hello"})
+		assert.NilError(t, err)
+		expires_at, ok := row.Get(builder.SYS_EXPIRES_AT).(time.Time)
+		assert.Assert(t, ok)
+		assert.Assert(t, time.Until(expires_at) > 59*time.Minute)
+		_, err = Create(table, QueryArg{"b": "world"})
+		assert.NilError(t, err)
+
+		expire(table, row)
+
+		_, err = FindUnique(table, QueryArg{"b": "hello"})
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusNotFound)
+		found, err := Find(context.Background(), table, nil, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 1)
+		assert.Equal(t, found[0].Get("b"), "world")
+		found, err = FindWithArgs(context.Background(), table, FindArgs{Distinct: []string{"b"}}, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 1)
+
+		// the value of an expired row can be used again before it is swept
+		_, err = Create(table, QueryArg{"b": "hello"})
+		assert.NilError(t, err)
+	})
+
+	t.Run("expiresAt", func(t *testing.T) {
+		schema, _ := builder.NewSchemaFromString(`
+$TABLE a expiresAt(until) {
+    id Int key(primary)
+    until Date optional(true)
+}
+    `, nil, false)
+		table := schema.Tables.Get("a")
+		for _, until := range []any{time.Now().Add(-time.Second), nil, time.Now().Add(time.Hour)} {
+			row, err := Create(table, QueryArg{"until": until})
+			assert.NilError(t, err)
+			assert.Assert(t, !row.Has(builder.SYS_EXPIRES_AT))
+		}
+
+		found, err := Find(context.Background(), table, nil, true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(found), 2)
+		_, err = FindUnique(table, QueryArg{"id": 1})
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusNotFound)
+		_, err = FindUnique(table, QueryArg{"id": 2})
+		assert.NilError(t, err)
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a softDelete(true) {
+    b String unique(true)
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	ctx := context.Background()
+
+	first, _ := Create(table, QueryArg{"b": "hello"})
+	deleted, err := Delete(table, first, "")
+	assert.NilError(t, err)
+	assert.Assert(t, builder.IsDeleted(deleted))
+	assert.Equal(t, table.Rows().Len(), 1)
+	assert.Assert(t, !table.IndexMap("b").Has("hello"))
+
+	second, err := Create(table, QueryArg{"b": "hello"})
+	assert.NilError(t, err)
+	Delete(table, second, "")
+
+	found, err := Find(ctx, table, nil, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(found), 0)
+	found, err = FindWithArgs(ctx, table, FindArgs{IncludeDeleted: true}, true)
+	assert.NilError(t, err)
+	assert.Equal(t, len(found), 2)
+
+	// both rows use the same unique value
+	found, err = FindDeleted(ctx, table, nil)
+	assert.NilError(t, err)
+	_, err = Restore(table, found)
+	assert.Equal(t, err.(*QueryError).Status(), http.StatusConflict)
+	assert.Assert(t, !table.IndexMap("b").Has("hello"))
+
+	restored, err := Restore(table, found[1:])
+	assert.NilError(t, err)
+	assert.Assert(t, !builder.IsDeleted(restored[0]))
+	assert.Equal(t, table.IndexMap("b").Get("hello"), builder.GetPrimaryKey(second))
+
+	Purge(table, found[:1])
+	assert.Equal(t, table.Rows().Len(), 1)
+	found, err = FindDeleted(ctx, table, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(found), 0)
+}
+
+func TestHistory(t *testing.T) {
+	schema, _ := builder.NewSchemaFromString(`
+$TABLE a history(true) {
+    b String unique(true)
+    c Int
+}
+
+$TABLE d {
+    e Int
+}
+    `, nil, false)
+	table := schema.Tables.Get("a")
+	history := table.History()
+	assert.Assert(t, history != nil)
+	ctx := context.Background()
+
+	// the clock must move on between writes for their versions to be told apart
+	tick := func() time.Time {
+		time.Sleep(time.Millisecond)
+		now := time.Now()
+		time.Sleep(time.Millisecond)
+		return now
+	}
+
+	before := tick()
+	row, err := Create(table, QueryArg{"b": "x", "c": 1})
+	assert.NilError(t, err)
+	id := builder.GetPrimaryKey(row)
+	created := tick()
+	row, err = Update(table, row, QueryArg{"c": 2}, "user-1")
+	assert.NilError(t, err)
+	updated := tick()
+	Delete(table, row, "user-2")
+	deleted := tick()
+
+	assert.Equal(t, history.Rows().Len(), 2)
+	entries, err := Find(ctx, history, nil, true)
+	assert.NilError(t, err)
+	assert.Equal(t, entries[0].Get(builder.HISTORY_FIELD_OPERATION), "update")
+	assert.Equal(t, entries[0].Get(builder.HISTORY_FIELD_ACTOR), "user-1")
+	assert.Equal(t, entries[1].Get(builder.HISTORY_FIELD_OPERATION), "delete")
+	assert.Equal(t, entries[1].Get(builder.HISTORY_FIELD_ACTOR), "user-2")
+
+	for _, c := range []struct {
+		at   time.Time
+		want []any
+	}{
+		{before, []any{}},
+		{created, []any{1}},
+		{updated, []any{2}},
+		{deleted, []any{}},
+	} {
+		found, err := FindWithArgs(ctx, table, FindArgs{AsOf: &c.at}, true)
+		assert.NilError(t, err)
+		got := []any{}
+		for _, row := range found {
+			assert.Equal(t, builder.GetPrimaryKey(row), id)
+			got = append(got, row.Get("c"))
+		}
+		assert.DeepEqual(t, got, c.want)
+	}
+
+	found, err := FindUniqueAsOf(table, QueryArg{"b": "x"}, created, false)
+	assert.NilError(t, err)
+	assert.Equal(t, found.Get("c"), 1)
+	assert.Equal(t, builder.GetPrimaryKey(found), id)
+	assert.Assert(t, !found.Has(builder.HISTORY_FIELD_ROW_ID))
+	_, err = FindUniqueAsOf(table, QueryArg{"b": "x"}, deleted, false)
+	assert.Equal(t, err.(*QueryError).Status(), http.StatusNotFound)
+
+	_, err = FindWithArgs(ctx, schema.Tables.Get("d"), FindArgs{AsOf: &deleted}, true)
+	assert.Equal(t, err.(*QueryError).Status(), http.StatusBadRequest)
+
+	// a row isn't deleted when its history entry can't be written
+	row, err = Create(table, QueryArg{"b": "y", "c": 1})
+	assert.NilError(t, err)
+	next := int(history.IdTracker.Load()) + 1
+	assert.Assert(t, history.Rows().Insert(next, builder.TDBTableRow{builder.SYS_PRIMARY_KEY: next}))
+	_, err = Delete(table, row, "")
+	assert.ErrorContains(t, err, "to its history")
+	assert.Assert(t, table.Rows().Has(builder.GetPrimaryKey(row)))
+	assert.Assert(t, table.IndexMap("b").Has("y"))
+}
+
+func TestHooks(t *testing.T) {
+	t.Run("registered", func(t *testing.T) {
+		s, err := builder.NewSchemaFromString(`
+$TABLE hooked {
+    b String
+    c String optional(true)
+}
+        `, nil, false)
+		assert.NilError(t, err)
+		table := s.Tables.Get("hooked")
+
+		after := []HookEvent{}
+		unregister := []func(){
+			RegisterHook("", "hooked", HookBeforeCreate, func(ctx *HookCtx) error {
+				ctx.Data["c"] = "stamped"
+				return nil
+			}),
+			RegisterHook("", "hooked", HookBeforeUpdate, func(ctx *HookCtx) error {
+				if ctx.Data["b"] == "rejected" {
+					return NewQueryError(http.StatusBadRequest, "b can't be rejected")
+				}
+				return nil
+			}),
+			RegisterHook("", "hooked", HookBeforeDelete, func(ctx *HookCtx) error {
+				if ctx.Before.Get("b") == "kept" {
+					return NewQueryError(http.StatusForbidden, "row is kept")
+				}
+				return nil
+			}),
+			RegisterHook("other", "hooked", HookBeforeCreate, func(ctx *HookCtx) error {
+				return fmt.Errorf("hook of another database")
+			}),
+		}
+		for _, event := range []HookEvent{HookAfterCreate, HookAfterUpdate, HookAfterDelete} {
+			unregister = append(unregister, RegisterHook("", "hooked", event, func(ctx *HookCtx) error {
+				after = append(after, ctx.Event)
+				return fmt.Errorf("after hook errors are only logged")
+			}))
+		}
+
+		data := QueryArg{"b": "hello"}
+		row, err := Create(table, data)
+		assert.NilError(t, err)
+		assert.Equal(t, row.Get("c"), "stamped")
+		assert.Assert(t, !data.Has("c"))
+
+		_, err = Update(table, row, QueryArg{"b": "rejected"}, "")
+		assert.ErrorContains(t, err, "b can't be rejected")
+		assert.Equal(t, err.(*QueryError).Status(), http.StatusBadRequest)
+		assert.Equal(t, table.Row(builder.GetPrimaryKey(row)).Get("b"), "hello")
 
+		kept, err := Update(table, row, QueryArg{"b": "kept"}, "")
+		assert.NilError(t, err)
+		_, err = Delete(table, kept, "")
+		assert.ErrorContains(t, err, "row is kept")
 		assert.Equal(t, table.Rows().Len(), 1)
+
+		other, err := Create(table, QueryArg{"b": "other"})
+		assert.NilError(t, err)
+		_, err = Delete(table, other, "")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, after, []HookEvent{HookAfterCreate, HookAfterUpdate, HookAfterCreate, HookAfterDelete})
+
+		for _, f := range unregister {
+			f()
+		}
+		row, err = Create(table, QueryArg{"b": "hello"})
+		assert.NilError(t, err)
+		assert.Assert(t, row.Get("c") == nil)
+		assert.Equal(t, len(after), 4)
+	})
+
+	t.Run("copy and counter", func(t *testing.T) {
+		s, err := builder.NewSchemaFromString(`
+$TABLE user {
+    id Int key(primary)
+    name String
+    posts Int default(0)
+}
+
+$TABLE post {
+    id Int key(primary)
+    title String
+    slug String copy(title)
+    author Int relation(user.id) counter(posts)
+    author_name String optional(true) copy(author.name)
+}
+        `, nil, false)
+		assert.NilError(t, err)
+		users := s.Tables.Get("user")
+		posts := s.Tables.Get("post")
+
+		a, err := Create(users, QueryArg{"name": "a"})
+		assert.NilError(t, err)
+		b, err := Create(users, QueryArg{"name": "b"})
+		assert.NilError(t, err)
+
+		post, err := Create(posts, QueryArg{"title": "hello", "author": builder.GetPrimaryKey(a)})
+		assert.NilError(t, err)
+		assert.Equal(t, post.Get("slug"), "hello")
+		assert.Equal(t, post.Get("author_name"), "a")
+		assert.Equal(t, users.Row(builder.GetPrimaryKey(a)).Get("posts"), 1)
+
+		post, err = Update(posts, post, QueryArg{"title": "bye", "author": builder.GetPrimaryKey(b)}, "")
+		assert.NilError(t, err)
+		assert.Equal(t, post.Get("slug"), "bye")
+		assert.Equal(t, post.Get("author_name"), "b")
+		assert.Equal(t, users.Row(builder.GetPrimaryKey(a)).Get("posts"), 0)
+		assert.Equal(t, users.Row(builder.GetPrimaryKey(b)).Get("posts"), 1)
+
+		_, err = Create(posts, QueryArg{"title": "hello", "slug": "hi", "author": builder.GetPrimaryKey(a)})
+		assert.ErrorContains(t, err, "slug is a copy and cannot be explicitly set")
+		_, err = Update(posts, post, QueryArg{"slug": "hi"}, "")
+		assert.ErrorContains(t, err, "slug is a copy and cannot be updated")
+
+		_, err = Delete(posts, post, "")
+		assert.NilError(t, err)
+		assert.Equal(t, users.Row(builder.GetPrimaryKey(b)).Get("posts"), 0)
+	})
+
+	t.Run("imports, purges and expired rows", func(t *testing.T) {
+		s, err := builder.NewSchemaFromString(`
+$TABLE swept_user {
+    id Int key(primary)
+    posts Int default(0)
+}
+
+$TABLE swept_post softDelete(true) ttl(1h) {
+    author Int relation(swept_user.id) counter(posts)
+}
+        `, nil, false)
+		assert.NilError(t, err)
+		users := s.Tables.Get("swept_user")
+		posts := s.Tables.Get("swept_post")
+		events := []HookEvent{}
+		for _, event := range []HookEvent{HookAfterCreate, HookAfterDelete} {
+			defer RegisterHook("", "swept_post", event, func(ctx *HookCtx) error {
+				events = append(events, ctx.Event)
+				return nil
+			})()
+		}
+		posts_of := func() any { return users.Row(1).Get("posts") }
+
+		// imported rows keep the counts they were exported with
+		_, err = Import(users, []QueryArg{{"id": 1, "posts": 1}}, nil)
+		assert.NilError(t, err)
+		_, err = Import(posts, []QueryArg{{"author": 1}}, nil)
+		assert.NilError(t, err)
+		assert.Equal(t, posts_of(), 1)
+		assert.Equal(t, len(events), 0)
+
+		// purged rows were already counted out when they were soft deleted
+		deleted, err := Delete(posts, posts.Row(1), "")
+		assert.NilError(t, err)
+		assert.Equal(t, posts_of(), 0)
+		Purge(posts, []builder.TDBTableRow{deleted})
+		assert.Equal(t, posts_of(), 0)
+		assert.DeepEqual(t, events, []HookEvent{HookAfterDelete})
+
+		// expired rows run the afterDelete hooks when they are swept,
+		// unless they were soft deleted already
+		_, err = Create(posts, QueryArg{"author": 1})
+		assert.NilError(t, err)
+		post, err := Create(posts, QueryArg{"author": 1})
+		assert.NilError(t, err)
+		_, err = Delete(posts, post, "")
+		assert.NilError(t, err)
+		assert.Equal(t, posts_of(), 1)
+		events = events[:0]
+		n, err := posts.SweepExpired(context.Background(), time.Now().Add(2*time.Hour), AfterExpired)
+		assert.NilError(t, err)
+		assert.Equal(t, n, 2)
+		assert.Equal(t, posts.Rows().Len(), 0)
+		assert.Equal(t, posts_of(), 0)
+		assert.DeepEqual(t, events, []HookEvent{HookAfterDelete})
 	})
 }
 
@@ -1,9 +1,13 @@
 package query
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
-	"sort"
+	"slices"
+	"time"
 
 	"github.com/tobsdb/tobsdb/internal/builder"
 	"github.com/tobsdb/tobsdb/internal/parser"
@@ -12,30 +16,14 @@ import (
 	"github.com/tobsdb/tobsdb/pkg"
 )
 
-type OrderBy string
+var ERR_EMPTY_WHERE = errors.New("Where constraints cannot be empty")
 
-const (
-	OrderByAsc  OrderBy = "asc"
-	OrderByDesc OrderBy = "desc"
-)
-
-func sortRowsByField(field *builder.Field, rows []builder.TDBTableRow, order OrderBy) []builder.TDBTableRow {
-	sort.SliceStable(rows, func(i, j int) bool {
-		a, b := rows[i].Get(field.Name), rows[j].Get(field.Name)
-		if order == "desc" {
-			return field.IsLess(b, a)
-		}
-		return field.IsLess(a, b)
-	})
-	return rows
-}
-
-func findManyUtil(table *builder.Table, where QueryArg, allow_empty_where bool) ([]builder.TDBTableRow, error) {
+func findManyUtil(ctx context.Context, table *builder.Table, where QueryArg, allow_empty_where, include_deleted bool) ([]builder.TDBTableRow, error) {
 	if allow_empty_where && (where == nil || len(where) == 0) {
 		// nil comparison works here
-		return filterRows(table, "", nil), nil
+		return filterRows(ctx, table, "", nil, include_deleted)
 	} else if where == nil || len(where) == 0 {
-		return nil, fmt.Errorf("Where constraints cannot be empty")
+		return nil, ERR_EMPTY_WHERE
 	}
 
 	found_rows := [](builder.TDBTableRow){}
@@ -58,7 +46,10 @@ func findManyUtil(table *builder.Table, where QueryArg, allow_empty_where bool)
 				return s_field.Compare(row.Get(index), input)
 			})
 		} else if !has_searched {
-			found_rows = filterRows(table, index, input)
+			var err error
+			if found_rows, err = filterRows(ctx, table, index, input, include_deleted); err != nil {
+				return nil, err
+			}
 		}
 		has_searched = true
 	}
@@ -76,7 +67,10 @@ func findManyUtil(table *builder.Table, where QueryArg, allow_empty_where bool)
 				return field.Compare(row.Get(field.Name), input)
 			})
 		} else if !contains_index && !has_searched {
-			found_rows = filterRows(table, field.Name, input)
+			var err error
+			if found_rows, err = filterRows(ctx, table, field.Name, input, include_deleted); err != nil {
+				return nil, err
+			}
 		}
 		has_searched = true
 	}
@@ -84,6 +78,11 @@ func findManyUtil(table *builder.Table, where QueryArg, allow_empty_where bool)
 	return found_rows, nil
 }
 
+// Matches reports whether the row meets the constraints of a where clause
+func Matches(table *builder.Table, row builder.TDBTableRow, where QueryArg) bool {
+	return compareUtil(table, row, where)
+}
+
 func compareUtil(t_schema *builder.Table, row builder.TDBTableRow, constraints QueryArg) bool {
 	for _, field := range t_schema.Fields.Idx {
 		if !constraints.Has(field.Name) {
@@ -97,35 +96,48 @@ func compareUtil(t_schema *builder.Table, row builder.TDBTableRow, constraints Q
 	return true
 }
 
-func findFirst(table *builder.Table, field_name string, value any) builder.TDBTableRow {
-	found := _filterRows(table, field_name, value, true)
-	if len(found) == 0 {
-		return nil
+// isVisible reports whether queries can see the row.
+// Expired rows stay hidden until the sweeper deletes them,
+// and soft deleted rows are only seen with include_deleted.
+func isVisible(table *builder.Table, row builder.TDBTableRow, now time.Time, include_deleted bool) bool {
+	if !include_deleted && builder.IsDeleted(row) {
+		return false
 	}
-	return found[0]
+	return !table.IsExpired(row, now)
 }
 
-func filterRows(table *builder.Table, field_name string, value any) []builder.TDBTableRow {
-	return _filterRows(table, field_name, value, false)
+// findFirst returns the first row where field_name matches value, or nil when there is none.
+// The scan stops at the first match so it is not cancelable.
+func findFirst(table *builder.Table, field_name string, value any) (builder.TDBTableRow, error) {
+	found, err := _filterRows(context.Background(), table, field_name, value, true, false)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return found[0], nil
 }
 
-func _filterRows(t_schema *builder.Table, field_name string, value any, exit_first bool) []builder.TDBTableRow {
-	found_rows := []builder.TDBTableRow{}
-	t_schema.Rows().GetLocker().RLock()
-	defer t_schema.Rows().GetLocker().RUnlock()
+func filterRows(ctx context.Context, table *builder.Table, field_name string, value any, include_deleted bool) ([]builder.TDBTableRow, error) {
+	return _filterRows(ctx, table, field_name, value, false, include_deleted)
+}
 
+func _filterRows(ctx context.Context, t_schema *builder.Table, field_name string, value any, exit_first, include_deleted bool) ([]builder.TDBTableRow, error) {
+	found_rows := []builder.TDBTableRow{}
 	s_field := t_schema.Fields.Get(field_name)
+	now := time.Now()
 
-	for row := range t_schema.Rows().Records() {
-		if s_field.Compare(row.Val.Get(field_name), value) {
-            found_rows = append(found_rows, row.Val)
-            if exit_first {
-                return found_rows
-            }
+	for row, err := range t_schema.Rows().Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		if isVisible(t_schema, row, now, include_deleted) && s_field.Compare(row.Get(field_name), value) {
+			found_rows = append(found_rows, row)
+			if exit_first {
+				break
+			}
 		}
 	}
 
-	return found_rows
+	return found_rows, nil
 }
 
 // validateRelation() checks if the row implied by the relation exists
@@ -140,7 +152,10 @@ func validateRelation(table *builder.Table, field *builder.Field, id *int, data
 		return nil
 	}
 
-	rel_row := findFirst(rel_table_schema, rel_field_name, data)
+	rel_row, err := findFirst(rel_table_schema, rel_field_name, data)
+	if err != nil {
+		return err
+	}
 
 	if rel_row == nil {
 		if !field.Properties.Has(props.FieldPropOptional) {
@@ -181,6 +196,42 @@ func validateUnique(t_schema *builder.Table, field *builder.Field, data any) err
 	return nil
 }
 
+// CheckVersion returns a conflict error when the row's version is not version,
+// meaning the row changed since the client read it
+func CheckVersion(row builder.TDBTableRow, version int) error {
+	if current := builder.GetVersion(row); current != version {
+		return NewQueryError(
+			http.StatusConflict,
+			fmt.Sprintf("Row %d changed: version is %d, expected %d", builder.GetPrimaryKey(row), current, version),
+		)
+	}
+	return nil
+}
+
+// CheckVersions checks the rows matched by an update against the versions a client read them at, keyed by row id.
+// Every matched row must have a version, and every version must be of a matched row,
+// so rows that changed to or from matching since they were read are also conflicts.
+func CheckVersions(rows []builder.TDBTableRow, versions map[int]int) error {
+	matched := map[int]bool{}
+	for _, row := range rows {
+		key := builder.GetPrimaryKey(row)
+		version, ok := versions[key]
+		if !ok {
+			return NewQueryError(http.StatusConflict, fmt.Sprintf("Row %d changed: it matches where but has no version in ifVersion", key))
+		}
+		if err := CheckVersion(row, version); err != nil {
+			return err
+		}
+		matched[key] = true
+	}
+	for _, key := range slices.Sorted(maps.Keys(versions)) {
+		if !matched[key] {
+			return NewQueryError(http.StatusConflict, fmt.Sprintf("Row %d changed: it no longer matches where", key))
+		}
+	}
+	return nil
+}
+
 type QueryError struct {
 	msg    string
 	status int
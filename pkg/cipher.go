@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// size of an AES-256 key
+	KEY_SIZE = 32
+	// bytes a Cipher adds to each message: a GCM nonce and tag
+	CIPHER_OVERHEAD = 12 + 16
+
+	// version 2 files authenticate the file's name along with their header
+	ENCRYPTED_FILE_VERSION = 2
+)
+
+var ENCRYPTED_FILE_MAGIC = []byte("TDBE")
+
+var (
+	ERR_ENCRYPTED     = errors.New("data is encrypted and no key was given")
+	ERR_NOT_ENCRYPTED = errors.New("data is not encrypted")
+	ERR_DECRYPT       = errors.New("failed to decrypt data: wrong key or corrupt data")
+)
+
+// Cipher encrypts data with AES-256-GCM, using a new random nonce for every message.
+// A nil *Cipher leaves data unencrypted.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KEY_SIZE, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead}, nil
+}
+
+// ParseKey decodes a base64 encoded key, ignoring surrounding whitespace
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KEY_SIZE, len(key))
+	}
+	return key, nil
+}
+
+// Overhead is the number of bytes Seal adds to a message
+func (c *Cipher) Overhead() int { return CIPHER_OVERHEAD }
+
+// Seal encrypts data and returns the nonce followed by the ciphertext.
+// aad is authenticated but not encrypted; the same aad must be given to Open.
+func (c *Cipher) Seal(data, aad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.Overhead()+len(data))
+	if _, err := rand.Read(nonce); err != nil {
+		FatalLog("failed to generate nonce", err)
+	}
+	return c.aead.Seal(nonce, nonce, data, aad)
+}
+
+func (c *Cipher) Open(data, aad []byte) ([]byte, error) {
+	if len(data) < c.Overhead() {
+		return nil, ERR_DECRYPT
+	}
+	n := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, data[:n], data[n:], aad)
+	if err != nil {
+		return nil, ERR_DECRYPT
+	}
+	return plain, nil
+}
+
+func encryptedFileHeader(version byte) []byte {
+	return append(bytes.Clone(ENCRYPTED_FILE_MAGIC), version)
+}
+
+// encryptedFileAAD binds an encrypted file to its name, so a file can't be swapped for another file encrypted with the same key
+func encryptedFileAAD(header []byte, name string) []byte {
+	return append(bytes.Clone(header), name...)
+}
+
+// IsEncryptedFile reports whether data was written by EncryptFile
+func IsEncryptedFile(data []byte) bool {
+	return bytes.HasPrefix(data, ENCRYPTED_FILE_MAGIC)
+}
+
+// EncryptFile returns the contents of an encrypted file holding data.
+// name is the file's path relative to the db directory, and the file must be decrypted with the same name.
+// It returns data unchanged when c is nil.
+func (c *Cipher) EncryptFile(data []byte, name string) []byte {
+	if c == nil {
+		return data
+	}
+	header := encryptedFileHeader(ENCRYPTED_FILE_VERSION)
+	return append(header, c.Seal(data, encryptedFileAAD(header, name))...)
+}
+
+// DecryptFile returns the data of a file written by EncryptFile.
+// When c is nil the file must not be encrypted, and when it is set the file must be.
+func (c *Cipher) DecryptFile(data []byte, name string) ([]byte, error) {
+	if !IsEncryptedFile(data) {
+		if c != nil {
+			return nil, ERR_NOT_ENCRYPTED
+		}
+		return data, nil
+	}
+	if c == nil {
+		return nil, ERR_ENCRYPTED
+	}
+
+	n := len(ENCRYPTED_FILE_MAGIC) + 1
+	if len(data) < n || data[n-1] != ENCRYPTED_FILE_VERSION {
+		return nil, fmt.Errorf("unsupported encrypted file version")
+	}
+	return c.Open(data[n:], encryptedFileAAD(data[:n], name))
+}
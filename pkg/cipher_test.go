@@ -0,0 +1,83 @@
+package pkg_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	. "github.com/tobsdb/tobsdb/pkg"
+	"gotest.tools/assert"
+)
+
+func newTestCipher(t *testing.T) *Cipher {
+	key := make([]byte, KEY_SIZE)
+	_, err := rand.Read(key)
+	assert.NilError(t, err)
+	c, err := NewCipher(key)
+	assert.NilError(t, err)
+	return c
+}
+
+func TestCipherSeal(t *testing.T) {
+	c := newTestCipher(t)
+	data := []byte("some data")
+
+	sealed := c.Seal(data, []byte("aad"))
+	assert.Equal(t, len(sealed), len(data)+c.Overhead())
+	// each message gets its own nonce
+	assert.Assert(t, !bytes.Equal(sealed, c.Seal(data, []byte("aad"))))
+
+	plain, err := c.Open(sealed, []byte("aad"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, plain, data)
+
+	_, err = c.Open(sealed, []byte("other"))
+	assert.Equal(t, err, ERR_DECRYPT)
+	_, err = newTestCipher(t).Open(sealed, []byte("aad"))
+	assert.Equal(t, err, ERR_DECRYPT)
+	_, err = c.Open(sealed[:10], []byte("aad"))
+	assert.Equal(t, err, ERR_DECRYPT)
+}
+
+func TestCipherFile(t *testing.T) {
+	c := newTestCipher(t)
+	data := []byte(`{"databases":[]}`)
+
+	encrypted := c.EncryptFile(data, "db/meta.1.tdb")
+	assert.Assert(t, IsEncryptedFile(encrypted))
+	plain, err := c.DecryptFile(encrypted, "db/meta.1.tdb")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, plain, data)
+	// a file moved to another name fails to decrypt
+	_, err = c.DecryptFile(encrypted, "db/meta.2.tdb")
+	assert.Equal(t, err, ERR_DECRYPT)
+
+	// files of another version are rejected, even when they would decrypt
+	header := append(bytes.Clone(ENCRYPTED_FILE_MAGIC), ENCRYPTED_FILE_VERSION-1)
+	_, err = c.DecryptFile(append(header, c.Seal(data, header)...), "db/meta.1.tdb")
+	assert.ErrorContains(t, err, "unsupported encrypted file version")
+
+	var none *Cipher
+	assert.DeepEqual(t, none.EncryptFile(data, "meta.tdb"), data)
+	plain, err = none.DecryptFile(data, "meta.tdb")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, plain, data)
+
+	_, err = none.DecryptFile(encrypted, "db/meta.1.tdb")
+	assert.Equal(t, err, ERR_ENCRYPTED)
+	_, err = c.DecryptFile(data, "db/meta.1.tdb")
+	assert.Equal(t, err, ERR_NOT_ENCRYPTED)
+}
+
+func TestParseKey(t *testing.T) {
+	key := make([]byte, KEY_SIZE)
+	parsed, err := ParseKey(base64.StdEncoding.EncodeToString(key) + "\n")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed, key)
+
+	_, err = ParseKey(base64.StdEncoding.EncodeToString(key[:16]))
+	assert.ErrorContains(t, err, "must be 32 bytes")
+	_, err = ParseKey("not base64!")
+	assert.ErrorContains(t, err, "invalid key")
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// WriteFileAtomic writes data to name so that a crash leaves either the previous or the new contents, never a partial file.
+// The data is written to a temporary file in the same directory, synced to disk, and renamed over name.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicFunc(name, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteFileAtomicFunc is WriteFileAtomic for contents that are written by write instead of held in memory
+func WriteFileAtomicFunc(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir := path.Dir(name)
+	f, err := os.CreateTemp(dir, "."+path.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir flushes a directory's entries to disk so renames and removals in it are durable
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
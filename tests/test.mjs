@@ -143,7 +143,7 @@ await test("NESTED vectors", async (t) => {
     });
 
     assert.strictEqual(r_create.status, 201, r_create.message);
-    assert.strictEqual(r_create.data.length, count);
+    assert.strictEqual(r_create.data.created.length, count);
 
     const res = await API("findMany", {
       table: "nested_vec",
@@ -235,11 +235,9 @@ await test("CREATE", async (t) => {
       }),
     });
 
-    assert.strictEqual(res.data.length, count);
-    assert.strictEqual(
-      res.data[res.data.length - 1].id - res.data[0].id,
-      count - 1,
-    );
+    const created = res.data.created;
+    assert.strictEqual(created.length, count);
+    assert.strictEqual(created[created.length - 1].id - created[0].id, count - 1);
     assert.strictEqual(
       res.message,
       `Created ${count} new rows in table ${table}`,
@@ -255,12 +253,13 @@ await test("CREATE", async (t) => {
       });
 
       assert.strictEqual(res.status, 201, res.message);
-      assert.strictEqual(res.data.length, 2);
-      assert.strictEqual(res.data[1].auto - res.data[0].auto, 1);
+      const created = res.data.created;
+      assert.strictEqual(created.length, 2);
+      assert.strictEqual(created[1].auto - created[0].auto, 1);
 
       const check = await API("findMany", {
         table: "autoincr",
-        where: { auto: { gte: res.data[0].auto } },
+        where: { auto: { gte: created[0].auto } },
       });
 
       assert.strictEqual(check.status, 200, check.message);
@@ -356,7 +355,7 @@ await test("FIND", async (t) => {
     });
 
     assert.strictEqual(r_create.status, 201, r_create.message);
-    assert.strictEqual(r_create.data.length, count);
+    assert.strictEqual(r_create.data.created.length, count);
 
     const res = await API("findMany", {
       table: "example",
@@ -95,7 +95,7 @@ export default class TobsDB<const Schema extends Record<string, object>> {
   }
 
   private async __query<
-    T extends QueryType.Unique | QueryType.Many,
+    T extends QueryType.Unique | QueryType.Many | QueryType.Created,
     const Table extends keyof Schema & string,
   >(props: {
     action: QueryAction;
@@ -133,7 +133,7 @@ export default class TobsDB<const Schema extends Record<string, object>> {
     table: Table,
     data: CreateData<Schema[Table]>[],
   ) {
-    return this.__query<QueryType.Many, Table>({
+    return this.__query<QueryType.Created, Table>({
       action: QueryAction.CreateMany,
       table,
       data,
@@ -349,6 +349,7 @@ enum QueryType {
   Unique,
   Many,
   Schema,
+  Created,
 }
 
 export interface TDBResponse<U extends QueryType, Table extends object = {}> {
@@ -358,7 +359,9 @@ export interface TDBResponse<U extends QueryType, Table extends object = {}> {
     ? Table
     : U extends QueryType.Many
       ? Table[]
-      : string;
+      : U extends QueryType.Created
+        ? { created: Table[]; skipped: number[] }
+        : string;
   __tdb_client_req_id__: number;
 }
 
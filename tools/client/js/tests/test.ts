@@ -59,7 +59,7 @@ describe("TEEEEEEEESSSTTTTTSSSSS", async () => {
       );
 
       assert.strictEqual(r_create.status, 201);
-      assert.strictEqual(r_create.data.length, count);
+      assert.strictEqual(r_create.data.created.length, count);
 
       const res = await db.findMany("nested_vec", { vec2 });
 
@@ -190,18 +190,18 @@ impl Tobsdb {
     /// assert!(res.status == 201);
     /// assert!(res.data.is_some());
     ///
-    /// let users = res.data.unwrap();
+    /// let users = res.data.unwrap().created;
     /// assert!(users.len() == 2);
     /// ```
     pub async fn create_many<T>(
         &mut self,
         table: &str,
         data: Vec<&T>,
-    ) -> Result<types::TdbResponseMany<T>, TdbError>
+    ) -> Result<types::TdbResponse<types::TdbCreated<T>>, TdbError>
     where
         T: DeserializeOwned + Serialize,
     {
-        self.query::<Vec<&T>, _, types::TdbResponseMany<T>>(
+        self.query::<Vec<&T>, _, types::TdbResponse<types::TdbCreated<T>>>(
             "createMany",
             table,
             Some(data),
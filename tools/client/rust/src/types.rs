@@ -18,6 +18,14 @@ pub struct TdbResponse<D> {
     __tdb_client_req_id__: u64,
 }
 
+/// Data of a createMany response
+#[derive(Deserialize, Debug)]
+pub struct TdbCreated<D> {
+    pub created: Vec<D>,
+    /// indices of the rows left out as duplicates
+    pub skipped: Vec<usize>,
+}
+
 #[derive(Deserialize, Debug)]
 pub struct TdbResponseMany<D> {
     pub status: u32,